@@ -49,7 +49,7 @@ func generateValidOrder() entity.Order {
 	order.Payment.DeliveryCost = gofakeit.Number(100, 2000)
 	order.Payment.GoodsTotal = gofakeit.Number(500, 50000)
 	order.Payment.CustomFee = gofakeit.Number(0, 5000)
-	order.Payment.Amount = order.Payment.GoodsTotal + order.Payment.DeliveryCost - order.Payment.CustomFee
+	order.Payment.Amount = order.Payment.GoodsTotal + order.Payment.DeliveryCost + order.Payment.CustomFee
 	order.Payment.PaymentDt = gofakeit.DateRange(order.DateCreated, time.Now())
 
 	// Items
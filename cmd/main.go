@@ -4,50 +4,32 @@ import (
 	"context"
 	"log/slog"
 	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/Asus/L0_DemoServise/config"
-	"github.com/Asus/L0_DemoServise/internal/broker"
-	"github.com/Asus/L0_DemoServise/internal/server"
-	"github.com/Asus/L0_DemoServise/internal/service"
-	"github.com/Asus/L0_DemoServise/internal/storage"
+	"github.com/Asus/L0_DemoServise/internal/app"
+	"github.com/Asus/L0_DemoServise/internal/logger"
 )
 
 func main() {
+	logger.Setup(os.Stderr)
+
 	cfg := config.MustLoad()
 	slog.Info("Configuration loaded successfully")
 
-	stor, err := storage.NewStorage(&cfg.Storage)
+	// SIGINT/SIGTERM отменяют ctx, после чего сервис корректно останавливается
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	application, err := app.New(ctx, cfg)
 	if err != nil {
-		slog.Error("failed to init storage", "error", err)
+		slog.Error("failed to start service", "error", err)
 		os.Exit(1)
 	}
-	slog.Info("Successfully connected to DB", "host", cfg.Storage.Host, "port", cfg.Storage.Port, "dbname", cfg.Storage.DBName)
-	defer stor.Close()
 
-	Cache := service.NewCache(stor, cfg.CacheCap)
-	slog.Info("Cache layer initialized")
-
-	// Восстановление кэша
-	if err := Cache.LoadCache(context.Background()); err != nil {
-		slog.Error("failed to load cache", "error", err)
+	if err := application.Run(ctx); err != nil {
+		slog.Error("service stopped with error", "error", err)
 		os.Exit(1)
 	}
-
-	slog.Info("Cache successfully populated from database", "orders_loaded", len(Cache.OrderMap))
-
-	// Kafka consumer
-	consumer := broker.NewKafkaConsumer("localhost:9092", "orders", "order-service-group", Cache)
-	slog.Info("Kafka consumer initialized")
-
-	for i := 0; i < cfg.ConsmerNumber; i++ {
-		go func() {
-			if err := consumer.ConsumeAndSave(context.Background()); err != nil {
-				slog.Error("consumer error", "error", err)
-			}
-		}()
-	}
-
-	server := server.NewServer("localhost:8080", Cache)
-	slog.Info("HTTP server initialized", "address", "localhost:8080")
-	server.Start()
 }
@@ -2,8 +2,10 @@ package config
 
 import (
 	"encoding/json"
+	"fmt"
 	"log"
 	"os"
+	"time"
 
 	"github.com/joho/godotenv"
 )
@@ -15,8 +17,109 @@ const (
 type Config struct {
 	Env      string  `json:"env"`
 	Storage  Storage `json:"storage"`
-	CacheCap int     `json:"cache_cap"`
+	Kafka    Kafka   `json:"kafka"`
+	// где хранится кэш: "memory" (по умолчанию) - в памяти каждой реплики, "redis" - общий для реплик кэш в Redis.
+	// Для "redis" cache_cap - сколько последних заказов положить в Redis при старте, а политика,
+	// шарды, бюджет памяти, снапшот и фильтр Блума не используются
+	CacheBackend string `json:"cache_backend"`
+	Redis        Redis  `json:"redis"`
+	CacheCap     int    `json:"cache_cap"`
+	// бюджет памяти кэша в байтах: если задан, кэш ограничивается оценкой размера заказов,
+	// а cache_cap только задаёт, сколько заказов загрузить при старте
+	CacheMaxBytes int64 `json:"cache_max_bytes"`
+	// политика вытеснения из кэша: "lru" (по умолчанию), "lfu", "ttl" или "arc";
+	// cache_ttl - сколько заказ живёт в кэше при политике "ttl"
+	CachePolicy string   `json:"cache_policy"`
+	CacheTTL    Duration `json:"cache_ttl"`
+	// на сколько частей со своими блокировками делится кэш, чтобы чтения не ждали друг друга;
+	// ёмкость и бюджет памяти делятся поровну, 0 - значение по умолчанию
+	CacheShards int `json:"cache_shards"`
+	// файл снапшота кэша: пишется при остановке и каждые cache_snapshot_interval (0 - только при остановке),
+	// при старте кэш читается из него и догружает из БД заказы, сохранённые позже; пустой путь - снапшот выключен
+	CacheSnapshotPath     string   `json:"cache_snapshot_path"`
+	CacheSnapshotInterval Duration `json:"cache_snapshot_interval"`
+	// сколько ненайденных UID помнить и как долго, чтобы не ходить за ними в БД; 0 - не запоминать
+	NegativeCacheSize int      `json:"negative_cache_size"`
+	NegativeCacheTTL  Duration `json:"negative_cache_ttl"`
+	// фильтр Блума по всем UID: ожидаемое число заказов (дальше растёт сам) и допустимая доля
+	// ложных срабатываний; bloom_capacity = 0 - фильтр выключен. Фильтр работает только с kafka.invalidation_topic:
+	// без него реплика не узнает о заказах, сохранённых другими. bloom_sync_interval - как часто фильтр
+	// догружает из БД заказы, события о которых могли потеряться
+	BloomCapacity     int      `json:"bloom_capacity"`
+	BloomFPRate       float64  `json:"bloom_fp_rate"`
+	BloomSyncInterval Duration `json:"bloom_sync_interval"`
 	ConsmerNumber int `json:"consumer_number"`
+	// выключенные бизнес-правила проверки заказов: amount_total, item_total_price, item_track_number,
+	// payment_transaction, currency; теги validate проверяются всегда
+	DisabledOrderRules []string `json:"disabled_order_rules"`
+	// сколько ждём завершения консьюмеров и HTTP-запросов при остановке сервиса
+	ShutdownTimeout Duration `json:"shutdown_timeout"`
+	// дедлайн на обработку одного HTTP-запроса, по его истечении запрос к БД отменяется, а клиент получает 504
+	RequestTimeout Duration `json:"request_timeout"`
+	// ID этой реплики, по нему реплика отличает свои события инвалидации кэша от чужих.
+	// Берётся из REPLICA_ID, без него генерируется при старте
+	ReplicaID string `json:"-"`
+	// токен для /admin/* эндпоинтов, берётся из ADMIN_TOKEN; пустой - админка выключена
+	AdminToken string `json:"-"`
+}
+
+type Kafka struct {
+	Brokers []string `json:"brokers"`
+	Topic   string   `json:"topic"`
+	GroupID string   `json:"group_id"`
+	// топик, в который уходят отклонённые сообщения; пустая строка - dead-letter выключен
+	DLQTopic string `json:"dlq_topic"`
+	// повторные попытки при временных ошибках хранилища: задержка растёт экспоненциально
+	// от retry_backoff до max_retry_backoff
+	MaxRetries      int      `json:"max_retries"`
+	RetryBackoff    Duration `json:"retry_backoff"`
+	MaxRetryBackoff Duration `json:"max_retry_backoff"`
+	// топик, через который реплики сообщают друг другу о сохранённых заказах, чтобы сбросить
+	// их копии в своих кэшах; пустая строка - инвалидация между репликами выключена
+	InvalidationTopic string `json:"invalidation_topic"`
+	// топик событий смены статуса заказов; пустая строка - статусы из Kafka не читаются
+	StatusTopic string `json:"status_topic"`
+	// формат тела сообщений по топикам: "json" (по умолчанию), "avro" или "protobuf" во framing'е Confluent.
+	// Заголовок content-type сообщения важнее формата топика
+	Formats        map[string]string `json:"formats"`
+	SchemaRegistry SchemaRegistry    `json:"schema_registry"`
+}
+
+// SchemaRegistry - реестр схем с API Confluent Schema Registry, нужен для форматов avro и protobuf
+type SchemaRegistry struct {
+	URL      string   `json:"url"`
+	Username string   `json:"username"`
+	Password string   `json:"-"` // берётся из SCHEMA_REGISTRY_PASSWORD
+	Timeout  Duration `json:"timeout"`
+}
+
+type Redis struct {
+	Addr     string `json:"addr"`
+	Password string `json:"-"` // берётся из REDIS_PASSWORD
+	// база должна использоваться только кэшем заказов: по её размеру считается размер кэша
+	DB int `json:"db"`
+	// сколько заказ живёт в Redis без обращений
+	TTL Duration `json:"ttl"`
+	// локальный кэш перед Redis для самых горячих заказов; может отставать от Redis на near_cache_ttl,
+	// near_cache_size = 0 - выключен
+	NearCacheSize int      `json:"near_cache_size"`
+	NearCacheTTL  Duration `json:"near_cache_ttl"`
+}
+
+// Duration - time.Duration, который в JSON записывается строкой ("250ms", "5s")
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("duration must be a string like \"5s\": %w", err)
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
 }
 
 type Storage struct {
@@ -26,6 +129,9 @@ type Storage struct {
 	DBName     string
 	DBPassword string
 	ServerPort string
+	// что делать, если пришёл заказ с уже существующим UID, но другим содержимым:
+	// "reject" (по умолчанию) - отклонить, "upsert" - перезаписать
+	OnConflict string `json:"on_conflict"`
 }
 
 func MustLoad() *Config {
@@ -74,6 +180,11 @@ func MustLoad() *Config {
 		log.Fatal("DB_NAME environment variable is not set")
 	}
 
+	cfg.AdminToken = os.Getenv("ADMIN_TOKEN") // необязательный
+	cfg.Redis.Password = os.Getenv("REDIS_PASSWORD") // необязательный
+	cfg.ReplicaID = os.Getenv("REPLICA_ID")          // необязательный
+	cfg.Kafka.SchemaRegistry.Password = os.Getenv("SCHEMA_REGISTRY_PASSWORD") // необязательный
+
 	return &cfg
 }
 
@@ -0,0 +1,494 @@
+// пакет app собирает сервис из слоёв и управляет его жизненным циклом:
+// запускает консьюмеры и HTTP-сервер и корректно останавливает их
+
+package app
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Asus/L0_DemoServise/config"
+	"github.com/Asus/L0_DemoServise/internal/broker"
+	"github.com/Asus/L0_DemoServise/internal/entity"
+	"github.com/Asus/L0_DemoServise/internal/metrics"
+	"github.com/Asus/L0_DemoServise/internal/server"
+	"github.com/Asus/L0_DemoServise/internal/service"
+	"github.com/Asus/L0_DemoServise/internal/storage"
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	serverAddr             = "localhost:8080"
+	defaultShutdownTimeout = 15 * time.Second
+	defaultRequestTimeout  = 5 * time.Second
+	defaultBloomFPRate     = 0.01
+	defaultBloomSync       = time.Minute
+	defaultCacheShards     = 16
+	// запас при сверке снапшота с БД: часы сервиса и Postgres могут расходиться,
+	// а заказ попадает в БД раньше, чем в кэш. Лишний раз перечитанный заказ ничего не портит
+	snapshotReconcileMargin = time.Minute
+	defaultRedisTTL         = time.Hour
+)
+
+// cacheBackend - то, что сервису нужно от кэша заказов любого бэкенда
+type cacheBackend interface {
+	service.OrderCache
+	server.CacheAdmin
+	broker.CacheInvalidator
+	EnableInvalidationFanOut(publisher service.InvalidationPublisher)
+	Refresh(ctx context.Context, UID string)
+}
+
+type App struct {
+	storage    *storage.Storage
+	cache      *service.Cache // кэш для снапшотов, nil - снапшоты выключены
+	redisCache *service.RedisCache
+	consumers  []*broker.KafkaConsumer
+	statuses   *broker.StatusConsumer // nil - статусы из Kafka не читаются
+	// инвалидация кэша между репликами, nil - выключена
+	invalidations         *broker.InvalidationConsumer
+	invalidationPublisher *broker.InvalidationPublisher
+	server                *server.Server
+	shutdownTimeout       time.Duration
+	// снапшот кэша: пустой путь - выключен, нулевой интервал - пишется только при остановке
+	snapshotPath     string
+	snapshotInterval time.Duration
+	// кэш, чей фильтр Блума сверяется с БД; nil - фильтр выключен
+	bloomCache        *service.Cache
+	bloomSyncInterval time.Duration
+}
+
+// newCodecs выбирает формат тела сообщений по топикам; без реестра схем принимается только JSON
+func newCodecs(cfg *config.Kafka) (*broker.Codecs, error) {
+	var registry *broker.SchemaRegistry
+	if cfg.SchemaRegistry.URL != "" {
+		registry = broker.NewSchemaRegistry(cfg.SchemaRegistry.URL, cfg.SchemaRegistry.Username,
+			cfg.SchemaRegistry.Password, time.Duration(cfg.SchemaRegistry.Timeout))
+	}
+	codecs, err := broker.NewCodecs(cfg.Formats, registry)
+	if err != nil {
+		return nil, fmt.Errorf("invalid kafka formats: %w", err)
+	}
+	return codecs, nil
+}
+
+// New подключается к БД, прогревает кэш и создаёт консьюмеры и HTTP-сервер
+func New(ctx context.Context, cfg *config.Config) (*App, error) {
+	stor, err := storage.NewStorage(&cfg.Storage)
+	if err != nil {
+		return nil, fmt.Errorf("failed to init storage: %w", err)
+	}
+	slog.Info("Successfully connected to DB", "host", cfg.Storage.Host, "port", cfg.Storage.Port, "dbname", cfg.Storage.DBName)
+
+	codecs, err := newCodecs(&cfg.Kafka)
+	if err != nil {
+		stor.Close()
+		return nil, err
+	}
+	orderValidator, err := entity.NewOrderValidator(cfg.DisabledOrderRules...)
+	if err != nil {
+		stor.Close()
+		return nil, fmt.Errorf("invalid disabled_order_rules: %w", err)
+	}
+
+	var (
+		cache      cacheBackend
+		memCache   *service.Cache      // только для бэкенда memory: снапшоты
+		redisCache *service.RedisCache // только для бэкенда redis: закрыть соединения
+	)
+	switch cfg.CacheBackend {
+	case "", service.BackendMemory:
+		memCache, err = newMemoryCache(ctx, cfg, stor)
+		cache = memCache
+	case service.BackendRedis:
+		redisCache, err = newRedisCache(ctx, cfg, stor)
+		cache = redisCache
+	default:
+		err = fmt.Errorf("unknown cache_backend %q, expected %q or %q", cfg.CacheBackend, service.BackendMemory, service.BackendRedis)
+	}
+	if err != nil {
+		stor.Close()
+		return nil, err
+	}
+
+	statusService := service.NewStatusService(stor, cache)
+	orderEvents := service.NewOrderEvents(stor, cache, statusService)
+
+	var (
+		invalidations         *broker.InvalidationConsumer
+		invalidationPublisher *broker.InvalidationPublisher
+	)
+	if cfg.Kafka.InvalidationTopic != "" {
+		replicaID := cfg.ReplicaID
+		if replicaID == "" {
+			replicaID = newReplicaID()
+		}
+		invalidationPublisher = broker.NewInvalidationPublisher(&cfg.Kafka, replicaID)
+		cache.EnableInvalidationFanOut(invalidationPublisher)
+		statusService.EnableInvalidationFanOut(invalidationPublisher)
+		orderEvents.EnableInvalidationFanOut(invalidationPublisher)
+		invalidations = broker.NewInvalidationConsumer(&cfg.Kafka, replicaID, cache)
+		slog.Info("Cache invalidation fan-out enabled", "topic", cfg.Kafka.InvalidationTopic, "replica_id", replicaID)
+	}
+
+	// у каждого консьюмера свой reader, партиции распределяются между ними внутри группы,
+	// поэтому коммит offset'а одним консьюмером не "перепрыгнет" незавершённое сообщение другого
+	consumers := make([]*broker.KafkaConsumer, 0, cfg.ConsmerNumber)
+	for i := 0; i < cfg.ConsmerNumber; i++ {
+		consumer := broker.NewKafkaConsumer(&cfg.Kafka, cache)
+		consumer.EnableOrderEvents(orderEvents)
+		consumer.EnableCodecs(codecs)
+		consumer.SetOrderValidator(orderValidator)
+		consumers = append(consumers, consumer)
+	}
+	slog.Info("Kafka consumers initialized", "count", cfg.ConsmerNumber, "topic", cfg.Kafka.Topic, "dlq_topic", cfg.Kafka.DLQTopic)
+
+	var statuses *broker.StatusConsumer
+	if cfg.Kafka.StatusTopic != "" {
+		statuses = broker.NewStatusConsumer(&cfg.Kafka, statusService)
+		statuses.EnableCodecs(codecs)
+		slog.Info("Order status consumer initialized", "topic", cfg.Kafka.StatusTopic)
+	}
+
+	requestTimeout := time.Duration(cfg.RequestTimeout)
+	if requestTimeout <= 0 {
+		requestTimeout = defaultRequestTimeout
+	}
+	srv := server.NewServer(serverAddr, cache, requestTimeout)
+	srv.EnableStatusHistory(statusService)
+	if cfg.AdminToken != "" {
+		srv.EnableCacheAdmin(cache, cfg.AdminToken)
+		slog.Info("Cache admin API enabled", "path", "/admin/cache")
+	} else {
+		slog.Warn("ADMIN_TOKEN is not set, cache admin API is disabled")
+	}
+	slog.Info("HTTP server initialized", "address", serverAddr)
+
+	shutdownTimeout := time.Duration(cfg.ShutdownTimeout)
+	if shutdownTimeout <= 0 {
+		shutdownTimeout = defaultShutdownTimeout
+	}
+
+	app := &App{
+		storage:               stor,
+		redisCache:            redisCache,
+		consumers:             consumers,
+		statuses:              statuses,
+		invalidations:         invalidations,
+		invalidationPublisher: invalidationPublisher,
+		server:                srv,
+		shutdownTimeout:       shutdownTimeout,
+	}
+	if memCache != nil && cfg.BloomCapacity > 0 && cfg.Kafka.InvalidationTopic != "" {
+		app.bloomCache = memCache
+		app.bloomSyncInterval = time.Duration(cfg.BloomSyncInterval)
+		if app.bloomSyncInterval <= 0 {
+			app.bloomSyncInterval = defaultBloomSync
+		}
+	}
+	if memCache != nil && cfg.CacheSnapshotPath != "" {
+		app.cache = memCache
+		app.snapshotPath = cfg.CacheSnapshotPath
+		app.snapshotInterval = time.Duration(cfg.CacheSnapshotInterval)
+	}
+	return app, nil
+}
+
+// newMemoryCache создаёт кэш в памяти процесса и наполняет его из снапшота или БД
+func newMemoryCache(ctx context.Context, cfg *config.Config, stor *storage.Storage) (*service.Cache, error) {
+	newPolicy, err := service.NewPolicyFactory(cfg.CachePolicy, time.Duration(cfg.CacheTTL))
+	if err != nil {
+		return nil, fmt.Errorf("failed to init cache: %w", err)
+	}
+	shards := cfg.CacheShards
+	if shards <= 0 {
+		shards = defaultCacheShards
+	}
+	cache := service.NewShardedCache(stor, cfg.CacheCap, shards, newPolicy)
+	if cfg.CacheMaxBytes > 0 {
+		cache.EnableByteBudget(cfg.CacheMaxBytes)
+	}
+	if cfg.NegativeCacheSize > 0 && cfg.NegativeCacheTTL > 0 {
+		cache.EnableNegativeCache(cfg.NegativeCacheSize, time.Duration(cfg.NegativeCacheTTL))
+	}
+	metrics.RegisterCache(cache.Stats)
+	slog.Info("Cache layer initialized", "backend", service.BackendMemory, "policy", cfg.CachePolicy, "shards", cache.Stats().Shards)
+
+	// Восстановление кэша
+	if err := warmCache(ctx, cache, cfg.CacheSnapshotPath); err != nil {
+		return nil, fmt.Errorf("failed to load cache: %w", err)
+	}
+
+	if cfg.BloomCapacity > 0 && cfg.Kafka.InvalidationTopic == "" {
+		// без событий инвалидации фильтр не узнает о заказах других реплик и будет отвечать 404 на существующие
+		slog.Warn("Bloom filter is disabled: it needs kafka.invalidation_topic to learn about orders saved by other replicas")
+	} else if cfg.BloomCapacity > 0 {
+		fpRate := cfg.BloomFPRate
+		if fpRate == 0 {
+			fpRate = defaultBloomFPRate
+		}
+		if fpRate <= 0 || fpRate >= 1 {
+			return nil, fmt.Errorf("bloom_fp_rate must be between 0 and 1, got %v", cfg.BloomFPRate)
+		}
+		if err := cache.LoadBloomFilter(ctx, cfg.BloomCapacity, fpRate); err != nil {
+			return nil, fmt.Errorf("failed to load bloom filter: %w", err)
+		}
+	}
+	return cache, nil
+}
+
+// newRedisCache подключается к Redis и прогревает общий кэш последними заказами
+func newRedisCache(ctx context.Context, cfg *config.Config, stor *storage.Storage) (*service.RedisCache, error) {
+	client := redis.NewClient(&redis.Options{
+		Addr:     cfg.Redis.Addr,
+		Password: cfg.Redis.Password,
+		DB:       cfg.Redis.DB,
+	})
+	if err := client.Ping(ctx).Err(); err != nil {
+		client.Close()
+		return nil, fmt.Errorf("failed to connect to redis: %w", err)
+	}
+	slog.Info("Successfully connected to Redis", "addr", cfg.Redis.Addr, "db", cfg.Redis.DB)
+
+	ttl := time.Duration(cfg.Redis.TTL)
+	if ttl <= 0 {
+		ttl = defaultRedisTTL
+	}
+	cache := service.NewRedisCache(client, stor, cfg.CacheCap, ttl)
+	if cfg.Redis.NearCacheSize > 0 && cfg.Redis.NearCacheTTL > 0 {
+		cache.EnableNearCache(cfg.Redis.NearCacheSize, time.Duration(cfg.Redis.NearCacheTTL))
+	}
+	if cfg.NegativeCacheSize > 0 && cfg.NegativeCacheTTL > 0 {
+		cache.EnableNegativeCache(cfg.NegativeCacheSize, time.Duration(cfg.NegativeCacheTTL))
+	}
+	metrics.RegisterCache(cache.Stats)
+	slog.Info("Cache layer initialized", "backend", service.BackendRedis, "ttl", ttl, "near_cache_size", cfg.Redis.NearCacheSize)
+	if ignored := ignoredByRedis(cfg); len(ignored) > 0 {
+		slog.Warn("Settings of the memory cache are ignored by the redis backend", "settings", ignored)
+	}
+
+	if err := cache.LoadCache(ctx); err != nil {
+		cache.Close()
+		return nil, fmt.Errorf("failed to load cache: %w", err)
+	}
+	return cache, nil
+}
+
+// ignoredByRedis - заданные в конфиге настройки кэша в памяти, которых у бэкенда redis нет:
+// заказы вытесняет TTL самого Redis, а снапшот и фильтр Блума есть только у кэша в памяти
+func ignoredByRedis(cfg *config.Config) []string {
+	var ignored []string
+	if cfg.CachePolicy != "" {
+		ignored = append(ignored, "cache_policy")
+	}
+	if cfg.CacheMaxBytes > 0 {
+		ignored = append(ignored, "cache_max_bytes")
+	}
+	if cfg.CacheShards > 0 {
+		ignored = append(ignored, "cache_shards")
+	}
+	if cfg.CacheSnapshotPath != "" {
+		ignored = append(ignored, "cache_snapshot_path")
+	}
+	if cfg.BloomCapacity > 0 {
+		ignored = append(ignored, "bloom_capacity")
+	}
+	return ignored
+}
+
+// warmCache наполняет кэш из снапшота и догружает заказы, сохранённые после него.
+// Если снапшота нет или он битый, кэш загружается из БД как обычно
+func warmCache(ctx context.Context, cache *service.Cache, snapshotPath string) error {
+	if snapshotPath != "" {
+		createdAt, err := cache.LoadSnapshot(ctx, snapshotPath)
+		switch {
+		case err == nil:
+			n, err := cache.Reconcile(ctx, createdAt.Add(-snapshotReconcileMargin))
+			if err != nil {
+				return err
+			}
+			slog.Info("Cache restored from snapshot", "path", snapshotPath, "snapshot_time", createdAt,
+				"orders_loaded", cache.Stats().Size, "orders_reconciled", n)
+			return nil
+		case errors.Is(err, os.ErrNotExist):
+			slog.Info("Cache snapshot not found, loading cache from database", "path", snapshotPath)
+		default:
+			slog.Warn("Cache snapshot is unusable, loading cache from database", "path", snapshotPath, "error", err)
+		}
+	}
+
+	if err := cache.LoadCache(ctx); err != nil {
+		return err
+	}
+	slog.Info("Cache successfully populated from database", "orders_loaded", cache.Stats().Size)
+	return nil
+}
+
+// newReplicaID - ID реплики, уникальный даже для нескольких процессов на одном хосте.
+// Если случайный суффикс получить не удалось, вместо него берётся PID: с одинаковыми ID
+// реплики пропускали бы события инвалидации друг друга как свои
+func newReplicaID() string {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "replica"
+	}
+	suffix := make([]byte, 4)
+	if _, err := rand.Read(suffix); err != nil {
+		slog.Warn("Failed to generate random replica ID suffix, using PID", "error", err)
+		return host + "-" + strconv.Itoa(os.Getpid())
+	}
+	return host + "-" + hex.EncodeToString(suffix)
+}
+
+// Run работает, пока не отменён ctx (сигнал остановки) или не упал HTTP-сервер, после чего останавливает сервис
+func (a *App) Run(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// консьюмер, остановившийся из-за ошибки (dead-letter, коммит, реестр схем), останавливает и сервис:
+	// реплика, которая ничего не читает, но отвечает по HTTP, должна быть перезапущена, а не работать молча
+	consumerErr := make(chan error, len(a.consumers)+2)
+	var consumersWG sync.WaitGroup
+	runConsumer := func(name string, consume func(ctx context.Context) error) {
+		consumersWG.Add(1)
+		go func() {
+			defer consumersWG.Done()
+			if err := consume(ctx); err != nil && !errors.Is(err, context.Canceled) {
+				consumerErr <- fmt.Errorf("%s stopped: %w", name, err)
+			}
+		}()
+	}
+	for _, consumer := range a.consumers {
+		runConsumer("kafka consumer", consumer.ConsumeAndSave)
+	}
+	if a.statuses != nil {
+		runConsumer("order status consumer", a.statuses.Consume)
+	}
+	if a.invalidations != nil {
+		runConsumer("cache invalidation consumer", a.invalidations.Consume)
+	}
+
+	// фоновые задачи пользуются БД и кэшем, поэтому завершаются до снапшота и закрытия БД
+	var backgroundWG sync.WaitGroup
+	if a.bloomCache != nil {
+		backgroundWG.Add(1)
+		go func() {
+			defer backgroundWG.Done()
+			a.bloomCache.RunBloomSync(ctx, a.bloomSyncInterval)
+		}()
+	}
+	if a.snapshotPath != "" && a.snapshotInterval > 0 {
+		backgroundWG.Add(1)
+		go func() {
+			defer backgroundWG.Done()
+			a.cache.RunSnapshots(ctx, a.snapshotPath, a.snapshotInterval)
+		}()
+	}
+
+	serverErr := make(chan error, 1)
+	go func() {
+		serverErr <- a.server.Start()
+	}()
+
+	var runErr error
+	select {
+	case <-ctx.Done():
+		slog.Info("Shutdown signal received")
+	case err := <-serverErr:
+		if !errors.Is(err, http.ErrServerClosed) {
+			runErr = fmt.Errorf("http server stopped: %w", err)
+		}
+	case err := <-consumerErr:
+		runErr = err
+	}
+
+	cancel()            // консьюмеры перестают читать новые сообщения
+	backgroundWG.Wait() // периодический снапшот не должен перезаписать финальный
+	return errors.Join(runErr, a.shutdown(&consumersWG))
+}
+
+// shutdown останавливает компоненты в порядке зависимостей: консьюмеры, Kafka, HTTP, пишет снапшот кэша и в конце закрывает БД,
+// которой пользуются все остальные. На всё отводится shutdownTimeout
+func (a *App) shutdown(consumersWG *sync.WaitGroup) error {
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), a.shutdownTimeout)
+	defer cancel()
+
+	var errs []error
+
+	// ждём, пока консьюмеры допишут заказы, которые уже начали сохранять
+	drained := make(chan struct{})
+	go func() {
+		consumersWG.Wait()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+		slog.Info("Kafka consumers drained")
+	case <-shutdownCtx.Done():
+		// время вышло: прерываем зависшие запросы к БД и Kafka, иначе закрытие пула соединений
+		// ждало бы их бесконечно. Прерванные сообщения не закоммичены и будут прочитаны снова
+		slog.Warn("Kafka consumers did not finish in time, in-flight messages will be redelivered")
+		for _, consumer := range a.consumers {
+			consumer.Abort()
+		}
+		if a.statuses != nil {
+			a.statuses.Abort()
+		}
+		<-drained
+	}
+
+	for _, consumer := range a.consumers {
+		if err := consumer.Close(); err != nil {
+			errs = append(errs, fmt.Errorf("failed to close kafka consumer: %w", err))
+		}
+	}
+
+	if a.statuses != nil {
+		if err := a.statuses.Close(); err != nil {
+			errs = append(errs, fmt.Errorf("failed to close order status consumer: %w", err))
+		}
+	}
+
+	if a.invalidations != nil {
+		if err := a.invalidations.Close(); err != nil {
+			errs = append(errs, fmt.Errorf("failed to close cache invalidation consumer: %w", err))
+		}
+	}
+
+	if err := a.server.Shutdown(shutdownCtx); err != nil {
+		errs = append(errs, fmt.Errorf("failed to shutdown http server: %w", err))
+	}
+
+	// заказы больше не сохраняются - отправляем оставшиеся события инвалидации
+	if a.invalidationPublisher != nil {
+		if err := a.invalidationPublisher.Close(); err != nil {
+			errs = append(errs, fmt.Errorf("failed to close cache invalidation publisher: %w", err))
+		}
+	}
+
+	// снапшот пишем, когда новых заказов уже не будет: консьюмеры и HTTP остановлены
+	if a.snapshotPath != "" {
+		if err := a.cache.WriteSnapshot(a.snapshotPath); err != nil {
+			errs = append(errs, fmt.Errorf("failed to write cache snapshot: %w", err))
+		}
+	}
+
+	if a.redisCache != nil {
+		if err := a.redisCache.Close(); err != nil {
+			errs = append(errs, fmt.Errorf("failed to close redis client: %w", err))
+		}
+	}
+	a.storage.Close()
+	slog.Info("Service stopped")
+
+	return errors.Join(errs...)
+}
@@ -0,0 +1,340 @@
+package broker
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bufbuild/protocompile"
+	"github.com/hamba/avro/v2"
+	"github.com/segmentio/kafka-go"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+// форматы тела сообщения. Avro и Protobuf приходят во framing'е Confluent:
+// нулевой байт, ID схемы в реестре (4 байта, big-endian), затем данные
+const (
+	FormatJSON     = "json"
+	FormatAvro     = "avro"
+	FormatProtobuf = "protobuf"
+)
+
+// HeaderContentType - заголовок сообщения с форматом тела, он важнее формата топика
+const HeaderContentType = "content-type"
+
+// contentTypes - значения content-type и соответствующие им форматы
+var contentTypes = map[string]string{
+	"application/json":       FormatJSON,
+	"application/avro":       FormatAvro,
+	"avro/binary":            FormatAvro,
+	"application/x-protobuf": FormatProtobuf,
+	"application/protobuf":   FormatProtobuf,
+}
+
+const (
+	confluentMagicByte = 0
+	confluentHeaderLen = 5
+)
+
+// PayloadCodec переводит тело сообщения своего формата в JSON, с которым дальше работает консьюмер
+type PayloadCodec interface {
+	ToJSON(ctx context.Context, value []byte) ([]byte, error)
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) ToJSON(_ context.Context, value []byte) ([]byte, error) {
+	return value, nil
+}
+
+// splitConfluentFrame отделяет ID схемы от данных
+func splitConfluentFrame(value []byte) (int, []byte, error) {
+	if len(value) < confluentHeaderLen || value[0] != confluentMagicByte {
+		return 0, nil, errors.New("message is not in Confluent wire format")
+	}
+	return int(binary.BigEndian.Uint32(value[1:confluentHeaderLen])), value[confluentHeaderLen:], nil
+}
+
+// avroCodec разбирает Avro по схеме writer'а из реестра
+type avroCodec struct {
+	registry *SchemaRegistry
+
+	mu      sync.Mutex
+	schemas map[int]avro.Schema
+}
+
+func (c *avroCodec) ToJSON(ctx context.Context, value []byte) ([]byte, error) {
+	id, data, err := splitConfluentFrame(value)
+	if err != nil {
+		return nil, err
+	}
+	schema, err := c.schema(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	// union'ы разворачиваются в значение, timestamp-millis - в time.Time, т.е. в JSON это строка RFC 3339
+	var doc any
+	if err := avro.Unmarshal(schema, data, &doc); err != nil {
+		return nil, fmt.Errorf("failed to decode avro message with schema id %d: %w", id, err)
+	}
+	return json.Marshal(doc)
+}
+
+func (c *avroCodec) schema(ctx context.Context, id int) (avro.Schema, error) {
+	c.mu.Lock()
+	schema, ok := c.schemas[id]
+	c.mu.Unlock()
+	if ok {
+		return schema, nil
+	}
+
+	registered, err := c.registry.Schema(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if registered.Type != SchemaTypeAvro {
+		return nil, fmt.Errorf("%w: schema id %d is %s, not %s", ErrUnsupportedSchema, id, registered.Type, SchemaTypeAvro)
+	}
+	schema, err = avro.Parse(registered.Schema)
+	if err != nil {
+		return nil, fmt.Errorf("%w: schema id %d: %w", ErrUnsupportedSchema, id, err)
+	}
+
+	c.mu.Lock()
+	c.schemas[id] = schema
+	c.mu.Unlock()
+	return schema, nil
+}
+
+// protobufCodec разбирает Protobuf по .proto из реестра. После ID схемы во framing'е идут индексы
+// сообщения в файле (zigzag varint: число индексов, затем сами индексы; 0 - первое сообщение файла)
+type protobufCodec struct {
+	registry *SchemaRegistry
+
+	mu    sync.Mutex
+	files map[int]protoreflect.FileDescriptor
+}
+
+func (c *protobufCodec) ToJSON(ctx context.Context, value []byte) ([]byte, error) {
+	id, data, err := splitConfluentFrame(value)
+	if err != nil {
+		return nil, err
+	}
+	indexes, data, err := readMessageIndexes(data)
+	if err != nil {
+		return nil, err
+	}
+	file, err := c.file(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	desc, err := messageByIndexes(file, indexes)
+	if err != nil {
+		return nil, fmt.Errorf("%w: schema id %d: %w", ErrUnsupportedSchema, id, err)
+	}
+
+	msg := dynamicpb.NewMessage(desc)
+	if err := proto.Unmarshal(data, msg); err != nil {
+		return nil, fmt.Errorf("failed to decode protobuf message %s with schema id %d: %w", desc.FullName(), id, err)
+	}
+	return json.Marshal(protoToMap(msg))
+}
+
+func (c *protobufCodec) file(ctx context.Context, id int) (protoreflect.FileDescriptor, error) {
+	c.mu.Lock()
+	file, ok := c.files[id]
+	c.mu.Unlock()
+	if ok {
+		return file, nil
+	}
+
+	registered, err := c.registry.Schema(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if registered.Type != SchemaTypeProtobuf {
+		return nil, fmt.Errorf("%w: schema id %d is %s, not %s", ErrUnsupportedSchema, id, registered.Type, SchemaTypeProtobuf)
+	}
+
+	const name = "schema.proto"
+	compiler := protocompile.Compiler{
+		Resolver: protocompile.WithStandardImports(&protocompile.SourceResolver{
+			Accessor: protocompile.SourceAccessorFromMap(map[string]string{name: registered.Schema}),
+		}),
+	}
+	files, err := compiler.Compile(ctx, name)
+	if err != nil {
+		return nil, fmt.Errorf("%w: schema id %d: %w", ErrUnsupportedSchema, id, err)
+	}
+	file = files[0]
+
+	c.mu.Lock()
+	c.files[id] = file
+	c.mu.Unlock()
+	return file, nil
+}
+
+func readMessageIndexes(data []byte) ([]int, []byte, error) {
+	count, n := binary.Varint(data)
+	if n <= 0 || count < 0 {
+		return nil, nil, errors.New("invalid protobuf message indexes")
+	}
+	data = data[n:]
+	if count == 0 {
+		return []int{0}, data, nil
+	}
+
+	indexes := make([]int, 0, count)
+	for range count {
+		idx, n := binary.Varint(data)
+		if n <= 0 || idx < 0 {
+			return nil, nil, errors.New("invalid protobuf message indexes")
+		}
+		indexes = append(indexes, int(idx))
+		data = data[n:]
+	}
+	return indexes, data, nil
+}
+
+// messageByIndexes находит сообщение по индексам: первый - среди сообщений файла, следующие - среди вложенных
+func messageByIndexes(file protoreflect.FileDescriptor, indexes []int) (protoreflect.MessageDescriptor, error) {
+	messages := file.Messages()
+	var desc protoreflect.MessageDescriptor
+	for _, idx := range indexes {
+		if idx >= messages.Len() {
+			return nil, fmt.Errorf("message index %v is out of range", indexes)
+		}
+		desc = messages.Get(idx)
+		messages = desc.Messages()
+	}
+	return desc, nil
+}
+
+// protoToMap переводит сообщение в документ с именами полей из .proto. В отличие от protojson
+// 64-битные числа остаются числами, а google.protobuf.Timestamp становится строкой RFC 3339,
+// поэтому документ разбирается в entity.Order так же, как обычный JSON
+func protoToMap(msg protoreflect.Message) map[string]any {
+	doc := make(map[string]any)
+	msg.Range(func(fd protoreflect.FieldDescriptor, v protoreflect.Value) bool {
+		switch {
+		case fd.IsList():
+			list := v.List()
+			values := make([]any, list.Len())
+			for i := range values {
+				values[i] = protoValue(fd, list.Get(i))
+			}
+			doc[string(fd.Name())] = values
+		case fd.IsMap():
+			values := make(map[string]any)
+			v.Map().Range(func(k protoreflect.MapKey, v protoreflect.Value) bool {
+				values[k.String()] = protoValue(fd.MapValue(), v)
+				return true
+			})
+			doc[string(fd.Name())] = values
+		default:
+			doc[string(fd.Name())] = protoValue(fd, v)
+		}
+		return true
+	})
+	return doc
+}
+
+func protoValue(fd protoreflect.FieldDescriptor, v protoreflect.Value) any {
+	switch fd.Kind() {
+	case protoreflect.MessageKind, protoreflect.GroupKind:
+		if fd.Message().FullName() == "google.protobuf.Timestamp" {
+			fields := v.Message().Descriptor().Fields()
+			seconds := v.Message().Get(fields.ByName("seconds")).Int()
+			nanos := v.Message().Get(fields.ByName("nanos")).Int()
+			return time.Unix(seconds, nanos).UTC()
+		}
+		return protoToMap(v.Message())
+	case protoreflect.EnumKind:
+		if ev := fd.Enum().Values().ByNumber(v.Enum()); ev != nil {
+			return string(ev.Name())
+		}
+		return int32(v.Enum())
+	case protoreflect.BytesKind:
+		return base64.StdEncoding.EncodeToString(v.Bytes())
+	default:
+		return v.Interface()
+	}
+}
+
+// Codecs выбирает кодек сообщения: по заголовку content-type, а без него - по формату топика
+type Codecs struct {
+	formats map[string]string // топик -> формат
+	codecs  map[string]PayloadCodec
+}
+
+// NewCodecs проверяет форматы топиков. registry нужен только для avro и protobuf, nil - только JSON
+func NewCodecs(formats map[string]string, registry *SchemaRegistry) (*Codecs, error) {
+	c := &Codecs{
+		formats: make(map[string]string, len(formats)),
+		codecs:  map[string]PayloadCodec{FormatJSON: jsonCodec{}},
+	}
+	if registry != nil {
+		c.codecs[FormatAvro] = &avroCodec{registry: registry, schemas: make(map[int]avro.Schema)}
+		c.codecs[FormatProtobuf] = &protobufCodec{registry: registry, files: make(map[int]protoreflect.FileDescriptor)}
+	}
+
+	for topic, format := range formats {
+		format = strings.ToLower(format)
+		switch format {
+		case FormatJSON:
+		case FormatAvro, FormatProtobuf:
+			if registry == nil {
+				return nil, fmt.Errorf("topic %s: format %s needs schema registry", topic, format)
+			}
+		default:
+			return nil, fmt.Errorf("topic %s: unknown format %q", topic, format)
+		}
+		c.formats[topic] = format
+	}
+	return c, nil
+}
+
+// ToJSON переводит тело сообщения в JSON. Неизвестный content-type или схема - ErrUnsupportedSchema
+func (c *Codecs) ToJSON(ctx context.Context, msg kafka.Message) ([]byte, error) {
+	format, err := c.format(msg)
+	if err != nil {
+		return nil, err
+	}
+	codec, ok := c.codecs[format]
+	if !ok {
+		return nil, fmt.Errorf("%w: format %s needs schema registry", ErrUnsupportedSchema, format)
+	}
+	return codec.ToJSON(ctx, msg.Value)
+}
+
+func (c *Codecs) format(msg kafka.Message) (string, error) {
+	for _, h := range msg.Headers {
+		if !strings.EqualFold(h.Key, HeaderContentType) {
+			continue
+		}
+		mediaType, _, err := mime.ParseMediaType(string(h.Value))
+		if err != nil {
+			return "", fmt.Errorf("%w: content-type %q", ErrUnsupportedSchema, h.Value)
+		}
+		format, ok := contentTypes[mediaType]
+		if !ok {
+			return "", fmt.Errorf("%w: content-type %q", ErrUnsupportedSchema, mediaType)
+		}
+		return format, nil
+	}
+
+	if format, ok := c.formats[msg.Topic]; ok {
+		return format, nil
+	}
+	return FormatJSON, nil
+}
@@ -2,65 +2,329 @@ package broker
 
 import (
 	"context"
-	"encoding/json"
+	"errors"
 	"fmt"
 	"log/slog"
+	"strconv"
+	"time"
 
+	"github.com/Asus/L0_DemoServise/config"
 	"github.com/Asus/L0_DemoServise/internal/entity"
+	"github.com/Asus/L0_DemoServise/internal/metrics"
 	"github.com/segmentio/kafka-go"
 )
 
 type OrderSaver interface {
-	SaveOrder(ctx context.Context, o entity.Order) error
+	SaveOrder(ctx context.Context, o entity.Order) (entity.SaveResult, error)
+}
+
+// messageReader - то, что нужно консьюмеру от kafka.Reader (интерфейс нужен для тестов)
+type messageReader interface {
+	FetchMessage(ctx context.Context) (kafka.Message, error)
+	CommitMessages(ctx context.Context, msgs ...kafka.Message) error
+	Close() error
+}
+
+// messageWriter - то, что нужно консьюмеру от kafka.Writer (интерфейс нужен для тестов)
+type messageWriter interface {
+	WriteMessages(ctx context.Context, msgs ...kafka.Message) error
+	Close() error
 }
 
 type KafkaConsumer struct {
-	reader *kafka.Reader
-	saver  OrderSaver
+	reader     messageReader
+	deadLetter messageWriter // nil, если dead-letter топик не настроен
+	saver      OrderSaver
+	events     OrderEventApplier      // nil - принимаются только заказы целиком
+	codecs     *Codecs                // nil - тело сообщений только JSON
+	validator  *entity.OrderValidator // nil - все бизнес-правила (entity.DefaultOrderValidator)
+	retry      retryPolicy
+
+	// отменяется Abort: прерывает работу над уже прочитанными сообщениями; nil - не прерывается
+	aborted context.Context
+	abort   context.CancelFunc
 }
 
-func NewKafkaConsumer(brokerAddr string, topic string, groupID string, saver OrderSaver) *KafkaConsumer {
+func NewKafkaConsumer(cfg *config.Kafka, saver OrderSaver) *KafkaConsumer {
+	c := newConsumer(cfg, cfg.Topic, cfg.GroupID)
+	c.saver = saver
+	return c
+}
+
+// newConsumer создаёт reader топика topic с общими для всех консьюмеров dead-letter топиком и повторами
+func newConsumer(cfg *config.Kafka, topic, groupID string) *KafkaConsumer {
 	reader := kafka.NewReader(kafka.ReaderConfig{
-		Brokers:  []string{brokerAddr},
+		Brokers:  cfg.Brokers,
 		Topic:    topic,
 		GroupID:  groupID,
 		MaxBytes: 10e6,
 	})
+
+	var deadLetter messageWriter
+	if cfg.DLQTopic != "" {
+		deadLetter = &kafka.Writer{
+			Addr:                   kafka.TCP(cfg.Brokers...),
+			Topic:                  cfg.DLQTopic,
+			Balancer:               &kafka.LeastBytes{},
+			AllowAutoTopicCreation: true,
+		}
+	}
+
+	aborted, abort := context.WithCancel(context.Background())
 	return &KafkaConsumer{
-		reader: reader,
-		saver:  saver,
+		reader:     reader,
+		deadLetter: deadLetter,
+		aborted:    aborted,
+		abort:      abort,
+		retry: retryPolicy{
+			maxRetries: cfg.MaxRetries,
+			backoff:    time.Duration(cfg.RetryBackoff),
+			maxBackoff: time.Duration(cfg.MaxRetryBackoff),
+		},
 	}
 }
 
+// EnableCodecs включает разбор Avro и Protobuf: формат выбирается по заголовку content-type или топику
+func (c *KafkaConsumer) EnableCodecs(codecs *Codecs) {
+	c.codecs = codecs
+}
+
+// SetOrderValidator задаёт набор бизнес-правил, которыми проверяются заказы
+func (c *KafkaConsumer) SetOrderValidator(v *entity.OrderValidator) {
+	c.validator = v
+}
+
+// ConsumeAndSave читает заказы и сохраняет их. Offset коммитится только после того,
+// как заказ сохранён в БД или отправлен в dead-letter топик (at-least-once).
+// Отмена ctx останавливает чтение новых сообщений, но уже прочитанное сообщение дообрабатывается,
+// пока его не прервёт Abort
 func (c *KafkaConsumer) ConsumeAndSave(ctx context.Context) error {
+	return c.consume(ctx, c.process)
+}
+
+// consume читает сообщения и коммитит offset каждого после того, как process его обработал
+func (c *KafkaConsumer) consume(ctx context.Context, process func(ctx, workCtx context.Context, msg kafka.Message) error) error {
 	for {
-		msg, err := c.reader.ReadMessage(ctx)
+		msg, err := c.reader.FetchMessage(ctx)
 		if err != nil {
-			return fmt.Errorf("failed to read message: %w", err)
+			return fmt.Errorf("failed to fetch message: %w", err)
 		}
+		if lag := msg.HighWaterMark - msg.Offset - 1; lag >= 0 {
+			metrics.ConsumerLag.WithLabelValues(msg.Topic, strconv.Itoa(msg.Partition)).Set(float64(lag))
+		}
+
+		// сохранение, отправка в dead-letter и коммит не прерываются остановкой сервиса (прерываются
+		// только паузы между повторами), но их прерывает Abort, когда время на остановку вышло
+		workCtx, cancelWork := c.workContext(ctx)
+		err = c.processAndCommit(ctx, workCtx, msg, process)
+		cancelWork()
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// processAndCommit обрабатывает сообщение и коммитит его offset. Если обработка не завершилась,
+// offset не коммитим - сообщение будет прочитано снова
+func (c *KafkaConsumer) processAndCommit(ctx, workCtx context.Context, msg kafka.Message, process func(ctx, workCtx context.Context, msg kafka.Message) error) error {
+	if err := process(ctx, workCtx, msg); err != nil {
+		return err
+	}
+	if err := c.reader.CommitMessages(workCtx, msg); err != nil {
+		return fmt.Errorf("failed to commit offset %d of partition %d: %w", msg.Offset, msg.Partition, err)
+	}
+	return nil
+}
+
+// workContext - контекст работы над прочитанным сообщением: значения берёт из ctx,
+// но отменяется не вместе с ним, а только Abort
+func (c *KafkaConsumer) workContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	workCtx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+	if c.aborted == nil {
+		return workCtx, cancel
+	}
+	stop := context.AfterFunc(c.aborted, cancel)
+	return workCtx, func() {
+		stop()
+		cancel()
+	}
+}
+
+// Abort прерывает работу над уже прочитанными сообщениями: запросы к БД, отправку в dead-letter и коммит.
+// Вызывается при остановке, когда время на дообработку вышло; прерванные сообщения будут прочитаны снова
+func (c *KafkaConsumer) Abort() {
+	if c.abort != nil {
+		c.abort()
+	}
+}
+
+// process возвращает ошибку, только если сообщение нельзя коммитить.
+// workCtx используется для самой работы, ctx - для ожидания между повторами
+func (c *KafkaConsumer) process(ctx, workCtx context.Context, msg kafka.Message) error {
+	value, ok, err := c.toJSON(ctx, workCtx, msg)
+	if !ok {
+		return err
+	}
+	ev, err := decodeEvent(value)
+	if err != nil {
+		slog.Error("failed to parse order JSON", "error", err, "message", string(msg.Value))
+		return c.reject(ctx, workCtx, msg, StageParse, err)
+	}
+	if ev.Type != entity.EventOrderCreated {
+		return c.processEvent(ctx, workCtx, msg, ev)
+	}
+
+	order, err := orderDecoder.Decode(ev.Payload, schemaHeader(msg))
+	if errors.Is(err, ErrUnsupportedSchema) {
+		slog.Error("unsupported order schema version", "error", err, "partition", msg.Partition, "offset", msg.Offset)
+		return c.reject(ctx, workCtx, msg, StageSchema, err)
+	}
+	if err != nil {
+		slog.Error("failed to parse order JSON", "error", err, "message", string(msg.Value))
+		return c.reject(ctx, workCtx, msg, StageParse, err)
+	}
+	if order.OrderUID != ev.OrderUID {
+		err := fmt.Errorf("payload order_uid %q does not match event order_uid %q", order.OrderUID, ev.OrderUID)
+		return c.reject(ctx, workCtx, msg, StageValidate, err)
+	}
 
-		var order entity.Order
-		if err := json.Unmarshal(msg.Value, &order); err != nil {
-			slog.Error("failed to parse order JSON", "error", err, "message", string(msg.Value))
-			continue
+	// Валидация данных: теги и бизнес-правила
+	validator := c.validator
+	if validator == nil {
+		validator = entity.DefaultOrderValidator
+	}
+	if err := validator.Validate(order); err != nil {
+		slog.Error("failed to validate order data", "error", err, "order_uid", order.OrderUID)
+		return c.reject(ctx, workCtx, msg, StageValidate, err) // невалидное сообщение уходит в dead-letter топик
+	}
+
+	slog.Info("Order processed from Kafka", "order_uid", order.OrderUID)
+
+	// Сохранение заказа, временные ошибки хранилища повторяем
+	var (
+		result  entity.SaveResult
+		saveErr error
+	)
+	err = c.retry.do(ctx, func(attempt int) error {
+		result, saveErr = c.saver.SaveOrder(workCtx, order)
+		if saveErr == nil || !isRetryable(saveErr) {
+			return nil // повторять нечего
 		}
+		slog.Warn("failed to save order, will retry", "order_uid", order.OrderUID, "attempt", attempt, "error", saveErr)
+		return saveErr
+	})
+	if err == nil && saveErr == nil {
+		if result == entity.SaveConflict {
+			// в БД уже лежит другая версия заказа, а политика запрещает её перезаписывать
+			return c.reject(ctx, workCtx, msg, StageConflict, fmt.Errorf("order %s already exists with different content", order.OrderUID))
+		}
+		metrics.ConsumerProcessed.WithLabelValues(result.String()).Inc()
+		return nil
+	}
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return fmt.Errorf("order %s was not saved: %w", order.OrderUID, ctxErr)
+	}
+
+	slog.Error("failed to save order", "order_uid", order.OrderUID, "error", saveErr)
+	return c.reject(ctx, workCtx, msg, StagePersist, saveErr)
+}
 
-		// Валидация данных
-		if err := entity.Validate.Struct(order); err != nil {
-			slog.Error("failed to validate order data", "error", err, "order_uid", order.OrderUID)
-			continue // Пропускаем невалидное сообщение, предварительно логируя его
+// toJSON переводит тело сообщения в JSON. Недоступный реестр схем повторяется, как и ошибки хранилища.
+// Если реестр так и не ответил или отказал в доступе, консьюмер останавливается без коммита: это сбой
+// инфраструктуры или настроек, а не сообщения, и отправлять в dead-letter всё подряд нельзя
+// ok = false - дальше сообщение не обрабатывается: оно отклонено или, если err != nil, его нельзя коммитить
+func (c *KafkaConsumer) toJSON(ctx, workCtx context.Context, msg kafka.Message) (value []byte, ok bool, err error) {
+	if c.codecs == nil {
+		return msg.Value, true, nil
+	}
+
+	var decodeErr error
+	err = c.retry.do(ctx, func(attempt int) error {
+		value, decodeErr = c.codecs.ToJSON(workCtx, msg)
+		if !errors.Is(decodeErr, errRegistryUnavailable) {
+			return nil
 		}
-		
-		slog.Info("Order processed from Kafka", "order_uid", order.OrderUID)
+		slog.Warn("schema registry is unavailable, will retry", "partition", msg.Partition, "offset", msg.Offset, "attempt", attempt, "error", decodeErr)
+		return decodeErr
+	})
+	if err == nil && decodeErr == nil {
+		return value, true, nil
+	}
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return nil, false, fmt.Errorf("message (partition %d, offset %d) was not decoded: %w", msg.Partition, msg.Offset, ctxErr)
+	}
+	if errors.Is(decodeErr, errRegistryAccessDenied) || errors.Is(decodeErr, errRegistryUnavailable) {
+		return nil, false, fmt.Errorf("message (partition %d, offset %d) was not decoded: %w", msg.Partition, msg.Offset, decodeErr)
+	}
+
+	slog.Error("failed to decode message", "error", decodeErr, "partition", msg.Partition, "offset", msg.Offset)
+	stage := StageParse
+	if errors.Is(decodeErr, ErrUnsupportedSchema) {
+		stage = StageSchema
+	}
+	return nil, false, c.reject(ctx, workCtx, msg, stage, decodeErr)
+}
 
-		// Сохранение заказа
-		if err := c.saver.SaveOrder(ctx, order); err != nil {
-			slog.Error("failed to save order", "order_uid", order.OrderUID, "error", err)
-			continue
+// applyRetrying применяет изменение заказа UID, повторяя временные ошибки хранилища. Заказ мог ещё
+// не дойти из топика заказов, поэтому ErrNotFound тоже повторяется. result - метка в метрике обработанных сообщений
+func (c *KafkaConsumer) applyRetrying(ctx, workCtx context.Context, msg kafka.Message, UID, result string, apply func(ctx context.Context) error) error {
+	var applyErr error
+	err := c.retry.do(ctx, func(attempt int) error {
+		applyErr = apply(workCtx)
+		if applyErr == nil || !isRetryable(applyErr) {
+			return nil
 		}
+		slog.Warn("failed to apply order change, will retry", "order_uid", UID, "attempt", attempt, "error", applyErr)
+		return applyErr
+	})
+	if err == nil && applyErr == nil {
+		metrics.ConsumerProcessed.WithLabelValues(result).Inc()
+		return nil
+	}
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return fmt.Errorf("change of order %s was not applied: %w", UID, ctxErr)
+	}
+
+	slog.Error("failed to apply order change", "order_uid", UID, "change", result, "error", applyErr)
+	switch {
+	case errors.Is(applyErr, entity.ErrInvalidTransition), errors.Is(applyErr, entity.ErrNotFound):
+		return c.reject(ctx, workCtx, msg, StageTransition, applyErr)
+	case errors.Is(applyErr, entity.ErrInvalidOrder):
+		return c.reject(ctx, workCtx, msg, StageValidate, applyErr)
+	default:
+		return c.reject(ctx, workCtx, msg, StagePersist, applyErr)
 	}
 }
 
+// reject отправляет сообщение в dead-letter топик. Если отправить не удалось,
+// возвращается ошибка: такое сообщение нельзя коммитить, иначе оно потеряется
+func (c *KafkaConsumer) reject(ctx, workCtx context.Context, msg kafka.Message, stage RejectStage, cause error) error {
+	if c.deadLetter == nil {
+		slog.Warn("dead-letter topic is not configured, message is dropped",
+			"stage", stage, "partition", msg.Partition, "offset", msg.Offset)
+		metrics.ConsumerRejected.WithLabelValues(string(stage)).Inc()
+		return nil
+	}
+
+	dead := deadLetterMessage(msg, stage, cause)
+	err := c.retry.do(ctx, func(attempt int) error {
+		return c.deadLetter.WriteMessages(workCtx, dead)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to send message to dead-letter topic (partition %d, offset %d): %w", msg.Partition, msg.Offset, err)
+	}
+
+	slog.Warn("message sent to dead-letter topic", "stage", stage, "partition", msg.Partition, "offset", msg.Offset)
+	metrics.ConsumerRejected.WithLabelValues(string(stage)).Inc()
+	return nil
+}
+
 func (c *KafkaConsumer) Close() error {
-	return c.reader.Close()
+	err := c.reader.Close()
+	if c.deadLetter != nil {
+		if dlqErr := c.deadLetter.Close(); dlqErr != nil && err == nil {
+			err = dlqErr
+		}
+	}
+	return err
 }
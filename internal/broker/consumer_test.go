@@ -0,0 +1,1464 @@
+package broker
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Asus/L0_DemoServise/internal/entity"
+	"github.com/Asus/L0_DemoServise/internal/metrics"
+	"github.com/hamba/avro/v2"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/segmentio/kafka-go"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+// fakeReader отдаёт заранее подготовленные сообщения, потом возвращает io.EOF
+type fakeReader struct {
+	msgs      []kafka.Message
+	committed []int64
+}
+
+func (r *fakeReader) FetchMessage(ctx context.Context) (kafka.Message, error) {
+	if len(r.msgs) == 0 {
+		return kafka.Message{}, io.EOF
+	}
+	msg := r.msgs[0]
+	r.msgs = r.msgs[1:]
+	return msg, nil
+}
+
+func (r *fakeReader) CommitMessages(ctx context.Context, msgs ...kafka.Message) error {
+	for _, msg := range msgs {
+		r.committed = append(r.committed, msg.Offset)
+	}
+	return nil
+}
+
+func (r *fakeReader) Close() error { return nil }
+
+// fakeWriter - in-process замена dead-letter топика
+type fakeWriter struct {
+	written []kafka.Message
+	err     error
+}
+
+func (w *fakeWriter) WriteMessages(ctx context.Context, msgs ...kafka.Message) error {
+	if w.err != nil {
+		return w.err
+	}
+	w.written = append(w.written, msgs...)
+	return nil
+}
+
+func (w *fakeWriter) Close() error { return nil }
+
+// fakeSaver возвращает ошибки из errs по очереди, затем err, а при успехе - result
+type fakeSaver struct {
+	saved  []string
+	calls  int
+	errs   []error
+	err    error
+	result entity.SaveResult
+}
+
+func (s *fakeSaver) SaveOrder(ctx context.Context, o entity.Order) (entity.SaveResult, error) {
+	s.calls++
+	if len(s.errs) > 0 {
+		err := s.errs[0]
+		s.errs = s.errs[1:]
+		return 0, err
+	}
+	if s.err != nil {
+		return 0, s.err
+	}
+	s.saved = append(s.saved, o.OrderUID)
+	if s.result == 0 {
+		return entity.SaveInserted, nil
+	}
+	return s.result, nil
+}
+
+func loadModelOrder(t *testing.T) []byte {
+	t.Helper()
+	data, err := os.ReadFile("../../cmd/helpCMD/model.json")
+	if err != nil {
+		t.Fatalf("failed to read model.json: %v", err)
+	}
+	return data
+}
+
+func header(msg kafka.Message, key string) (string, bool) {
+	for _, h := range msg.Headers {
+		if h.Key == key {
+			return string(h.Value), true
+		}
+	}
+	return "", false
+}
+
+func TestConsumeAndSaveDeadLetter(t *testing.T) {
+	validOrder := loadModelOrder(t)
+
+	testCases := []struct {
+		name          string
+		value         []byte
+		saverErr      error
+		saverResult   entity.SaveResult
+		expectedStage RejectStage
+		expectedSaved int
+	}{
+		{
+			name:          "valid order is saved",
+			value:         validOrder,
+			expectedSaved: 1,
+		},
+		{
+			name:          "broken JSON goes to dead-letter with parse stage",
+			value:         []byte(`{"order_uid": `),
+			expectedStage: StageParse,
+		},
+		{
+			name:          "invalid order goes to dead-letter with validate stage",
+			value:         []byte(`{"order_uid": "uid-without-anything-else"}`),
+			expectedStage: StageValidate,
+		},
+		{
+			name:          "storage failure goes to dead-letter with persist stage",
+			value:         validOrder,
+			saverErr:      errors.New("db is down"),
+			expectedStage: StagePersist,
+		},
+		{
+			name:          "exact duplicate is committed without dead-letter",
+			value:         validOrder,
+			saverResult:   entity.SaveDuplicate,
+			expectedSaved: 1,
+		},
+		{
+			name:          "changed duplicate goes to dead-letter with conflict stage",
+			value:         validOrder,
+			saverResult:   entity.SaveConflict,
+			expectedStage: StageConflict,
+			expectedSaved: 1,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			msg := kafka.Message{
+				Topic:     "orders",
+				Partition: 2,
+				Offset:    42,
+				Key:       []byte("key"),
+				Value:     tc.value,
+
+				HighWaterMark: 50,
+			}
+			rejected := metrics.ConsumerRejected.WithLabelValues(string(tc.expectedStage))
+			rejectedBefore := testutil.ToFloat64(rejected)
+			dlq := &fakeWriter{}
+			saver := &fakeSaver{err: tc.saverErr, result: tc.saverResult}
+			reader := &fakeReader{msgs: []kafka.Message{msg}}
+			consumer := &KafkaConsumer{
+				reader:     reader,
+				deadLetter: dlq,
+				saver:      saver,
+			}
+
+			if err := consumer.ConsumeAndSave(context.Background()); !errors.Is(err, io.EOF) {
+				t.Fatalf("expected io.EOF after the last message, got: %v", err)
+			}
+
+			// и сохранённое, и отправленное в dead-letter сообщение должно быть закоммичено
+			if len(reader.committed) != 1 || reader.committed[0] != 42 {
+				t.Errorf("expected offset 42 to be committed, got %v", reader.committed)
+			}
+
+			if len(saver.saved) != tc.expectedSaved {
+				t.Errorf("expected %d saved orders, got %d", tc.expectedSaved, len(saver.saved))
+			}
+			if lag := testutil.ToFloat64(metrics.ConsumerLag.WithLabelValues("orders", "2")); lag != 7 {
+				t.Errorf("expected consumer lag 7 (high water mark 50, offset 42), got %v", lag)
+			}
+
+			if tc.expectedStage != "" && testutil.ToFloat64(rejected) != rejectedBefore+1 {
+				t.Errorf("expected rejected counter for stage %q to grow by 1", tc.expectedStage)
+			}
+
+			if tc.expectedStage == "" {
+				if len(dlq.written) != 0 {
+					t.Errorf("expected no dead-letter messages, got %d", len(dlq.written))
+				}
+				return
+			}
+
+			if len(dlq.written) != 1 {
+				t.Fatalf("expected 1 dead-letter message, got %d", len(dlq.written))
+			}
+			dead := dlq.written[0]
+			if string(dead.Value) != string(tc.value) || string(dead.Key) != "key" {
+				t.Errorf("dead-letter message must keep the original key and value")
+			}
+
+			expectedHeaders := map[string]string{
+				HeaderOriginalTopic:     "orders",
+				HeaderOriginalPartition: "2",
+				HeaderOriginalOffset:    "42",
+				HeaderFailureStage:      string(tc.expectedStage),
+			}
+			for key, want := range expectedHeaders {
+				if got, ok := header(dead, key); !ok || got != want {
+					t.Errorf("header %s: expected %q, got %q", key, want, got)
+				}
+			}
+			if errText, ok := header(dead, HeaderError); !ok || errText == "" {
+				t.Errorf("header %s must contain the error text", HeaderError)
+			}
+		})
+	}
+}
+
+func TestConsumeAndSaveDeadLetterWriteFailure(t *testing.T) {
+	reader := &fakeReader{msgs: []kafka.Message{
+		{Offset: 1, Value: []byte("not a json")},
+		{Offset: 2, Value: loadModelOrder(t)},
+	}}
+	consumer := &KafkaConsumer{
+		reader:     reader,
+		deadLetter: &fakeWriter{err: errors.New("kafka is down")},
+		saver:      &fakeSaver{},
+		retry:      retryPolicy{maxRetries: 2},
+	}
+
+	// сообщение не попало ни в БД, ни в dead-letter - его нельзя коммитить
+	if err := consumer.ConsumeAndSave(context.Background()); err == nil || errors.Is(err, io.EOF) {
+		t.Fatalf("expected dead-letter error, got: %v", err)
+	}
+	if len(reader.committed) != 0 {
+		t.Errorf("expected no commits, got %v", reader.committed)
+	}
+}
+
+func TestConsumeAndSaveRetry(t *testing.T) {
+	transient := errors.New("connection reset by peer")
+	permanent := fmt.Errorf("%w: null value in column", entity.ErrInvalidOrder)
+
+	testCases := []struct {
+		name          string
+		saver         *fakeSaver
+		expectedCalls int
+		expectedDead  int
+	}{
+		{
+			name:          "transient errors are retried until success",
+			saver:         &fakeSaver{errs: []error{transient, transient}},
+			expectedCalls: 3,
+		},
+		{
+			name:          "exhausted retries send message to dead-letter",
+			saver:         &fakeSaver{err: transient},
+			expectedCalls: 4,
+			expectedDead:  1,
+		},
+		{
+			name:          "constraint violations are not retried",
+			saver:         &fakeSaver{err: permanent},
+			expectedCalls: 1,
+			expectedDead:  1,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			reader := &fakeReader{msgs: []kafka.Message{{Offset: 7, Value: loadModelOrder(t)}}}
+			dlq := &fakeWriter{}
+			consumer := &KafkaConsumer{
+				reader:     reader,
+				deadLetter: dlq,
+				saver:      tc.saver,
+				retry:      retryPolicy{maxRetries: 3, backoff: time.Millisecond, maxBackoff: 2 * time.Millisecond},
+			}
+
+			if err := consumer.ConsumeAndSave(context.Background()); !errors.Is(err, io.EOF) {
+				t.Fatalf("expected io.EOF after the last message, got: %v", err)
+			}
+			if tc.saver.calls != tc.expectedCalls {
+				t.Errorf("expected %d SaveOrder calls, got %d", tc.expectedCalls, tc.saver.calls)
+			}
+			if len(dlq.written) != tc.expectedDead {
+				t.Errorf("expected %d dead-letter messages, got %d", tc.expectedDead, len(dlq.written))
+			}
+			if len(reader.committed) != 1 {
+				t.Errorf("expected the message to be committed once, got %v", reader.committed)
+			}
+		})
+	}
+}
+
+func TestConsumeAndSaveStopsRetryingOnCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	reader := &fakeReader{msgs: []kafka.Message{{Offset: 7, Value: loadModelOrder(t)}}}
+	saver := &fakeSaver{err: errors.New("connection refused")}
+	consumer := &KafkaConsumer{
+		reader:     reader,
+		deadLetter: &fakeWriter{},
+		saver:      saver,
+		retry:      retryPolicy{maxRetries: 10, backoff: time.Hour},
+	}
+
+	time.AfterFunc(10*time.Millisecond, cancel)
+	if err := consumer.ConsumeAndSave(ctx); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got: %v", err)
+	}
+	if len(reader.committed) != 0 {
+		t.Errorf("unsaved message must not be committed, got %v", reader.committed)
+	}
+}
+
+func TestRetryPolicyDelay(t *testing.T) {
+	p := retryPolicy{backoff: 100 * time.Millisecond, maxBackoff: time.Second}
+	expected := []time.Duration{100 * time.Millisecond, 200 * time.Millisecond, 400 * time.Millisecond, 800 * time.Millisecond, time.Second, time.Second}
+	for i, want := range expected {
+		if got := p.delay(i + 1); got != want {
+			t.Errorf("attempt %d: expected %v, got %v", i+1, want, got)
+		}
+	}
+}
+
+// cancelingSaver имитирует сигнал остановки, пришедший во время сохранения заказа
+type cancelingSaver struct {
+	cancel   context.CancelFunc
+	ctxAlive bool
+}
+
+func (s *cancelingSaver) SaveOrder(ctx context.Context, o entity.Order) (entity.SaveResult, error) {
+	s.cancel()
+	s.ctxAlive = ctx.Err() == nil
+	return entity.SaveInserted, nil
+}
+
+func TestConsumeAndSaveDrainsInFlightMessage(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	reader := &fakeReader{msgs: []kafka.Message{{Offset: 3, Value: loadModelOrder(t)}}}
+	saver := &cancelingSaver{cancel: cancel}
+	consumer := &KafkaConsumer{reader: reader, saver: saver}
+
+	consumer.ConsumeAndSave(ctx)
+
+	if !saver.ctxAlive {
+		t.Error("stopping the consumer must not cancel an in-flight SaveOrder")
+	}
+	if len(reader.committed) != 1 || reader.committed[0] != 3 {
+		t.Errorf("saved message must be committed during shutdown, got %v", reader.committed)
+	}
+}
+
+// hangingSaver не возвращается из SaveOrder, пока не отменят его ctx
+type hangingSaver struct {
+	started chan struct{}
+}
+
+func (s *hangingSaver) SaveOrder(ctx context.Context, o entity.Order) (entity.SaveResult, error) {
+	close(s.started)
+	<-ctx.Done()
+	return 0, ctx.Err()
+}
+
+func TestConsumeAndSaveAbortsHangingMessage(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	reader := &fakeReader{msgs: []kafka.Message{{Offset: 3, Value: loadModelOrder(t)}}}
+	dlq := &fakeWriter{}
+	saver := &hangingSaver{started: make(chan struct{})}
+	aborted, abort := context.WithCancel(context.Background())
+	consumer := &KafkaConsumer{reader: reader, deadLetter: dlq, saver: saver, aborted: aborted, abort: abort}
+
+	done := make(chan error, 1)
+	go func() { done <- consumer.ConsumeAndSave(ctx) }()
+	<-saver.started
+	cancel() // сигнал остановки зависшее сохранение не прерывает...
+	select {
+	case err := <-done:
+		t.Fatalf("consumer must keep saving after the stop signal, returned %v", err)
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	consumer.Abort() // ...а истёкшее время на остановку - прерывает
+	select {
+	case err := <-done:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("expected context.Canceled, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Abort must cancel the in-flight SaveOrder")
+	}
+	if len(reader.committed) != 0 || len(dlq.written) != 0 {
+		t.Errorf("aborted message must be neither committed nor dead-lettered, committed %v, dead-letter %d", reader.committed, len(dlq.written))
+	}
+}
+
+// fakeInvalidator запоминает UID применённых событий
+type fakeInvalidator struct {
+	applied []string
+}
+
+func (c *fakeInvalidator) ApplyInvalidation(ctx context.Context, ev entity.CacheInvalidation) {
+	c.applied = append(c.applied, ev.OrderUID)
+}
+
+func TestInvalidationFanOut(t *testing.T) {
+	writer := &fakeWriter{}
+	publisher := &InvalidationPublisher{writer: writer, replicaID: "replica-a"}
+	if err := publisher.PublishInvalidation(t.Context(), "order-1", entity.InvalidationSaved); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(writer.written) != 1 || string(writer.written[0].Key) != "order-1" {
+		t.Fatalf("expected one event keyed by order UID, got %+v", writer.written)
+	}
+
+	var ev entity.CacheInvalidation
+	if err := json.Unmarshal(writer.written[0].Value, &ev); err != nil {
+		t.Fatalf("event must be JSON: %v", err)
+	}
+	if ev.OrderUID != "order-1" || ev.Action != entity.InvalidationSaved || ev.Origin != "replica-a" {
+		t.Errorf("unexpected event %+v", ev)
+	}
+
+	foreign, _ := json.Marshal(entity.CacheInvalidation{OrderUID: "order-2", Action: entity.InvalidationSaved, Origin: "replica-b"})
+	reader := &fakeReader{msgs: []kafka.Message{
+		{Offset: 1, Value: writer.written[0].Value}, // своё событие
+		{Offset: 2, Value: []byte("not json")},
+		{Offset: 3, Value: foreign},
+	}}
+	cache := &fakeInvalidator{}
+	consumer := &InvalidationConsumer{cache: cache, replicaID: "replica-a", newReaders: func(context.Context) ([]partitionReader, error) {
+		return []partitionReader{reader}, nil
+	}}
+
+	if err := consumer.Consume(t.Context()); !errors.Is(err, io.EOF) {
+		t.Fatalf("expected io.EOF after the last message, got %v", err)
+	}
+	if len(cache.applied) != 1 || cache.applied[0] != "order-2" {
+		t.Errorf("only the other replica's event must be applied, got %v", cache.applied)
+	}
+	if len(reader.committed) != 0 {
+		t.Errorf("events are read without a consumer group and must not be committed, got %v", reader.committed)
+	}
+	if err := consumer.Close(); err != nil {
+		t.Errorf("unexpected close error: %v", err)
+	}
+}
+
+// fakeStatusChanger возвращает ошибки из errs по очереди, затем применяет события
+type fakeStatusChanger struct {
+	errs    []error
+	calls   int
+	changed []entity.OrderStatus
+}
+
+func (c *fakeStatusChanger) ChangeStatus(ctx context.Context, ev entity.StatusEvent) (entity.StatusChange, error) {
+	c.calls++
+	if len(c.errs) > 0 {
+		err := c.errs[0]
+		c.errs = c.errs[1:]
+		return entity.StatusChange{}, err
+	}
+	c.changed = append(c.changed, ev.Status)
+	return entity.StatusChange{OrderUID: ev.OrderUID, To: ev.Status}, nil
+}
+
+func TestStatusConsumer(t *testing.T) {
+	event := []byte(`{"order_uid": "uid-1", "status": "paid", "reason": "payment confirmed"}`)
+	invalid := fmt.Errorf("order uid-1: %w: created -> delivered", entity.ErrInvalidTransition)
+
+	testCases := []struct {
+		name          string
+		value         []byte
+		errs          []error
+		expectedStage RejectStage
+		expectedCalls int
+	}{
+		{
+			name:          "status event is applied",
+			value:         event,
+			expectedCalls: 1,
+		},
+		{
+			name:          "broken JSON goes to dead-letter with parse stage",
+			value:         []byte(`{"order_uid": `),
+			expectedStage: StageParse,
+		},
+		{
+			name:          "event without status goes to dead-letter with validate stage",
+			value:         []byte(`{"order_uid": "uid-1"}`),
+			expectedStage: StageValidate,
+		},
+		{
+			name:          "forbidden transition is not retried",
+			value:         event,
+			errs:          []error{invalid},
+			expectedStage: StageTransition,
+			expectedCalls: 1,
+		},
+		{
+			name:          "order that has not arrived yet is retried",
+			value:         event,
+			errs:          []error{entity.ErrNotFound},
+			expectedCalls: 2,
+		},
+		{
+			name:          "order that never arrives goes to dead-letter with transition stage",
+			value:         event,
+			errs:          []error{entity.ErrNotFound, entity.ErrNotFound, entity.ErrNotFound},
+			expectedStage: StageTransition,
+			expectedCalls: 3,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			reader := &fakeReader{msgs: []kafka.Message{{Topic: "orders-status", Offset: 7, Value: tc.value}}}
+			dlq := &fakeWriter{}
+			changer := &fakeStatusChanger{errs: tc.errs}
+			consumer := &StatusConsumer{
+				KafkaConsumer: &KafkaConsumer{
+					reader:     reader,
+					deadLetter: dlq,
+					retry:      retryPolicy{maxRetries: 2, backoff: time.Millisecond},
+				},
+				changer: changer,
+			}
+
+			if err := consumer.Consume(context.Background()); !errors.Is(err, io.EOF) {
+				t.Fatalf("expected io.EOF after the last message, got: %v", err)
+			}
+			if len(reader.committed) != 1 || reader.committed[0] != 7 {
+				t.Errorf("expected offset 7 to be committed, got %v", reader.committed)
+			}
+			if changer.calls != tc.expectedCalls {
+				t.Errorf("expected %d ChangeStatus calls, got %d", tc.expectedCalls, changer.calls)
+			}
+
+			if tc.expectedStage == "" {
+				if len(dlq.written) != 0 {
+					t.Errorf("expected no dead-letter messages, got %d", len(dlq.written))
+				}
+				return
+			}
+			if len(dlq.written) != 1 {
+				t.Fatalf("expected 1 dead-letter message, got %d", len(dlq.written))
+			}
+			if stage, _ := header(dlq.written[0], HeaderFailureStage); stage != string(tc.expectedStage) {
+				t.Errorf("expected stage %q, got %q", tc.expectedStage, stage)
+			}
+		})
+	}
+}
+
+// fakeEventApplier запоминает применённые события, err возвращается на каждое из них
+type fakeEventApplier struct {
+	applied []string
+	err     error
+}
+
+func (a *fakeEventApplier) record(kind, UID string) error {
+	if a.err != nil {
+		return a.err
+	}
+	a.applied = append(a.applied, kind+":"+UID)
+	return nil
+}
+
+func (a *fakeEventApplier) UpdateOrder(ctx context.Context, UID string, patch entity.OrderPatch) error {
+	return a.record("update", UID)
+}
+
+func (a *fakeEventApplier) ChangeDelivery(ctx context.Context, UID string, d entity.Delivery) error {
+	return a.record("delivery", UID)
+}
+
+func (a *fakeEventApplier) ReturnItems(ctx context.Context, UID string, ret entity.ItemsReturn) error {
+	return a.record("return", UID)
+}
+
+func (a *fakeEventApplier) CancelOrder(ctx context.Context, UID string, c entity.Cancellation) error {
+	return a.record("cancel", UID)
+}
+
+func TestConsumeOrderEvents(t *testing.T) {
+	order := loadModelOrder(t)
+	var orderUID struct {
+		OrderUID string `json:"order_uid"`
+	}
+	if err := json.Unmarshal(order, &orderUID); err != nil {
+		t.Fatalf("failed to read order_uid of the model order: %v", err)
+	}
+	envelope := func(eventType, payload string) []byte {
+		return []byte(fmt.Sprintf(`{"type": %q, "version": 1, "order_uid": "uid-1", "payload": %s}`, eventType, payload))
+	}
+
+	testCases := []struct {
+		name            string
+		value           []byte
+		applierErr      error
+		expectedApplied []string
+		expectedSaved   int
+		expectedStage   RejectStage
+	}{
+		{
+			name:          "legacy order JSON is saved as order.created",
+			value:         order,
+			expectedSaved: 1,
+		},
+		{
+			name:          "order.created envelope is saved",
+			value:         []byte(fmt.Sprintf(`{"type": "order.created", "order_uid": %q, "payload": %s}`, orderUID.OrderUID, order)),
+			expectedSaved: 1,
+		},
+		{
+			name:          "order.created with another order_uid in payload is rejected",
+			value:         []byte(fmt.Sprintf(`{"type": "order.created", "order_uid": "other", "payload": %s}`, order)),
+			expectedStage: StageValidate,
+		},
+		{
+			name:            "partial update is applied",
+			value:           envelope("order.updated", `{"track_number": "TRACK-NEW", "sm_id": 7}`),
+			expectedApplied: []string{"update:uid-1"},
+		},
+		{
+			name:          "empty update is rejected",
+			value:         envelope("order.updated", `{}`),
+			expectedStage: StageValidate,
+		},
+		{
+			name:          "update with unknown field is rejected",
+			value:         envelope("order.updated", `{"trak_number": "TRACK-NEW"}`),
+			expectedStage: StageParse,
+		},
+		{
+			name:          "update with invalid locale is rejected",
+			value:         envelope("order.updated", `{"locale": "english"}`),
+			expectedStage: StageValidate,
+		},
+		{
+			name: "delivery change is applied",
+			value: envelope("order.delivery_changed",
+				`{"name": "Test", "phone": "+79990000000", "city": "Moscow", "address": "Lenina 1", "email": "test@example.com"}`),
+			expectedApplied: []string{"delivery:uid-1"},
+		},
+		{
+			name:          "delivery without phone is rejected",
+			value:         envelope("order.delivery_changed", `{"name": "Test", "city": "Moscow", "address": "Lenina 1"}`),
+			expectedStage: StageValidate,
+		},
+		{
+			name:            "item return is applied",
+			value:           envelope("order.items_returned", `{"rids": ["rid-1"], "returned_at": "2026-03-02T09:00:00Z", "reason": "broken"}`),
+			expectedApplied: []string{"return:uid-1"},
+		},
+		{
+			name:          "return without returned_at is rejected",
+			value:         envelope("order.items_returned", `{"rids": ["rid-1"]}`),
+			expectedStage: StageValidate,
+		},
+		{
+			name:          "return without items is rejected",
+			value:         envelope("order.items_returned", `{"rids": []}`),
+			expectedStage: StageValidate,
+		},
+		{
+			name:            "cancellation without payload is applied",
+			value:           []byte(`{"type": "order.cancelled", "order_uid": "uid-1"}`),
+			expectedApplied: []string{"cancel:uid-1"},
+		},
+		{
+			name:          "cancellation of a shipped order goes to dead-letter with transition stage",
+			value:         envelope("order.cancelled", `{"reason": "changed my mind"}`),
+			applierErr:    fmt.Errorf("%w: shipped -> cancelled", entity.ErrInvalidTransition),
+			expectedStage: StageTransition,
+		},
+		{
+			name:          "return of foreign items goes to dead-letter with validate stage",
+			value:         envelope("order.items_returned", `{"rids": ["rid-9"], "returned_at": "2026-03-02T09:00:00Z"}`),
+			applierErr:    fmt.Errorf("%w: item rid-9 does not belong to order", entity.ErrInvalidOrder),
+			expectedStage: StageValidate,
+		},
+		{
+			name:          "unknown event type is rejected",
+			value:         envelope("order.teleported", `{}`),
+			expectedStage: StageValidate,
+		},
+		{
+			name:          "unknown event version is rejected",
+			value:         []byte(`{"type": "order.updated", "version": 9, "order_uid": "uid-1", "payload": {"sm_id": 1}}`),
+			expectedStage: StageParse,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			reader := &fakeReader{msgs: []kafka.Message{{Topic: "orders", Offset: 3, Value: tc.value}}}
+			dlq := &fakeWriter{}
+			saver := &fakeSaver{}
+			events := &fakeEventApplier{err: tc.applierErr}
+			consumer := &KafkaConsumer{reader: reader, deadLetter: dlq, saver: saver}
+			consumer.EnableOrderEvents(events)
+
+			if err := consumer.ConsumeAndSave(context.Background()); !errors.Is(err, io.EOF) {
+				t.Fatalf("expected io.EOF after the last message, got: %v", err)
+			}
+			if len(reader.committed) != 1 {
+				t.Errorf("expected the message to be committed, got %v", reader.committed)
+			}
+			if len(saver.saved) != tc.expectedSaved {
+				t.Errorf("expected %d saved orders, got %d", tc.expectedSaved, len(saver.saved))
+			}
+			if fmt.Sprint(events.applied) != fmt.Sprint(tc.expectedApplied) {
+				t.Errorf("expected applied events %v, got %v", tc.expectedApplied, events.applied)
+			}
+
+			if tc.expectedStage == "" {
+				if len(dlq.written) != 0 {
+					t.Errorf("expected no dead-letter messages, got %d", len(dlq.written))
+				}
+				return
+			}
+			if len(dlq.written) != 1 {
+				t.Fatalf("expected 1 dead-letter message, got %d", len(dlq.written))
+			}
+			if stage, _ := header(dlq.written[0], HeaderFailureStage); stage != string(tc.expectedStage) {
+				t.Errorf("expected stage %q, got %q", tc.expectedStage, stage)
+			}
+		})
+	}
+}
+
+var updateGolden = flag.Bool("update", false, "rewrite golden files in testdata")
+
+// TestOrderSchemaGolden проверяет, что заказы каждой версии схемы из testdata/orders/vN разбираются
+// в тот же entity.Order, что записан рядом в .golden. У каждой версии должны быть свои файлы
+func TestOrderSchemaGolden(t *testing.T) {
+	decoder := NewOrderDecoder()
+	for version := oldestOrderSchema; version <= CurrentOrderSchema; version++ {
+		inputs, err := filepath.Glob(filepath.Join("testdata", "orders", "v"+strconv.Itoa(version), "*.json"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(inputs) == 0 {
+			t.Errorf("schema version %d has no fixtures in testdata/orders/v%d", version, version)
+		}
+
+		for _, input := range inputs {
+			t.Run(fmt.Sprintf("v%d/%s", version, filepath.Base(input)), func(t *testing.T) {
+				data, err := os.ReadFile(input)
+				if err != nil {
+					t.Fatal(err)
+				}
+				order, err := decoder.Decode(data, strconv.Itoa(version))
+				if err != nil {
+					t.Fatalf("failed to decode fixture: %v", err)
+				}
+				got, err := json.MarshalIndent(order, "", "  ")
+				if err != nil {
+					t.Fatal(err)
+				}
+				got = append(got, '\n')
+
+				golden := strings.TrimSuffix(input, ".json") + ".golden"
+				if *updateGolden {
+					if err := os.WriteFile(golden, got, 0o644); err != nil {
+						t.Fatal(err)
+					}
+				}
+				want, err := os.ReadFile(golden)
+				if err != nil {
+					t.Fatalf("failed to read golden file (run with -update to create it): %v", err)
+				}
+				if !bytes.Equal(got, want) {
+					t.Errorf("decoded order differs from %s:\n%s", golden, got)
+				}
+			})
+		}
+	}
+}
+
+func TestOrderDecoder(t *testing.T) {
+	model := loadModelOrder(t)
+	withField := func(field string) []byte {
+		return append([]byte(`{`+field+`, `), bytes.TrimPrefix(bytes.TrimSpace(model), []byte("{"))...)
+	}
+
+	testCases := []struct {
+		name        string
+		payload     []byte
+		header      string
+		unsupported bool
+		wantErr     bool
+	}{
+		{name: "message without version is schema 1", payload: model},
+		{name: "version from header", payload: model, header: "1"},
+		{name: "version from field", payload: withField(`"schema_version": 1`)},
+		{name: "unknown field of the current schema is ignored", payload: withField(`"customer_name": "Test"`)},
+		{name: "newer version is unsupported", payload: withField(`"schema_version": 2`), unsupported: true},
+		{name: "version older than the oldest is unsupported", payload: model, header: "-1", unsupported: true},
+		{name: "schema 0 needs payment_dt in unix seconds", payload: model, header: "0", wantErr: true},
+		{name: "malformed header is unsupported", payload: model, header: "v1", unsupported: true},
+		{name: "header and field must agree", payload: withField(`"schema_version": 1`), header: "2", unsupported: true},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			order, err := NewOrderDecoder().Decode(tc.payload, tc.header)
+			switch {
+			case tc.unsupported:
+				if !errors.Is(err, ErrUnsupportedSchema) {
+					t.Errorf("expected ErrUnsupportedSchema, got %v", err)
+				}
+			case tc.wantErr:
+				if err == nil || errors.Is(err, ErrUnsupportedSchema) {
+					t.Errorf("expected a decoding error, got %v", err)
+				}
+			case err != nil:
+				t.Errorf("unexpected error: %v", err)
+			case order.OrderUID != "b563feb7b2b84b6test1" || len(order.Items) != 1:
+				t.Errorf("unexpected order %+v", order)
+			}
+		})
+	}
+}
+
+func TestOrderDecoderUpcasting(t *testing.T) {
+	// версия 1 называла customer_id "customer", версия 2 вынесла службу доставки во вложенный объект
+	decoder := &OrderDecoder{current: 3, upcasters: map[int]Upcaster{
+		1: func(doc map[string]any) error {
+			doc["customer_id"] = doc["customer"]
+			delete(doc, "customer")
+			return nil
+		},
+		2: func(doc map[string]any) error {
+			shipping, ok := doc["shipping"].(map[string]any)
+			if !ok {
+				return errors.New("shipping object is missing")
+			}
+			doc["delivery_service"] = shipping["service"]
+			delete(doc, "shipping")
+			return nil
+		},
+	}}
+
+	v1 := []byte(`{"order_uid": "uid-1", "customer": "test", "shipping": {"service": "meest"}, "sm_id": 99}`)
+	order, err := decoder.Decode(v1, "1")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if order.CustomerID != "test" || order.DeliveryService != "meest" || order.SmID != 99 {
+		t.Errorf("expected the order to be upcasted through both versions, got %+v", order)
+	}
+
+	v2 := []byte(`{"order_uid": "uid-1", "customer_id": "test"}`)
+	if _, err := decoder.Decode(v2, "2"); err == nil || errors.Is(err, ErrUnsupportedSchema) {
+		t.Errorf("expected the upcaster error to be returned, got %v", err)
+	}
+
+	delete(decoder.upcasters, 1)
+	if _, err := decoder.Decode(v1, "1"); !errors.Is(err, ErrUnsupportedSchema) {
+		t.Errorf("expected ErrUnsupportedSchema without an upcaster from version 1, got %v", err)
+	}
+}
+
+func TestConsumeAndSaveUnsupportedSchema(t *testing.T) {
+	reader := &fakeReader{msgs: []kafka.Message{{
+		Offset:  5,
+		Value:   loadModelOrder(t),
+		Headers: []kafka.Header{{Key: HeaderSchemaVersion, Value: []byte("9")}},
+	}}}
+	dlq := &fakeWriter{}
+	saver := &fakeSaver{}
+	consumer := &KafkaConsumer{reader: reader, deadLetter: dlq, saver: saver}
+
+	if err := consumer.ConsumeAndSave(context.Background()); !errors.Is(err, io.EOF) {
+		t.Fatalf("expected io.EOF after the last message, got: %v", err)
+	}
+	if len(saver.saved) != 0 || len(reader.committed) != 1 {
+		t.Errorf("expected the message to be committed without saving, saved %v, committed %v", saver.saved, reader.committed)
+	}
+	if len(dlq.written) != 1 {
+		t.Fatalf("expected 1 dead-letter message, got %d", len(dlq.written))
+	}
+	if stage, _ := header(dlq.written[0], HeaderFailureStage); stage != string(StageSchema) {
+		t.Errorf("expected stage %q, got %q", StageSchema, stage)
+	}
+}
+
+const orderAvroSchema = `{
+	"type": "record", "name": "Order", "namespace": "orders",
+	"fields": [
+		{"name": "order_uid", "type": "string"},
+		{"name": "track_number", "type": "string"},
+		{"name": "entry", "type": "string"},
+		{"name": "delivery", "type": {"type": "record", "name": "Delivery", "fields": [
+			{"name": "name", "type": "string"},
+			{"name": "phone", "type": "string"},
+			{"name": "zip", "type": "string"},
+			{"name": "city", "type": "string"},
+			{"name": "address", "type": "string"},
+			{"name": "region", "type": "string"},
+			{"name": "email", "type": "string"}
+		]}},
+		{"name": "payment", "type": {"type": "record", "name": "Payment", "fields": [
+			{"name": "transaction", "type": "string"},
+			{"name": "request_id", "type": "string"},
+			{"name": "currency", "type": "string"},
+			{"name": "provider", "type": "string"},
+			{"name": "amount", "type": "long"},
+			{"name": "payment_dt", "type": {"type": "long", "logicalType": "timestamp-millis"}},
+			{"name": "bank", "type": "string"},
+			{"name": "delivery_cost", "type": "long"},
+			{"name": "goods_total", "type": "long"},
+			{"name": "custom_fee", "type": "long"}
+		]}},
+		{"name": "items", "type": {"type": "array", "items": {"type": "record", "name": "Item", "fields": [
+			{"name": "chrt_id", "type": "long"},
+			{"name": "track_number", "type": "string"},
+			{"name": "price", "type": "long"},
+			{"name": "rid", "type": "string"},
+			{"name": "name", "type": "string"},
+			{"name": "sale", "type": "long"},
+			{"name": "size", "type": "string"},
+			{"name": "total_price", "type": "long"},
+			{"name": "nm_id", "type": "long"},
+			{"name": "brand", "type": "string"},
+			{"name": "status", "type": "long"},
+			{"name": "returned_at", "type": ["null", {"type": "long", "logicalType": "timestamp-millis"}], "default": null}
+		]}}},
+		{"name": "locale", "type": "string"},
+		{"name": "internal_signature", "type": "string"},
+		{"name": "customer_id", "type": "string"},
+		{"name": "delivery_service", "type": "string"},
+		{"name": "shardkey", "type": "string"},
+		{"name": "sm_id", "type": "long"},
+		{"name": "date_created", "type": {"type": "long", "logicalType": "timestamp-millis"}},
+		{"name": "oof_shard", "type": "string"}
+	]
+}`
+
+const orderProtoSchema = `syntax = "proto3";
+package orders;
+
+import "google/protobuf/timestamp.proto";
+
+message Order {
+	string order_uid = 1;
+	string track_number = 2;
+	string entry = 3;
+	Delivery delivery = 4;
+	Payment payment = 5;
+	repeated Item items = 6;
+	string locale = 7;
+	string internal_signature = 8;
+	string customer_id = 9;
+	string delivery_service = 10;
+	string shardkey = 11;
+	int64 sm_id = 12;
+	google.protobuf.Timestamp date_created = 13;
+	string oof_shard = 14;
+}
+
+message Delivery {
+	string name = 1;
+	string phone = 2;
+	string zip = 3;
+	string city = 4;
+	string address = 5;
+	string region = 6;
+	string email = 7;
+}
+
+message Payment {
+	string transaction = 1;
+	string request_id = 2;
+	string currency = 3;
+	string provider = 4;
+	int64 amount = 5;
+	google.protobuf.Timestamp payment_dt = 6;
+	string bank = 7;
+	int64 delivery_cost = 8;
+	int64 goods_total = 9;
+	int64 custom_fee = 10;
+}
+
+message Item {
+	int64 chrt_id = 1;
+	string track_number = 2;
+	int64 price = 3;
+	string rid = 4;
+	string name = 5;
+	int64 sale = 6;
+	string size = 7;
+	int64 total_price = 8;
+	int64 nm_id = 9;
+	string brand = 10;
+	int64 status = 11;
+}
+`
+
+const (
+	avroSchemaID  = 1
+	protoSchemaID = 2
+)
+
+// registryStub - in-process замена реестра схем. Первые failures запросов получают failStatus (0 - 503)
+type registryStub struct {
+	*httptest.Server
+	requests   int
+	failures   int
+	failStatus int
+}
+
+func newRegistryStub(t *testing.T) *registryStub {
+	t.Helper()
+	stub := &registryStub{}
+	schemas := map[string]map[string]string{
+		strconv.Itoa(avroSchemaID):  {"schema": orderAvroSchema},
+		strconv.Itoa(protoSchemaID): {"schema": orderProtoSchema, "schemaType": SchemaTypeProtobuf},
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /schemas/ids/{id}", func(w http.ResponseWriter, r *http.Request) {
+		stub.requests++
+		if stub.failures > 0 {
+			stub.failures--
+			w.WriteHeader(cmp.Or(stub.failStatus, http.StatusServiceUnavailable))
+			return
+		}
+		schema, ok := schemas[r.PathValue("id")]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `{"error_code": 40403, "message": "Schema not found"}`)
+			return
+		}
+		w.Header().Set("Content-Type", "application/vnd.schemaregistry.v1+json")
+		json.NewEncoder(w).Encode(schema)
+	})
+	stub.Server = httptest.NewServer(mux)
+	t.Cleanup(stub.Close)
+	return stub
+}
+
+func confluentFrame(schemaID int, data []byte) []byte {
+	frame := make([]byte, confluentHeaderLen, confluentHeaderLen+len(data))
+	binary.BigEndian.PutUint32(frame[1:], uint32(schemaID))
+	return append(frame, data...)
+}
+
+// encodeAvroOrder кодирует заказ из model.json в Avro во framing'е Confluent
+func encodeAvroOrder(t *testing.T, schemaID int) []byte {
+	t.Helper()
+	var o entity.Order
+	if err := json.Unmarshal(loadModelOrder(t), &o); err != nil {
+		t.Fatalf("failed to parse model.json: %v", err)
+	}
+
+	items := make([]any, 0, len(o.Items))
+	for _, it := range o.Items {
+		items = append(items, map[string]any{
+			"chrt_id": int64(it.ChrtID), "track_number": it.TrackNumber, "price": int64(it.Price), "rid": it.Rid,
+			"name": it.Name, "sale": int64(it.Sale), "size": it.Size, "total_price": int64(it.TotalPrice),
+			"nm_id": int64(it.NmID), "brand": it.Brand, "status": int64(it.Status), "returned_at": nil,
+		})
+	}
+	datum := map[string]any{
+		"order_uid": o.OrderUID, "track_number": o.TrackNumber, "entry": o.Entry,
+		"delivery": map[string]any{
+			"name": o.Delivery.Name, "phone": o.Delivery.Phone, "zip": o.Delivery.Zip, "city": o.Delivery.City,
+			"address": o.Delivery.Address, "region": o.Delivery.Region, "email": o.Delivery.Email,
+		},
+		"payment": map[string]any{
+			"transaction": o.Payment.OrderUID, "request_id": o.Payment.RequestID, "currency": o.Payment.Currency,
+			"provider": o.Payment.Provider, "amount": int64(o.Payment.Amount), "payment_dt": o.Payment.PaymentDt,
+			"bank": o.Payment.Bank, "delivery_cost": int64(o.Payment.DeliveryCost),
+			"goods_total": int64(o.Payment.GoodsTotal), "custom_fee": int64(o.Payment.CustomFee),
+		},
+		"items": items, "locale": o.Locale, "internal_signature": o.InternalSignature, "customer_id": o.CustomerID,
+		"delivery_service": o.DeliveryService, "shardkey": o.ShardKey, "sm_id": int64(o.SmID),
+		"date_created": o.DateCreated, "oof_shard": o.OofShard,
+	}
+
+	data, err := avro.Marshal(avro.MustParse(orderAvroSchema), datum)
+	if err != nil {
+		t.Fatalf("failed to encode avro order: %v", err)
+	}
+	return confluentFrame(schemaID, data)
+}
+
+// encodeProtoOrder кодирует заказ из model.json в Protobuf во framing'е Confluent (первое сообщение файла)
+func encodeProtoOrder(t *testing.T, registry *SchemaRegistry) []byte {
+	t.Helper()
+	codec := &protobufCodec{registry: registry, files: make(map[int]protoreflect.FileDescriptor)}
+	file, err := codec.file(context.Background(), protoSchemaID)
+	if err != nil {
+		t.Fatalf("failed to compile proto schema: %v", err)
+	}
+	msg := dynamicpb.NewMessage(file.Messages().ByName("Order"))
+	if err := protojson.Unmarshal(loadModelOrder(t), msg); err != nil {
+		t.Fatalf("failed to build proto order: %v", err)
+	}
+	data, err := proto.Marshal(msg)
+	if err != nil {
+		t.Fatalf("failed to encode proto order: %v", err)
+	}
+	// индексы сообщения: 0 - первое сообщение файла
+	return confluentFrame(protoSchemaID, append(binary.AppendVarint(nil, 0), data...))
+}
+
+func TestCodecs(t *testing.T) {
+	expected, err := orderDecoder.Decode(loadModelOrder(t), "")
+	if err != nil {
+		t.Fatalf("failed to decode model.json: %v", err)
+	}
+
+	stub := newRegistryStub(t)
+	registry := NewSchemaRegistry(stub.URL, "", "", time.Second)
+	codecs, err := NewCodecs(map[string]string{"orders-avro": "avro", "orders-proto": "protobuf"}, registry)
+	if err != nil {
+		t.Fatalf("NewCodecs returned error: %v", err)
+	}
+	avroOrder := encodeAvroOrder(t, avroSchemaID)
+	protoOrder := encodeProtoOrder(t, registry)
+
+	testCases := []struct {
+		name string
+		msg  kafka.Message
+	}{
+		{name: "json topic", msg: kafka.Message{Topic: "orders", Value: loadModelOrder(t)}},
+		{name: "avro topic", msg: kafka.Message{Topic: "orders-avro", Value: avroOrder}},
+		{name: "protobuf topic", msg: kafka.Message{Topic: "orders-proto", Value: protoOrder}},
+		{
+			name: "content-type header overrides topic format",
+			msg: kafka.Message{Topic: "orders-avro", Value: protoOrder, Headers: []kafka.Header{
+				{Key: HeaderContentType, Value: []byte("application/x-protobuf; charset=binary")},
+			}},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			value, err := codecs.ToJSON(context.Background(), tc.msg)
+			if err != nil {
+				t.Fatalf("ToJSON returned error: %v", err)
+			}
+			order, err := orderDecoder.Decode(value, "")
+			if err != nil {
+				t.Fatalf("decoded payload is not a valid order: %v\n%s", err, value)
+			}
+			if !reflect.DeepEqual(order, expected) {
+				t.Errorf("decoded order differs from model.json:\n got %+v\nwant %+v", order, expected)
+			}
+		})
+	}
+
+	// схемы кэшируются: по одному запросу на avro и protobuf
+	if stub.requests != 2 {
+		t.Errorf("expected 2 registry requests, got %d", stub.requests)
+	}
+
+	if _, err := NewCodecs(map[string]string{"orders": "avro"}, nil); err == nil {
+		t.Error("expected error for avro format without schema registry")
+	}
+	if _, err := NewCodecs(map[string]string{"orders": "xml"}, registry); err == nil {
+		t.Error("expected error for unknown format")
+	}
+}
+
+func TestConsumeEncodedOrders(t *testing.T) {
+	testCases := []struct {
+		name             string
+		value            func(t *testing.T) []byte
+		headers          []kafka.Header
+		registryFailures int
+		registryStatus   int
+		expectedSaved    int
+		expectedStage    RejectStage
+	}{
+		{
+			name:          "avro order is saved",
+			value:         func(t *testing.T) []byte { return encodeAvroOrder(t, avroSchemaID) },
+			expectedSaved: 1,
+		},
+		{
+			name:             "unavailable registry is retried",
+			value:            func(t *testing.T) []byte { return encodeAvroOrder(t, avroSchemaID) },
+			registryFailures: 2,
+			expectedSaved:    1,
+		},
+		{
+			name:             "registry timeout is retried",
+			value:            func(t *testing.T) []byte { return encodeAvroOrder(t, avroSchemaID) },
+			registryFailures: 2,
+			registryStatus:   http.StatusRequestTimeout,
+			expectedSaved:    1,
+		},
+		{
+			name:             "registry rejecting the request goes to dead-letter with schema stage",
+			value:            func(t *testing.T) []byte { return encodeAvroOrder(t, avroSchemaID) },
+			registryFailures: 1,
+			registryStatus:   http.StatusBadRequest,
+			expectedStage:    StageSchema,
+		},
+		{
+			name:          "unknown schema id goes to dead-letter with schema stage",
+			value:         func(t *testing.T) []byte { return encodeAvroOrder(t, 99) },
+			expectedStage: StageSchema,
+		},
+		{
+			name:          "schema of another type goes to dead-letter with schema stage",
+			value:         func(t *testing.T) []byte { return encodeAvroOrder(t, protoSchemaID) },
+			expectedStage: StageSchema,
+		},
+		{
+			name:          "payload without Confluent framing goes to dead-letter with parse stage",
+			value:         loadModelOrder,
+			expectedStage: StageParse,
+		},
+		{
+			name:          "unknown content-type goes to dead-letter with schema stage",
+			value:         loadModelOrder,
+			headers:       []kafka.Header{{Key: HeaderContentType, Value: []byte("application/xml")}},
+			expectedStage: StageSchema,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			stub := newRegistryStub(t)
+			stub.failures, stub.failStatus = tc.registryFailures, tc.registryStatus
+			codecs, err := NewCodecs(map[string]string{"orders": "avro"}, NewSchemaRegistry(stub.URL, "", "", time.Second))
+			if err != nil {
+				t.Fatalf("NewCodecs returned error: %v", err)
+			}
+
+			reader := &fakeReader{msgs: []kafka.Message{{Topic: "orders", Offset: 3, Value: tc.value(t), Headers: tc.headers}}}
+			dlq := &fakeWriter{}
+			saver := &fakeSaver{}
+			consumer := &KafkaConsumer{
+				reader:     reader,
+				deadLetter: dlq,
+				saver:      saver,
+				retry:      retryPolicy{maxRetries: 3, backoff: time.Millisecond, maxBackoff: 2 * time.Millisecond},
+			}
+			consumer.EnableCodecs(codecs)
+
+			if err := consumer.ConsumeAndSave(context.Background()); !errors.Is(err, io.EOF) {
+				t.Fatalf("expected io.EOF after the last message, got: %v", err)
+			}
+			if len(saver.saved) != tc.expectedSaved {
+				t.Errorf("expected %d saved orders, got %v", tc.expectedSaved, saver.saved)
+			}
+			if len(reader.committed) != 1 {
+				t.Errorf("expected the message to be committed once, got %v", reader.committed)
+			}
+			if tc.expectedStage == "" {
+				if len(dlq.written) != 0 {
+					t.Errorf("expected no dead-letter messages, got %d", len(dlq.written))
+				}
+				return
+			}
+			if len(dlq.written) != 1 {
+				t.Fatalf("expected 1 dead-letter message, got %d", len(dlq.written))
+			}
+			if stage, _ := header(dlq.written[0], HeaderFailureStage); stage != string(tc.expectedStage) {
+				t.Errorf("expected stage %q, got %q", tc.expectedStage, stage)
+			}
+		})
+	}
+}
+
+func TestConsumeStopsOnRegistryFailure(t *testing.T) {
+	testCases := []struct {
+		name             string
+		status           int
+		failures         int
+		expectedErr      error
+		expectedRequests int
+	}{
+		{name: "unauthorized", status: http.StatusUnauthorized, failures: 1, expectedErr: errRegistryAccessDenied, expectedRequests: 1},
+		{name: "forbidden", status: http.StatusForbidden, failures: 1, expectedErr: errRegistryAccessDenied, expectedRequests: 1},
+		{name: "unavailable after retries", status: http.StatusServiceUnavailable, failures: 10, expectedErr: errRegistryUnavailable, expectedRequests: 4},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			stub := newRegistryStub(t)
+			stub.failures, stub.failStatus = tc.failures, tc.status
+			codecs, err := NewCodecs(map[string]string{"orders": "avro"}, NewSchemaRegistry(stub.URL, "", "", time.Second))
+			if err != nil {
+				t.Fatalf("NewCodecs returned error: %v", err)
+			}
+
+			reader := &fakeReader{msgs: []kafka.Message{{Topic: "orders", Offset: 3, Value: encodeAvroOrder(t, avroSchemaID)}}}
+			dlq := &fakeWriter{}
+			consumer := &KafkaConsumer{
+				reader:     reader,
+				deadLetter: dlq,
+				saver:      &fakeSaver{},
+				retry:      retryPolicy{maxRetries: 3, backoff: time.Millisecond},
+			}
+			consumer.EnableCodecs(codecs)
+
+			// сбой реестра, а не сообщения: оно не коммитится и не уходит в dead-letter, консьюмер останавливается
+			if err := consumer.ConsumeAndSave(context.Background()); !errors.Is(err, tc.expectedErr) {
+				t.Fatalf("expected %v, got: %v", tc.expectedErr, err)
+			}
+			if len(reader.committed) != 0 || len(dlq.written) != 0 {
+				t.Errorf("expected no commit and no dead-letter, committed %v, dead-letter %d", reader.committed, len(dlq.written))
+			}
+			if stub.requests != tc.expectedRequests {
+				t.Errorf("expected %d registry requests, got %d", tc.expectedRequests, stub.requests)
+			}
+		})
+	}
+}
+
+func TestConsumeAndSaveBusinessRules(t *testing.T) {
+	testCases := []struct {
+		name          string
+		mutate        func(o *entity.Order)
+		disabled      []string
+		expectedRules []string // пусто - заказ сохраняется
+	}{
+		{
+			name:   "valid order is saved",
+			mutate: func(o *entity.Order) {},
+		},
+		{
+			name:   "discounted price may be rounded up",
+			mutate: func(o *entity.Order) { o.Items[0].TotalPrice = 318 },
+		},
+		{
+			name:          "amount must be goods + delivery + custom fee",
+			mutate:        func(o *entity.Order) { o.Payment.Amount = 1000 },
+			expectedRules: []string{entity.RuleAmountTotal},
+		},
+		{
+			name:          "item total price must match price and sale",
+			mutate:        func(o *entity.Order) { o.Items[0].TotalPrice = 453 },
+			expectedRules: []string{entity.RuleItemTotalPrice},
+		},
+		{
+			name:          "item track number must match order",
+			mutate:        func(o *entity.Order) { o.Items[0].TrackNumber = "OTHERTRACK" },
+			expectedRules: []string{entity.RuleItemTrackNumber},
+		},
+		{
+			name:          "payment transaction must match order UID",
+			mutate:        func(o *entity.Order) { o.Payment.OrderUID = "another-order" },
+			expectedRules: []string{entity.RulePaymentTransaction},
+		},
+		{
+			name:          "currency must be ISO 4217",
+			mutate:        func(o *entity.Order) { o.Payment.Currency = "XYZ" },
+			expectedRules: []string{entity.RuleCurrency},
+		},
+		{
+			name:     "disabled rule is not checked",
+			mutate:   func(o *entity.Order) { o.Payment.Currency = "XYZ" },
+			disabled: []string{entity.RuleCurrency},
+		},
+		{
+			name: "all violations are reported together",
+			mutate: func(o *entity.Order) {
+				o.Payment.Amount = 1000
+				o.Payment.Currency = "usd"
+			},
+			expectedRules: []string{entity.RuleAmountTotal, entity.RuleCurrency},
+		},
+		{
+			name:          "tag violations skip business rules",
+			mutate:        func(o *entity.Order) { o.Delivery.Phone = "not a phone"; o.Payment.Amount = 1000 },
+			expectedRules: []string{entity.RuleTags},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var order entity.Order
+			if err := json.Unmarshal(loadModelOrder(t), &order); err != nil {
+				t.Fatalf("failed to parse model.json: %v", err)
+			}
+			tc.mutate(&order)
+			value, err := json.Marshal(order)
+			if err != nil {
+				t.Fatalf("failed to encode order: %v", err)
+			}
+			validator, err := entity.NewOrderValidator(tc.disabled...)
+			if err != nil {
+				t.Fatalf("NewOrderValidator returned error: %v", err)
+			}
+
+			reader := &fakeReader{msgs: []kafka.Message{{Offset: 1, Value: value}}}
+			dlq := &fakeWriter{}
+			saver := &fakeSaver{}
+			consumer := &KafkaConsumer{reader: reader, deadLetter: dlq, saver: saver}
+			consumer.SetOrderValidator(validator)
+
+			if err := consumer.ConsumeAndSave(context.Background()); !errors.Is(err, io.EOF) {
+				t.Fatalf("expected io.EOF after the last message, got: %v", err)
+			}
+			if len(tc.expectedRules) == 0 {
+				if len(saver.saved) != 1 || len(dlq.written) != 0 {
+					t.Errorf("expected the order to be saved, saved %v, dead-letter %d", saver.saved, len(dlq.written))
+				}
+				return
+			}
+
+			if len(saver.saved) != 0 || len(dlq.written) != 1 {
+				t.Fatalf("expected the order to be rejected, saved %v, dead-letter %d", saver.saved, len(dlq.written))
+			}
+			if stage, _ := header(dlq.written[0], HeaderFailureStage); stage != string(StageValidate) {
+				t.Errorf("expected stage %q, got %q", StageValidate, stage)
+			}
+			raw, ok := header(dlq.written[0], HeaderViolations)
+			if !ok {
+				t.Fatalf("expected %s header", HeaderViolations)
+			}
+			var violations []entity.Violation
+			if err := json.Unmarshal([]byte(raw), &violations); err != nil {
+				t.Fatalf("failed to parse violations %q: %v", raw, err)
+			}
+			rules := make([]string, len(violations))
+			for i, v := range violations {
+				rules[i] = v.Rule
+			}
+			if !reflect.DeepEqual(rules, tc.expectedRules) {
+				t.Errorf("expected violated rules %v, got %v", tc.expectedRules, violations)
+			}
+		})
+	}
+
+	if _, err := entity.NewOrderValidator("no_such_rule"); err == nil {
+		t.Error("expected error for unknown rule name")
+	}
+	if _, err := entity.NewOrderValidator(entity.RuleTags); err == nil {
+		t.Error("expected error for disabling validate tags")
+	}
+}
@@ -0,0 +1,60 @@
+package broker
+
+import (
+	"encoding/json"
+	"errors"
+	"strconv"
+
+	"github.com/Asus/L0_DemoServise/internal/entity"
+	"github.com/segmentio/kafka-go"
+)
+
+// RejectStage - стадия обработки, на которой сообщение было отклонено
+type RejectStage string
+
+const (
+	StageParse    RejectStage = "parse"    // не удалось разобрать JSON
+	StageSchema   RejectStage = "schema"   // неизвестная версия или схема сообщения
+	StageValidate RejectStage = "validate" // заказ не прошёл валидацию
+	StagePersist  RejectStage = "persist"  // не удалось сохранить заказ
+	StageConflict RejectStage = "conflict" // заказ с таким UID уже сохранён с другим содержимым
+	// изменение недопустимо в текущем статусе заказа (в том числе переход статуса) или заказа нет в БД
+	StageTransition RejectStage = "transition"
+)
+
+// заголовки, которые добавляются к сообщению в dead-letter топике
+const (
+	HeaderOriginalTopic     = "x-original-topic"
+	HeaderOriginalPartition = "x-original-partition"
+	HeaderOriginalOffset    = "x-original-offset"
+	HeaderFailureStage      = "x-failure-stage"
+	HeaderError             = "x-error"
+	// JSON-массив нарушенных бизнес-правил (entity.Violation), только у заказов, не прошедших валидацию
+	HeaderViolations = "x-violations"
+)
+
+// deadLetterMessage собирает сообщение для dead-letter топика:
+// ключ, тело и исходные заголовки сохраняются как есть, чтобы сообщение можно было переиграть
+func deadLetterMessage(msg kafka.Message, stage RejectStage, cause error) kafka.Message {
+	headers := make([]kafka.Header, 0, len(msg.Headers)+6)
+	headers = append(headers, msg.Headers...)
+	headers = append(headers,
+		kafka.Header{Key: HeaderOriginalTopic, Value: []byte(msg.Topic)},
+		kafka.Header{Key: HeaderOriginalPartition, Value: []byte(strconv.Itoa(msg.Partition))},
+		kafka.Header{Key: HeaderOriginalOffset, Value: []byte(strconv.FormatInt(msg.Offset, 10))},
+		kafka.Header{Key: HeaderFailureStage, Value: []byte(stage)},
+		kafka.Header{Key: HeaderError, Value: []byte(cause.Error())},
+	)
+	var verr *entity.ValidationError
+	if errors.As(cause, &verr) {
+		if violations, err := json.Marshal(verr.Violations); err == nil {
+			headers = append(headers, kafka.Header{Key: HeaderViolations, Value: violations})
+		}
+	}
+
+	return kafka.Message{
+		Key:     msg.Key,
+		Value:   msg.Value,
+		Headers: headers,
+	}
+}
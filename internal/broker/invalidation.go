@@ -0,0 +1,197 @@
+package broker
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/Asus/L0_DemoServise/config"
+	"github.com/Asus/L0_DemoServise/internal/entity"
+	"github.com/Asus/L0_DemoServise/internal/metrics"
+	"github.com/segmentio/kafka-go"
+	"golang.org/x/sync/errgroup"
+)
+
+// инвалидация кэша между репликами: реплика, сохранившая заказ, публикует событие в топик
+// invalidation_topic, а каждая реплика читает все его партиции без consumer group и сбрасывает
+// свою копию заказа. Свои события реплика узнаёт по Origin и пропускает
+
+// CacheInvalidator - кэш, который применяет события других реплик
+type CacheInvalidator interface {
+	ApplyInvalidation(ctx context.Context, ev entity.CacheInvalidation)
+}
+
+type InvalidationPublisher struct {
+	writer    messageWriter
+	replicaID string
+}
+
+// NewInvalidationPublisher создаёт асинхронного отправителя событий: сохранение заказа
+// не ждёт Kafka, ошибки отправки только логируются и попадают в метрики
+func NewInvalidationPublisher(cfg *config.Kafka, replicaID string) *InvalidationPublisher {
+	writer := &kafka.Writer{
+		Addr:                   kafka.TCP(cfg.Brokers...),
+		Topic:                  cfg.InvalidationTopic,
+		Balancer:               &kafka.Hash{}, // события одного заказа попадают в одну партицию по порядку
+		AllowAutoTopicCreation: true,
+		Async:                  true,
+		Completion: func(msgs []kafka.Message, err error) {
+			if err != nil {
+				slog.Warn("failed to publish cache invalidations", "count", len(msgs), "error", err)
+				metrics.CacheInvalidations.WithLabelValues("publish_failed").Add(float64(len(msgs)))
+				return
+			}
+			metrics.CacheInvalidations.WithLabelValues("published").Add(float64(len(msgs)))
+		},
+	}
+	return &InvalidationPublisher{writer: writer, replicaID: replicaID}
+}
+
+// PublishInvalidation отправляет событие об изменении заказа UID остальным репликам
+func (p *InvalidationPublisher) PublishInvalidation(ctx context.Context, UID string, action entity.InvalidationAction) error {
+	value, err := json.Marshal(entity.CacheInvalidation{
+		OrderUID: UID,
+		Action:   action,
+		Origin:   p.replicaID,
+		At:       time.Now(),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to encode cache invalidation: %w", err)
+	}
+	if err := p.writer.WriteMessages(ctx, kafka.Message{Key: []byte(UID), Value: value}); err != nil {
+		return fmt.Errorf("failed to publish cache invalidation: %w", err)
+	}
+	return nil
+}
+
+// Close дожидается отправки накопленных событий
+func (p *InvalidationPublisher) Close() error {
+	return p.writer.Close()
+}
+
+// invalidationRetryDelay - пауза между попытками найти партиции топика инвалидаций
+const invalidationRetryDelay = 5 * time.Second
+
+// partitionReader - то, что нужно консьюмеру инвалидаций от kafka.Reader одной партиции
+type partitionReader interface {
+	FetchMessage(ctx context.Context) (kafka.Message, error)
+	Close() error
+}
+
+type InvalidationConsumer struct {
+	cache      CacheInvalidator
+	replicaID  string
+	newReaders func(ctx context.Context) ([]partitionReader, error) // по reader'у на каждую партицию топика
+
+	mu      sync.Mutex
+	readers []partitionReader // созданные Consume, их закрывает Close
+}
+
+// NewInvalidationConsumer читает события без consumer group: каждой реплике нужны все события,
+// а группа на реплику с её случайным ID оставляла бы на брокерах брошенную группу после каждого перезапуска.
+// Каждая партиция читается с конца: только что запущенная реплика загружает кэш из БД, старые события ей не нужны
+func NewInvalidationConsumer(cfg *config.Kafka, replicaID string, cache CacheInvalidator) *InvalidationConsumer {
+	c := &InvalidationConsumer{cache: cache, replicaID: replicaID}
+	c.newReaders = func(ctx context.Context) ([]partitionReader, error) {
+		partitions, err := topicPartitions(ctx, cfg.Brokers, cfg.InvalidationTopic)
+		if err != nil {
+			return nil, err
+		}
+		readers := make([]partitionReader, 0, len(partitions))
+		for _, partition := range partitions {
+			reader := kafka.NewReader(kafka.ReaderConfig{
+				Brokers:   cfg.Brokers,
+				Topic:     cfg.InvalidationTopic,
+				Partition: partition.ID,
+			})
+			if err := reader.SetOffset(kafka.LastOffset); err != nil {
+				reader.Close()
+				return nil, fmt.Errorf("failed to seek partition %d of %s: %w", partition.ID, cfg.InvalidationTopic, err)
+			}
+			readers = append(readers, reader)
+		}
+		return readers, nil
+	}
+	return c
+}
+
+// topicPartitions - партиции топика по данным первого доступного брокера
+func topicPartitions(ctx context.Context, brokers []string, topic string) ([]kafka.Partition, error) {
+	var errs []error
+	for _, broker := range brokers {
+		conn, err := kafka.DialContext(ctx, "tcp", broker)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		partitions, err := conn.ReadPartitions(topic)
+		conn.Close()
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		return partitions, nil
+	}
+	return nil, fmt.Errorf("failed to read partitions of %s: %w", topic, errors.Join(errs...))
+}
+
+// Consume применяет события других реплик к кэшу, пока не отменён ctx. Партиции читаются параллельно,
+// партиции, добавленные в топик после старта, реплика увидит только после перезапуска.
+// Нечитаемое событие пропускается: кэш от этого лишь дольше отдаёт старую копию
+func (c *InvalidationConsumer) Consume(ctx context.Context) error {
+	// топик создаёт первое опубликованное событие, до этого его партиции прочитать нельзя
+	readers, err := c.newReaders(ctx)
+	for err != nil {
+		slog.Warn("cache invalidation topic is not available yet, will retry", "error", err)
+		if err := sleepCtx(ctx, invalidationRetryDelay); err != nil {
+			return err
+		}
+		readers, err = c.newReaders(ctx)
+	}
+	c.mu.Lock()
+	c.readers = readers
+	c.mu.Unlock()
+
+	group, ctx := errgroup.WithContext(ctx)
+	for _, reader := range readers {
+		group.Go(func() error {
+			for {
+				msg, err := reader.FetchMessage(ctx)
+				if err != nil {
+					return fmt.Errorf("failed to fetch cache invalidation: %w", err)
+				}
+				c.handle(ctx, msg)
+			}
+		})
+	}
+	return group.Wait()
+}
+
+func (c *InvalidationConsumer) handle(ctx context.Context, msg kafka.Message) {
+	var ev entity.CacheInvalidation
+	if err := json.Unmarshal(msg.Value, &ev); err != nil || ev.OrderUID == "" {
+		slog.Warn("failed to parse cache invalidation, skipped", "error", err, "partition", msg.Partition, "offset", msg.Offset)
+		return
+	}
+	if ev.Origin == c.replicaID {
+		metrics.CacheInvalidations.WithLabelValues("own").Inc()
+		return
+	}
+	c.cache.ApplyInvalidation(ctx, ev)
+	metrics.CacheInvalidations.WithLabelValues("applied").Inc()
+}
+
+func (c *InvalidationConsumer) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var errs []error
+	for _, reader := range c.readers {
+		errs = append(errs, reader.Close())
+	}
+	return errors.Join(errs...)
+}
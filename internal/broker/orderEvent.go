@@ -0,0 +1,131 @@
+package broker
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+
+	"github.com/Asus/L0_DemoServise/internal/entity"
+	"github.com/segmentio/kafka-go"
+)
+
+// OrderEventApplier применяет к сохранённому заказу события, кроме его создания
+type OrderEventApplier interface {
+	UpdateOrder(ctx context.Context, UID string, patch entity.OrderPatch) error
+	ChangeDelivery(ctx context.Context, UID string, d entity.Delivery) error
+	ReturnItems(ctx context.Context, UID string, ret entity.ItemsReturn) error
+	CancelOrder(ctx context.Context, UID string, c entity.Cancellation) error
+}
+
+// EnableOrderEvents включает обработку событий изменения, возврата и отмены заказов.
+// Без неё такие события уходят в dead-letter. Вызывается до ConsumeAndSave
+func (c *KafkaConsumer) EnableOrderEvents(events OrderEventApplier) {
+	c.events = events
+}
+
+// decodeEvent разбирает конверт события. Сообщение без type - заказ целиком в старом формате,
+// оно становится событием order.created с самим сообщением в payload
+func decodeEvent(value []byte) (entity.OrderEvent, error) {
+	var ev entity.OrderEvent
+	if err := json.Unmarshal(value, &ev); err != nil {
+		return entity.OrderEvent{}, err
+	}
+	if ev.Type == "" {
+		return entity.OrderEvent{
+			Type:     entity.EventOrderCreated,
+			Version:  entity.CurrentEventVersion,
+			OrderUID: ev.OrderUID,
+			Payload:  value,
+		}, nil
+	}
+	if ev.Version == 0 {
+		ev.Version = entity.CurrentEventVersion
+	}
+	if ev.Version != entity.CurrentEventVersion {
+		return entity.OrderEvent{}, fmt.Errorf("unsupported version %d of %s event", ev.Version, ev.Type)
+	}
+	return ev, nil
+}
+
+// processEvent применяет событие об уже сохранённом заказе
+func (c *KafkaConsumer) processEvent(ctx, workCtx context.Context, msg kafka.Message, ev entity.OrderEvent) error {
+	if c.events == nil {
+		return c.reject(ctx, workCtx, msg, StageValidate, fmt.Errorf("%s events are not accepted", ev.Type))
+	}
+	if ev.OrderUID == "" {
+		return c.reject(ctx, workCtx, msg, StageValidate, fmt.Errorf("%s event without order_uid", ev.Type))
+	}
+
+	apply, stage, err := prepareEvent(c.events, ev)
+	if err != nil {
+		slog.Error("failed to prepare order event", "type", ev.Type, "order_uid", ev.OrderUID, "error", err)
+		return c.reject(ctx, workCtx, msg, stage, err)
+	}
+	return c.applyRetrying(ctx, workCtx, msg, ev.OrderUID, string(ev.Type), apply)
+}
+
+// prepareEvent разбирает и проверяет payload события и возвращает функцию, которая его применит.
+// При ошибке возвращается стадия, с которой сообщение уйдёт в dead-letter
+func prepareEvent(events OrderEventApplier, ev entity.OrderEvent) (func(ctx context.Context) error, RejectStage, error) {
+	switch ev.Type {
+	case entity.EventOrderUpdated:
+		var patch entity.OrderPatch
+		if err := decodePayload(ev.Payload, &patch); err != nil {
+			return nil, StageParse, err
+		}
+		if patch.Empty() {
+			return nil, StageValidate, errors.New("order.updated event changes nothing")
+		}
+		if err := entity.Validate.Struct(patch); err != nil {
+			return nil, StageValidate, err
+		}
+		return func(ctx context.Context) error { return events.UpdateOrder(ctx, ev.OrderUID, patch) }, "", nil
+
+	case entity.EventDeliveryChanged:
+		var d entity.Delivery
+		if err := decodePayload(ev.Payload, &d); err != nil {
+			return nil, StageParse, err
+		}
+		if err := entity.Validate.Struct(d); err != nil {
+			return nil, StageValidate, err
+		}
+		return func(ctx context.Context) error { return events.ChangeDelivery(ctx, ev.OrderUID, d) }, "", nil
+
+	case entity.EventItemsReturned:
+		var ret entity.ItemsReturn
+		if err := decodePayload(ev.Payload, &ret); err != nil {
+			return nil, StageParse, err
+		}
+		if err := entity.Validate.Struct(ret); err != nil {
+			return nil, StageValidate, err
+		}
+		return func(ctx context.Context) error { return events.ReturnItems(ctx, ev.OrderUID, ret) }, "", nil
+
+	case entity.EventOrderCancelled:
+		var cancel entity.Cancellation
+		if err := decodePayload(ev.Payload, &cancel); err != nil {
+			return nil, StageParse, err
+		}
+		return func(ctx context.Context) error { return events.CancelOrder(ctx, ev.OrderUID, cancel) }, "", nil
+
+	default:
+		return nil, StageValidate, fmt.Errorf("unknown event type %q", ev.Type)
+	}
+}
+
+// decodePayload разбирает payload строго: незнакомое поле скорее опечатка, которую нельзя молча пропустить.
+// Пустой payload - пустой объект
+func decodePayload(payload json.RawMessage, v any) error {
+	if len(payload) == 0 {
+		payload = json.RawMessage("{}")
+	}
+	dec := json.NewDecoder(bytes.NewReader(payload))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		return fmt.Errorf("failed to parse event payload: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,65 @@
+package broker
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/Asus/L0_DemoServise/internal/entity"
+)
+
+// retryPolicy описывает повторные попытки с экспоненциальной задержкой
+type retryPolicy struct {
+	maxRetries int           // сколько раз повторяем после первой неудачной попытки
+	backoff    time.Duration // задержка перед первым повтором
+	maxBackoff time.Duration // верхняя граница задержки
+}
+
+// delay возвращает задержку перед повтором с номером attempt (начиная с 1)
+func (p retryPolicy) delay(attempt int) time.Duration {
+	d := p.backoff
+	for i := 1; i < attempt; i++ {
+		d *= 2
+		if p.maxBackoff > 0 && d >= p.maxBackoff {
+			return p.maxBackoff
+		}
+	}
+	return d
+}
+
+// do вызывает fn, пока она не выполнится успешно или не закончатся попытки.
+// Возвращает последнюю ошибку fn, либо ошибку контекста, если он отменён во время ожидания
+func (p retryPolicy) do(ctx context.Context, fn func(attempt int) error) error {
+	err := fn(0)
+	for attempt := 1; err != nil && attempt <= p.maxRetries; attempt++ {
+		if waitErr := sleepCtx(ctx, p.delay(attempt)); waitErr != nil {
+			return waitErr
+		}
+		err = fn(attempt)
+	}
+	return err
+}
+
+func sleepCtx(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return ctx.Err()
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// isRetryable сообщает, имеет ли смысл повторять сохранение.
+// Невалидный заказ, нарушение уникальности и запрещённый переход статуса от повтора не исчезнут
+func isRetryable(err error) bool {
+	if errors.Is(err, entity.ErrInvalidOrder) || errors.Is(err, entity.ErrDuplicate) || errors.Is(err, entity.ErrInvalidTransition) {
+		return false
+	}
+	return !errors.Is(err, context.Canceled)
+}
@@ -0,0 +1,151 @@
+package broker
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Asus/L0_DemoServise/internal/entity"
+	"github.com/segmentio/kafka-go"
+)
+
+// версии JSON заказа. Версия берётся из заголовка x-schema-version или поля schema_version,
+// сообщение без версии - версия 1. Старые версии поднимаются upcaster'ами до текущей
+// и только потом разбираются в entity.Order
+
+// CurrentOrderSchema - версия JSON заказа, которая совпадает с entity.Order
+const CurrentOrderSchema = 1
+
+// oldestOrderSchema - самая старая версия, которую ещё принимает сервис.
+// 0 - формат исходного задания: payment_dt в Unix-секундах, а не строкой RFC 3339
+const oldestOrderSchema = 0
+
+const (
+	HeaderSchemaVersion = "x-schema-version"
+	schemaVersionField  = "schema_version"
+)
+
+// ErrUnsupportedSchema - версия схемы неизвестна сервису, такое сообщение уходит в dead-letter
+var ErrUnsupportedSchema = errors.New("unsupported order schema version")
+
+// Upcaster переводит JSON заказа из своей версии в следующую, меняя документ на месте
+type Upcaster func(doc map[string]any) error
+
+// orderUpcasters - переходы между версиями схемы, ключ - версия, из которой переводит upcaster.
+// Выпуская версию N+1, сюда добавляют upcaster из N, а в testdata/orders/vN+1 - golden-файлы
+var orderUpcasters = map[int]Upcaster{
+	0: upcastOrderV0,
+}
+
+// upcastOrderV0 переводит payment_dt из Unix-секунд (схема 0) в строку RFC 3339 (схема 1)
+func upcastOrderV0(doc map[string]any) error {
+	payment, ok := doc["payment"].(map[string]any)
+	if !ok {
+		return nil // заказ без оплаты отклонит валидация, переводить нечего
+	}
+	raw, ok := payment["payment_dt"]
+	if !ok {
+		return nil
+	}
+	num, isNum := raw.(json.Number)
+	seconds, err := num.Int64()
+	if !isNum || err != nil {
+		return fmt.Errorf("payment_dt must be unix seconds in schema 0, got %v", raw)
+	}
+	payment["payment_dt"] = time.Unix(seconds, 0).UTC().Format(time.RFC3339)
+	return nil
+}
+
+// OrderDecoder разбирает JSON заказа любой поддерживаемой версии схемы
+type OrderDecoder struct {
+	current   int
+	upcasters map[int]Upcaster
+}
+
+func NewOrderDecoder() *OrderDecoder {
+	return &OrderDecoder{current: CurrentOrderSchema, upcasters: orderUpcasters}
+}
+
+// orderDecoder используется консьюмером заказов
+var orderDecoder = NewOrderDecoder()
+
+// Decode разбирает заказ, headerVersion - значение заголовка x-schema-version (пустое - заголовка нет).
+// Незнакомые поля пропускаются: продюсер может добавить поле, не поднимая версию, и такие заказы
+// не должны уходить в dead-letter. Версии новее текущей отклоняются целиком - их поля могли поменять смысл
+func (d *OrderDecoder) Decode(payload []byte, headerVersion string) (entity.Order, error) {
+	var doc map[string]any
+	dec := json.NewDecoder(bytes.NewReader(payload))
+	dec.UseNumber() // числа проходят через upcaster'ы без потери точности
+	if err := dec.Decode(&doc); err != nil {
+		return entity.Order{}, fmt.Errorf("failed to parse order JSON: %w", err)
+	}
+
+	version, err := schemaVersion(doc, headerVersion)
+	if err != nil {
+		return entity.Order{}, err
+	}
+	if version < oldestOrderSchema || version > d.current {
+		return entity.Order{}, fmt.Errorf("%w: %d, the latest is %d", ErrUnsupportedSchema, version, d.current)
+	}
+	delete(doc, schemaVersionField)
+
+	for v := version; v < d.current; v++ {
+		upcast, ok := d.upcasters[v]
+		if !ok {
+			return entity.Order{}, fmt.Errorf("%w: no upcaster from %d to %d", ErrUnsupportedSchema, v, v+1)
+		}
+		if err := upcast(doc); err != nil {
+			return entity.Order{}, fmt.Errorf("failed to upcast order from schema %d to %d: %w", v, v+1, err)
+		}
+	}
+
+	current, err := json.Marshal(doc)
+	if err != nil {
+		return entity.Order{}, fmt.Errorf("failed to encode upcasted order: %w", err)
+	}
+	var order entity.Order
+	if err := json.Unmarshal(current, &order); err != nil {
+		return entity.Order{}, fmt.Errorf("order does not match schema %d: %w", d.current, err)
+	}
+	return order, nil
+}
+
+// schemaVersion находит версию в заголовке или поле. Если указаны оба, они должны совпадать
+func schemaVersion(doc map[string]any, headerVersion string) (int, error) {
+	version := 1 // сообщения до появления версий
+	fromHeader := headerVersion != ""
+	if fromHeader {
+		v, err := strconv.Atoi(strings.TrimSpace(headerVersion))
+		if err != nil {
+			return 0, fmt.Errorf("%w: header %s = %q", ErrUnsupportedSchema, HeaderSchemaVersion, headerVersion)
+		}
+		version = v
+	}
+
+	if raw, ok := doc[schemaVersionField]; ok {
+		num, isNum := raw.(json.Number)
+		v, err := num.Int64()
+		if !isNum || err != nil {
+			return 0, fmt.Errorf("%w: field %s = %v", ErrUnsupportedSchema, schemaVersionField, raw)
+		}
+		if fromHeader && int(v) != version {
+			return 0, fmt.Errorf("%w: header says %d, field says %d", ErrUnsupportedSchema, version, v)
+		}
+		version = int(v)
+	}
+	return version, nil
+}
+
+// schemaHeader возвращает значение заголовка x-schema-version, пустое - заголовка нет
+func schemaHeader(msg kafka.Message) string {
+	for _, h := range msg.Headers {
+		if h.Key == HeaderSchemaVersion {
+			return string(h.Value)
+		}
+	}
+	return ""
+}
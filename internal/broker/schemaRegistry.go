@@ -0,0 +1,130 @@
+package broker
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// типы схем в реестре; схема без типа - Avro
+const (
+	SchemaTypeAvro     = "AVRO"
+	SchemaTypeProtobuf = "PROTOBUF"
+)
+
+const defaultRegistryTimeout = 5 * time.Second
+
+// errRegistryUnavailable - реестр не ответил, ответил ошибкой сервера или таймаутом, запрос стоит повторить
+var errRegistryUnavailable = errors.New("schema registry unavailable")
+
+// errRegistryAccessDenied - реестр не принял учётные данные сервиса (401, 403). Ошибка в настройках,
+// а не в сообщении: консьюмер останавливается, не коммитя offset, а не отправляет в dead-letter всё подряд
+var errRegistryAccessDenied = errors.New("schema registry access denied")
+
+// RegisteredSchema - схема из реестра
+type RegisteredSchema struct {
+	ID     int
+	Type   string
+	Schema string
+}
+
+// SchemaRegistry - клиент реестра схем с API Confluent Schema Registry. Схема с данным ID
+// никогда не меняется, поэтому прочитанные схемы кэшируются без срока
+type SchemaRegistry struct {
+	baseURL  string
+	username string
+	password string
+	client   *http.Client
+
+	mu      sync.Mutex
+	schemas map[int]RegisteredSchema
+}
+
+// NewSchemaRegistry создаёт клиент реестра по адресу baseURL, пустой username - без авторизации
+func NewSchemaRegistry(baseURL, username, password string, timeout time.Duration) *SchemaRegistry {
+	if timeout <= 0 {
+		timeout = defaultRegistryTimeout
+	}
+	return &SchemaRegistry{
+		baseURL:  strings.TrimRight(baseURL, "/"),
+		username: username,
+		password: password,
+		client:   &http.Client{Timeout: timeout},
+		schemas:  make(map[int]RegisteredSchema),
+	}
+}
+
+// Schema возвращает схему по ID. Схемы, которой нет в реестре, - ErrUnsupportedSchema,
+// недоступный реестр - errRegistryUnavailable, отказ в доступе - errRegistryAccessDenied
+func (r *SchemaRegistry) Schema(ctx context.Context, id int) (RegisteredSchema, error) {
+	r.mu.Lock()
+	schema, ok := r.schemas[id]
+	r.mu.Unlock()
+	if ok {
+		return schema, nil
+	}
+
+	schema, err := r.fetch(ctx, id)
+	if err != nil {
+		return RegisteredSchema{}, err
+	}
+
+	r.mu.Lock()
+	r.schemas[id] = schema
+	r.mu.Unlock()
+	return schema, nil
+}
+
+func (r *SchemaRegistry) fetch(ctx context.Context, id int) (RegisteredSchema, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, r.baseURL+"/schemas/ids/"+strconv.Itoa(id), nil)
+	if err != nil {
+		return RegisteredSchema{}, fmt.Errorf("failed to build schema registry request: %w", err)
+	}
+	req.Header.Set("Accept", "application/vnd.schemaregistry.v1+json")
+	if r.username != "" {
+		req.SetBasicAuth(r.username, r.password)
+	}
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return RegisteredSchema{}, fmt.Errorf("%w: %w", errRegistryUnavailable, err)
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return RegisteredSchema{}, fmt.Errorf("%w: schema id %d is not registered", ErrUnsupportedSchema, id)
+	case resp.StatusCode >= http.StatusInternalServerError || resp.StatusCode == http.StatusTooManyRequests ||
+		resp.StatusCode == http.StatusRequestTimeout:
+		return RegisteredSchema{}, fmt.Errorf("%w: status %d for schema id %d", errRegistryUnavailable, resp.StatusCode, id)
+	case resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden:
+		return RegisteredSchema{}, fmt.Errorf("%w: status %d for schema id %d", errRegistryAccessDenied, resp.StatusCode, id)
+	case resp.StatusCode != http.StatusOK:
+		// остальные 4xx относятся к запросу этой схемы, схема сообщения так и останется неизвестной
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return RegisteredSchema{}, fmt.Errorf("%w: registry returned status %d for schema id %d: %s", ErrUnsupportedSchema, resp.StatusCode, id, body)
+	}
+
+	var body struct {
+		Schema     string            `json:"schema"`
+		SchemaType string            `json:"schemaType"`
+		References []json.RawMessage `json:"references"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return RegisteredSchema{}, fmt.Errorf("failed to decode schema id %d: %w", id, err)
+	}
+	if len(body.References) > 0 {
+		return RegisteredSchema{}, fmt.Errorf("%w: schema id %d has references, they are not supported", ErrUnsupportedSchema, id)
+	}
+	if body.SchemaType == "" {
+		body.SchemaType = SchemaTypeAvro
+	}
+	return RegisteredSchema{ID: id, Type: body.SchemaType, Schema: body.Schema}, nil
+}
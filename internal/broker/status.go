@@ -0,0 +1,58 @@
+package broker
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+
+	"github.com/Asus/L0_DemoServise/config"
+	"github.com/Asus/L0_DemoServise/internal/entity"
+	"github.com/segmentio/kafka-go"
+)
+
+type StatusChanger interface {
+	ChangeStatus(ctx context.Context, ev entity.StatusEvent) (entity.StatusChange, error)
+}
+
+// StatusConsumer читает события смены статуса заказов из status_topic.
+// Гарантии те же, что у консьюмера заказов: at-least-once, повторы и dead-letter топик
+type StatusConsumer struct {
+	*KafkaConsumer
+	changer StatusChanger
+}
+
+// NewStatusConsumer создаёт консьюмер в отдельной consumer group, чтобы партиции топика статусов
+// не делились с консьюмерами заказов
+func NewStatusConsumer(cfg *config.Kafka, changer StatusChanger) *StatusConsumer {
+	return &StatusConsumer{
+		KafkaConsumer: newConsumer(cfg, cfg.StatusTopic, cfg.GroupID+"-status"),
+		changer:       changer,
+	}
+}
+
+// Consume применяет события смены статуса, пока не отменён ctx
+func (c *StatusConsumer) Consume(ctx context.Context) error {
+	return c.consume(ctx, c.processStatus)
+}
+
+func (c *StatusConsumer) processStatus(ctx, workCtx context.Context, msg kafka.Message) error {
+	value, ok, err := c.toJSON(ctx, workCtx, msg)
+	if !ok {
+		return err
+	}
+	var ev entity.StatusEvent
+	if err := json.Unmarshal(value, &ev); err != nil {
+		slog.Error("failed to parse status event JSON", "error", err, "message", string(msg.Value))
+		return c.reject(ctx, workCtx, msg, StageParse, err)
+	}
+	if err := entity.Validate.Struct(ev); err != nil {
+		slog.Error("failed to validate status event", "error", err, "order_uid", ev.OrderUID)
+		return c.reject(ctx, workCtx, msg, StageValidate, err)
+	}
+
+	apply := func(ctx context.Context) error {
+		_, err := c.changer.ChangeStatus(ctx, ev)
+		return err
+	}
+	return c.applyRetrying(ctx, workCtx, msg, ev.OrderUID, "status_changed", apply)
+}
@@ -0,0 +1,31 @@
+package entity
+
+import "time"
+
+// CacheEntry - заказ в кэше и время последнего обращения к нему
+type CacheEntry struct {
+	OrderUID   string    `json:"order_uid"`
+	LastAccess time.Time `json:"last_access"`
+	SizeBytes  int64     `json:"size_bytes,omitempty"` // оценка размера, только в режиме бюджета памяти
+}
+
+// CacheStats - счётчики кэша с момента запуска сервиса
+type CacheStats struct {
+	Size     int `json:"size"`
+	Capacity int `json:"capacity"`
+	Shards   int `json:"shards"` // на сколько частей со своими блокировками разбит кэш
+	// в режиме бюджета памяти: оценка занятой памяти и бюджет, иначе 0
+	Bytes     int64  `json:"bytes"`
+	MaxBytes  int64  `json:"max_bytes"`
+	Hits      uint64 `json:"hits"`
+	Misses    uint64 `json:"misses"`
+	Evictions uint64 `json:"evictions"` // вытеснения из-за нехватки места
+	// запросы несуществующих UID, на которые ответили без похода в БД
+	NegativeHits uint64 `json:"negative_hits"`
+	// фильтр Блума: сколько запросов он отсёк, сколько раз ошибся (UID не нашёлся в БД),
+	// ожидаемая доля ложных срабатываний при текущем заполнении и занятая память
+	BloomRejects        uint64  `json:"bloom_rejects"`
+	BloomFalsePositives uint64  `json:"bloom_false_positives"`
+	BloomFPRate         float64 `json:"bloom_fp_rate"`
+	BloomBytes          int     `json:"bloom_bytes"`
+}
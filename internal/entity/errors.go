@@ -0,0 +1,14 @@
+package entity
+
+import "errors"
+
+// ошибки предметной области: storage и service оборачивают в них свои ошибки (fmt.Errorf("...: %w", ...)),
+// а HTTP-сервер и консьюмер проверяют их через errors.Is, не зная, откуда они пришли
+var (
+	ErrNotFound     = errors.New("order not found")
+	ErrInvalidOrder = errors.New("invalid order")
+	ErrDuplicate    = errors.New("duplicate order")
+	ErrUnavailable  = errors.New("storage unavailable")
+	// статус заказа нельзя сменить: переход запрещён или заказ успели перевести в другой статус
+	ErrInvalidTransition = errors.New("invalid order status transition")
+)
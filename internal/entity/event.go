@@ -0,0 +1,59 @@
+package entity
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// EventType - тип события о заказе в топике заказов
+type EventType string
+
+const (
+	EventOrderCreated    EventType = "order.created"          // payload - заказ целиком
+	EventOrderUpdated    EventType = "order.updated"          // payload - OrderPatch
+	EventDeliveryChanged EventType = "order.delivery_changed" // payload - Delivery
+	EventItemsReturned   EventType = "order.items_returned"   // payload - ItemsReturn
+	EventOrderCancelled  EventType = "order.cancelled"        // payload - Cancellation
+)
+
+// CurrentEventVersion - версия формата событий, которую понимает сервис
+const CurrentEventVersion = 1
+
+// OrderEvent - конверт события о заказе. Сообщение без type - заказ целиком в старом формате,
+// оно читается как order.created
+type OrderEvent struct {
+	Type     EventType       `json:"type"`
+	Version  int             `json:"version"`
+	OrderUID string          `json:"order_uid"`
+	Payload  json.RawMessage `json:"payload"`
+}
+
+// OrderPatch - частичное изменение заказа: меняются только переданные поля
+type OrderPatch struct {
+	TrackNumber       *string `json:"track_number" validate:"omitnil,min=1"`
+	Entry             *string `json:"entry" validate:"omitnil,min=1"`
+	Locale            *string `json:"locale" validate:"omitnil,len=2"`
+	InternalSignature *string `json:"internal_signature"`
+	CustomerID        *string `json:"customer_id" validate:"omitnil,min=1"`
+	DeliveryService   *string `json:"delivery_service" validate:"omitnil,min=1"`
+	ShardKey          *string `json:"shardkey"`
+	SmID              *int    `json:"sm_id"`
+	OofShard          *string `json:"oof_shard"`
+}
+
+// Empty сообщает, что патч ничего не меняет
+func (p OrderPatch) Empty() bool {
+	return p == OrderPatch{}
+}
+
+// ItemsReturn - возврат части товаров заказа
+type ItemsReturn struct {
+	Rids       []string  `json:"rids" validate:"required,min=1,dive,required"`
+	ReturnedAt time.Time `json:"returned_at" validate:"required"` // время возврата у источника
+	Reason     string    `json:"reason,omitempty"`
+}
+
+// Cancellation - отмена заказа
+type Cancellation struct {
+	Reason string `json:"reason,omitempty"`
+}
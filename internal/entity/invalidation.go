@@ -0,0 +1,19 @@
+package entity
+
+import "time"
+
+// InvalidationAction - что произошло с заказом на реплике, опубликовавшей событие
+type InvalidationAction string
+
+const (
+	InvalidationSaved   InvalidationAction = "saved"   // заказ добавлен или изменён
+	InvalidationDeleted InvalidationAction = "deleted" // заказ удалён
+)
+
+// CacheInvalidation - событие для остальных реплик: их копия заказа в кэше устарела
+type CacheInvalidation struct {
+	OrderUID string             `json:"order_uid"`
+	Action   InvalidationAction `json:"action"`
+	Origin   string             `json:"origin"` // ID реплики, которая опубликовала событие
+	At       time.Time          `json:"at"`
+}
@@ -29,6 +29,8 @@ type Order struct {
 	SmID             int       `json:"sm_id" db:"sm_id"`
 	DateCreated     time.Time `json:"date_created" db:"date_created" validate:"required"`
 	OofShard         string    `json:"oof_shard" db:"oof_shard"`
+	// текущий статус; меняется только через смену статуса (service.StatusService), в сообщении заказа игнорируется
+	Status OrderStatus `json:"status,omitempty" db:"status"`
 
 	// Вложенные объекты (хранятся в отдельных таблицах payment и delivery)
 	Delivery Delivery `json:"delivery" db:"-" validate:"required"`
@@ -79,6 +81,8 @@ type Item struct {
 	NmID        int    `json:"nm_id" db:"nm_id"`
 	Brand       string `json:"brand" db:"brand"`
 	Status      int    `json:"status" db:"status"`
+	// время возврата товара (событие order.items_returned), nil - товар не возвращали
+	ReturnedAt *time.Time `json:"returned_at,omitempty" db:"returned_at"`
 }
 
 
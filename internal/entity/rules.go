@@ -0,0 +1,203 @@
+package entity
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/go-playground/validator/v10"
+)
+
+// RuleTags - имя правила в нарушениях тегов validate на полях заказа. Теги проверяются всегда,
+// выключить их через disabled_order_rules нельзя
+const RuleTags = "tags"
+
+// бизнес-правила заказа, которые не выразить тегами validate. Каждое правило можно выключить
+// по имени (disabled_order_rules в конфиге)
+const (
+	RuleAmountTotal        = "amount_total"        // amount = goods_total + delivery_cost + custom_fee
+	RuleItemTotalPrice     = "item_total_price"    // total_price товара = price со скидкой sale%
+	RuleItemTrackNumber    = "item_track_number"   // track_number товара совпадает с заказом
+	RulePaymentTransaction = "payment_transaction" // transaction оплаты совпадает с order_uid
+	RuleCurrency           = "currency"            // валюта - код ISO 4217
+)
+
+// Violation - нарушенное правило и поле заказа, к которому оно относится
+type Violation struct {
+	Rule    string `json:"rule"`
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// ValidationError - все нарушения, найденные в заказе. errors.Is(err, ErrInvalidOrder) для неё true
+type ValidationError struct {
+	Violations []Violation
+}
+
+func (e *ValidationError) Error() string {
+	parts := make([]string, len(e.Violations))
+	for i, v := range e.Violations {
+		parts[i] = fmt.Sprintf("%s: %s (%s)", v.Field, v.Message, v.Rule)
+	}
+	return fmt.Sprintf("%s: %s", ErrInvalidOrder, strings.Join(parts, "; "))
+}
+
+func (e *ValidationError) Unwrap() error { return ErrInvalidOrder }
+
+// OrderRule - именованное правило, возвращает нарушения или nil
+type OrderRule struct {
+	Name  string
+	Check func(o Order) []Violation
+}
+
+// OrderRules - все бизнес-правила в порядке проверки
+var OrderRules = []OrderRule{
+	{Name: RuleAmountTotal, Check: checkAmountTotal},
+	{Name: RuleItemTotalPrice, Check: checkItemTotalPrice},
+	{Name: RuleItemTrackNumber, Check: checkItemTrackNumber},
+	{Name: RulePaymentTransaction, Check: checkPaymentTransaction},
+	{Name: RuleCurrency, Check: checkCurrency},
+}
+
+// OrderValidator проверяет заказ тегами validate и включёнными бизнес-правилами
+type OrderValidator struct {
+	rules []OrderRule
+}
+
+// NewOrderValidator создаёт валидатор со всеми правилами, кроме disabled. Неизвестное имя - ошибка,
+// чтобы опечатка в конфиге не оставила правило включённым
+func NewOrderValidator(disabled ...string) (*OrderValidator, error) {
+	off := make(map[string]bool, len(disabled))
+	for _, name := range disabled {
+		if name == RuleTags {
+			return nil, fmt.Errorf("order rule %q cannot be disabled", name)
+		}
+		if !knownRule(name) {
+			return nil, fmt.Errorf("unknown order rule %q", name)
+		}
+		off[name] = true
+	}
+
+	v := &OrderValidator{}
+	for _, rule := range OrderRules {
+		if !off[rule.Name] {
+			v.rules = append(v.rules, rule)
+		}
+	}
+	return v, nil
+}
+
+// DefaultOrderValidator проверяет все правила
+var DefaultOrderValidator, _ = NewOrderValidator()
+
+func knownRule(name string) bool {
+	for _, rule := range OrderRules {
+		if rule.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Validate возвращает *ValidationError со всеми нарушениями или nil. Бизнес-правила проверяются,
+// только если заказ прошёл теги: без товаров или оплаты их результат бессмыслен
+func (v *OrderValidator) Validate(o Order) error {
+	if err := Validate.Struct(o); err != nil {
+		var tagErrs validator.ValidationErrors
+		if !errors.As(err, &tagErrs) {
+			return fmt.Errorf("%w: %w", ErrInvalidOrder, err)
+		}
+		violations := make([]Violation, len(tagErrs))
+		for i, fe := range tagErrs {
+			violations[i] = Violation{
+				Rule:    RuleTags,
+				Field:   fe.Namespace(),
+				Message: fmt.Sprintf("failed on the '%s' tag", fe.Tag()),
+			}
+		}
+		return &ValidationError{Violations: violations}
+	}
+
+	var violations []Violation
+	for _, rule := range v.rules {
+		violations = append(violations, rule.Check(o)...)
+	}
+	if len(violations) > 0 {
+		return &ValidationError{Violations: violations}
+	}
+	return nil
+}
+
+func checkAmountTotal(o Order) []Violation {
+	p := o.Payment
+	if total := p.GoodsTotal + p.DeliveryCost + p.CustomFee; p.Amount != total {
+		return []Violation{{
+			Rule:    RuleAmountTotal,
+			Field:   "Order.Payment.Amount",
+			Message: fmt.Sprintf("amount %d must equal goods_total + delivery_cost + custom_fee = %d", p.Amount, total),
+		}}
+	}
+	return nil
+}
+
+// checkItemTotalPrice допускает округление цены со скидкой в любую сторону до целого
+func checkItemTotalPrice(o Order) []Violation {
+	var violations []Violation
+	for i, it := range o.Items {
+		field := fmt.Sprintf("Order.Items[%d].TotalPrice", i)
+		if it.Sale < 0 || it.Sale > 100 {
+			violations = append(violations, Violation{
+				Rule:    RuleItemTotalPrice,
+				Field:   fmt.Sprintf("Order.Items[%d].Sale", i),
+				Message: fmt.Sprintf("sale %d%% must be between 0 and 100", it.Sale),
+			})
+			continue
+		}
+		discounted := it.Price * (100 - it.Sale) // цена со скидкой, умноженная на 100
+		if diff := it.TotalPrice*100 - discounted; diff <= -100 || diff >= 100 {
+			violations = append(violations, Violation{
+				Rule:  RuleItemTotalPrice,
+				Field: field,
+				Message: fmt.Sprintf("total_price %d does not match price %d with sale %d%% (%d.%02d)",
+					it.TotalPrice, it.Price, it.Sale, discounted/100, discounted%100),
+			})
+		}
+	}
+	return violations
+}
+
+func checkItemTrackNumber(o Order) []Violation {
+	var violations []Violation
+	for i, it := range o.Items {
+		if it.TrackNumber != o.TrackNumber {
+			violations = append(violations, Violation{
+				Rule:    RuleItemTrackNumber,
+				Field:   fmt.Sprintf("Order.Items[%d].TrackNumber", i),
+				Message: fmt.Sprintf("track_number %q does not match order track_number %q", it.TrackNumber, o.TrackNumber),
+			})
+		}
+	}
+	return violations
+}
+
+func checkPaymentTransaction(o Order) []Violation {
+	if o.Payment.OrderUID != o.OrderUID {
+		return []Violation{{
+			Rule:    RulePaymentTransaction,
+			Field:   "Order.Payment.OrderUID",
+			Message: fmt.Sprintf("transaction %q does not match order_uid %q", o.Payment.OrderUID, o.OrderUID),
+		}}
+	}
+	return nil
+}
+
+func checkCurrency(o Order) []Violation {
+	if err := Validate.Var(o.Payment.Currency, "iso4217"); err != nil {
+		return []Violation{{
+			Rule:    RuleCurrency,
+			Field:   "Order.Payment.Currency",
+			Message: fmt.Sprintf("currency %q is not an ISO 4217 code", o.Payment.Currency),
+		}}
+	}
+	return nil
+}
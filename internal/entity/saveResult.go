@@ -0,0 +1,26 @@
+package entity
+
+// SaveResult - чем закончилось сохранение заказа
+type SaveResult int
+
+const (
+	SaveInserted  SaveResult = iota + 1 // заказ сохранён впервые
+	SaveDuplicate                       // точно такой же заказ уже есть, ничего не изменилось
+	SaveUpdated                         // заказ с таким UID был, но отличался - перезаписан
+	SaveConflict                        // заказ с таким UID был, но отличался - новая версия отклонена
+)
+
+func (r SaveResult) String() string {
+	switch r {
+	case SaveInserted:
+		return "inserted"
+	case SaveDuplicate:
+		return "duplicate"
+	case SaveUpdated:
+		return "updated"
+	case SaveConflict:
+		return "conflict"
+	default:
+		return "unknown"
+	}
+}
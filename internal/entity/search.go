@@ -0,0 +1,63 @@
+package entity
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// OrderFilter - условия поиска заказов, пустые (нулевые) поля не учитываются
+type OrderFilter struct {
+	CustomerID      string
+	TrackNumber     string
+	DeliveryService string
+	Locale          string
+	CreatedFrom     time.Time // date_created >= CreatedFrom
+	CreatedTo       time.Time // date_created < CreatedTo
+
+	// условия на товары: в заказе должен быть товар, подходящий под оба условия
+	NmID  int
+	Brand string
+}
+
+// OrderSearch - запрос страницы заказов. Заказы упорядочены по date_created (при равенстве - по order_uid)
+type OrderSearch struct {
+	Filter    OrderFilter
+	Limit     int
+	Ascending bool         // по умолчанию сначала новые заказы
+	After     *OrderCursor // nil - первая страница
+}
+
+// OrderPage - страница результатов поиска
+type OrderPage struct {
+	Orders     []Order `json:"orders"`
+	NextCursor string  `json:"next_cursor,omitempty"` // пустой, если страница последняя
+}
+
+// OrderCursor - позиция последнего заказа на странице (keyset-пагинация)
+type OrderCursor struct {
+	DateCreated time.Time `json:"date_created"`
+	OrderUID    string    `json:"order_uid"`
+}
+
+// Encode превращает курсор в непрозрачную строку для клиента
+func (c OrderCursor) Encode() string {
+	data, _ := json.Marshal(c) // time.Time и string всегда сериализуются
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func DecodeOrderCursor(s string) (OrderCursor, error) {
+	var c OrderCursor
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return c, fmt.Errorf("invalid cursor: %w", err)
+	}
+	if err := json.Unmarshal(data, &c); err != nil {
+		return c, fmt.Errorf("invalid cursor: %w", err)
+	}
+	if c.OrderUID == "" {
+		return c, fmt.Errorf("invalid cursor: order_uid is empty")
+	}
+	return c, nil
+}
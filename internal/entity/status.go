@@ -0,0 +1,33 @@
+package entity
+
+import "time"
+
+// OrderStatus - этап жизненного цикла заказа, допустимые переходы проверяет service
+type OrderStatus string
+
+const (
+	StatusCreated   OrderStatus = "created"
+	StatusPaid      OrderStatus = "paid"
+	StatusAssembled OrderStatus = "assembled"
+	StatusShipped   OrderStatus = "shipped"
+	StatusDelivered OrderStatus = "delivered"
+	StatusCancelled OrderStatus = "cancelled"
+	StatusReturned  OrderStatus = "returned"
+)
+
+// StatusEvent - запрос на смену статуса заказа, приходит из Kafka-топика статусов
+type StatusEvent struct {
+	OrderUID  string      `json:"order_uid" validate:"required"`
+	Status    OrderStatus `json:"status" validate:"required"`
+	ChangedAt time.Time   `json:"changed_at"` // время смены у источника, пустое - время обработки
+	Reason    string      `json:"reason,omitempty"`
+}
+
+// StatusChange - запись истории статусов заказа
+type StatusChange struct {
+	OrderUID  string      `json:"order_uid"`
+	From      OrderStatus `json:"from,omitempty"` // пустой у первой записи, когда заказ создан
+	To        OrderStatus `json:"to"`
+	ChangedAt time.Time   `json:"changed_at"`
+	Reason    string      `json:"reason,omitempty"`
+}
@@ -0,0 +1,52 @@
+// пакет logger добавляет в записи slog данные из контекста запроса (request_id),
+// чтобы строки HTTP-сервера, кэша и хранилища одного запроса можно было связать между собой
+package logger
+
+import (
+	"context"
+	"io"
+	"log/slog"
+)
+
+type ctxKey struct{}
+
+// WithRequestID кладёт ID запроса в контекст
+func WithRequestID(ctx context.Context, requestID string) context.Context {
+	return context.WithValue(ctx, ctxKey{}, requestID)
+}
+
+// RequestID достаёт ID запроса из контекста, пустая строка - если его там нет
+func RequestID(ctx context.Context) string {
+	requestID, _ := ctx.Value(ctxKey{}).(string)
+	return requestID
+}
+
+// ContextHandler дописывает request_id из контекста к каждой записи,
+// сделанной через slog.*Context (slog.InfoContext и т.п.)
+type ContextHandler struct {
+	slog.Handler
+}
+
+func NewContextHandler(h slog.Handler) *ContextHandler {
+	return &ContextHandler{Handler: h}
+}
+
+func (h *ContextHandler) Handle(ctx context.Context, r slog.Record) error {
+	if requestID := RequestID(ctx); requestID != "" {
+		r.AddAttrs(slog.String("request_id", requestID))
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h *ContextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &ContextHandler{Handler: h.Handler.WithAttrs(attrs)}
+}
+
+func (h *ContextHandler) WithGroup(name string) slog.Handler {
+	return &ContextHandler{Handler: h.Handler.WithGroup(name)}
+}
+
+// Setup делает логгер с ContextHandler логгером по умолчанию
+func Setup(w io.Writer) {
+	slog.SetDefault(slog.New(NewContextHandler(slog.NewTextHandler(w, nil))))
+}
@@ -0,0 +1,25 @@
+package logger
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+func TestContextHandlerAddsRequestID(t *testing.T) {
+	var buf bytes.Buffer
+	log := slog.New(NewContextHandler(slog.NewTextHandler(&buf, nil))).With("component", "test")
+
+	log.InfoContext(WithRequestID(context.Background(), "req-42"), "order not found")
+	if !strings.Contains(buf.String(), "request_id=req-42") || !strings.Contains(buf.String(), "component=test") {
+		t.Errorf("expected request_id and logger attrs in the record, got: %s", buf.String())
+	}
+
+	buf.Reset()
+	log.InfoContext(context.Background(), "no request")
+	if strings.Contains(buf.String(), "request_id") {
+		t.Errorf("request_id must not be added without one in context, got: %s", buf.String())
+	}
+}
@@ -0,0 +1,138 @@
+// пакет metrics описывает метрики Prometheus, которые сервис отдаёт на /metrics
+package metrics
+
+import (
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Asus/L0_DemoServise/internal/entity"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const namespace = "order_service"
+
+var (
+	// ConsumerProcessed - обработанные сообщения Kafka: заказы по результату сохранения (entity.SaveResult),
+	// события об изменении заказа - по типу события, смена статуса из топика статусов - status_changed
+	ConsumerProcessed = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "consumer",
+		Name:      "messages_processed_total",
+		Help:      "Kafka messages applied to storage, by result.",
+	}, []string{"result"})
+
+	// ConsumerRejected - сообщения, отправленные в dead-letter топик (или отброшенные), по этапу
+	ConsumerRejected = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "consumer",
+		Name:      "messages_rejected_total",
+		Help:      "Kafka messages rejected by the consumer, by failure stage.",
+	}, []string{"stage"})
+
+	// ConsumerLag - сколько сообщений партиции ещё не прочитано, считается по последнему прочитанному
+	ConsumerLag = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "consumer",
+		Name:      "lag_messages",
+		Help:      "Messages left in the partition after the last fetched one.",
+	}, []string{"topic", "partition"})
+
+	// CacheInvalidations - события инвалидации кэша между репликами: published и publish_failed
+	// для отправленных этой репликой, applied и own для полученных
+	CacheInvalidations = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "cache",
+		Name:      "invalidations_total",
+		Help:      "Cache invalidation events exchanged between replicas, by event.",
+	}, []string{"event"})
+
+	storageDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "storage",
+		Name:      "query_duration_seconds",
+		Help:      "Storage call latency, by operation and status.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"operation", "status"})
+
+	httpRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "http",
+		Name:      "requests_total",
+		Help:      "HTTP requests, by route pattern and status code.",
+	}, []string{"route", "code"})
+
+	httpDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "http",
+		Name:      "request_duration_seconds",
+		Help:      "HTTP request latency, by route pattern.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"route"})
+)
+
+// ObserveStorage записывает длительность вызова хранилища, начатого в start.
+// Удобно вызывать через defer с именованной ошибкой
+func ObserveStorage(operation string, start time.Time, err error) {
+	status := "ok"
+	if err != nil {
+		status = "error"
+	}
+	storageDuration.WithLabelValues(operation, status).Observe(time.Since(start).Seconds())
+}
+
+// ObserveHTTP записывает обработанный HTTP-запрос, route - шаблон маршрута из ServeMux
+func ObserveHTTP(route string, code int, duration time.Duration) {
+	if route == "" {
+		route = "unmatched" // чтобы произвольные пути не раздували число серий
+	}
+	httpRequests.WithLabelValues(route, strconv.Itoa(code)).Inc()
+	httpDuration.WithLabelValues(route).Observe(duration.Seconds())
+}
+
+var (
+	cacheStats      atomic.Pointer[func() entity.CacheStats] // источник статистики кэша, задаётся RegisterCache
+	cacheRegistered sync.Once
+)
+
+// RegisterCache отдаёт статистику кэша на /metrics, stats читается при каждом сборе метрик.
+// Метрики регистрируются один раз, повторный вызов только подменяет источник статистики
+func RegisterCache(stats func() entity.CacheStats) {
+	cacheStats.Store(&stats)
+	cacheRegistered.Do(registerCache)
+}
+
+func registerCache() {
+	stats := func() entity.CacheStats { return (*cacheStats.Load())() }
+	cacheOpts := func(name, help string) prometheus.GaugeOpts {
+		return prometheus.GaugeOpts{Namespace: namespace, Subsystem: "cache", Name: name, Help: help}
+	}
+	prometheus.MustRegister(
+		prometheus.NewGaugeFunc(cacheOpts("size", "Orders currently in the cache."),
+			func() float64 { return float64(stats().Size) }),
+		prometheus.NewGaugeFunc(cacheOpts("capacity", "Maximum number of orders in the cache."),
+			func() float64 { return float64(stats().Capacity) }),
+		prometheus.NewGaugeFunc(cacheOpts("bytes", "Estimated memory used by cached orders (byte-budget mode only)."),
+			func() float64 { return float64(stats().Bytes) }),
+		prometheus.NewGaugeFunc(cacheOpts("max_bytes", "Cache memory budget, 0 when the cache is limited by order count."),
+			func() float64 { return float64(stats().MaxBytes) }),
+		prometheus.NewCounterFunc(prometheus.CounterOpts(cacheOpts("hits_total", "Cache lookups served from memory.")),
+			func() float64 { return float64(stats().Hits) }),
+		prometheus.NewCounterFunc(prometheus.CounterOpts(cacheOpts("misses_total", "Cache lookups that went to storage.")),
+			func() float64 { return float64(stats().Misses) }),
+		prometheus.NewCounterFunc(prometheus.CounterOpts(cacheOpts("evictions_total", "Orders evicted to make room for new ones.")),
+			func() float64 { return float64(stats().Evictions) }),
+		prometheus.NewCounterFunc(prometheus.CounterOpts(cacheOpts("negative_hits_total", "Lookups of unknown UIDs answered without storage.")),
+			func() float64 { return float64(stats().NegativeHits) }),
+		prometheus.NewCounterFunc(prometheus.CounterOpts(cacheOpts("bloom_rejects_total", "Lookups rejected by the Bloom filter without storage.")),
+			func() float64 { return float64(stats().BloomRejects) }),
+		prometheus.NewCounterFunc(prometheus.CounterOpts(cacheOpts("bloom_false_positives_total", "Lookups passed by the Bloom filter but not found in storage.")),
+			func() float64 { return float64(stats().BloomFalsePositives) }),
+		prometheus.NewGaugeFunc(cacheOpts("bloom_false_positive_rate", "Expected Bloom filter false-positive rate at its current fill."),
+			func() float64 { return stats().BloomFPRate }),
+		prometheus.NewGaugeFunc(cacheOpts("bloom_memory_bytes", "Memory used by the Bloom filter bit arrays."),
+			func() float64 { return float64(stats().BloomBytes) }),
+	)
+}
@@ -0,0 +1,28 @@
+package metrics
+
+import (
+	"testing"
+
+	"github.com/Asus/L0_DemoServise/internal/entity"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestRegisterCacheTwice(t *testing.T) {
+	RegisterCache(func() entity.CacheStats { return entity.CacheStats{Size: 1} })
+	// кэш пересобирается (например, при переключении бэкенда): повторная регистрация не должна паниковать
+	RegisterCache(func() entity.CacheStats { return entity.CacheStats{Size: 2} })
+
+	families, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		t.Fatalf("failed to gather metrics: %v", err)
+	}
+	for _, family := range families {
+		if family.GetName() == "order_service_cache_size" {
+			if got := family.GetMetric()[0].GetGauge().GetValue(); got != 2 {
+				t.Errorf("expected cache size from the latest stats source 2, got %v", got)
+			}
+			return
+		}
+	}
+	t.Error("cache size metric is not registered")
+}
@@ -0,0 +1,94 @@
+package server
+
+import (
+	"context"
+	"crypto/subtle"
+	"log/slog"
+	"net/http"
+
+	"github.com/Asus/L0_DemoServise/internal/entity"
+)
+
+// CacheAdmin - ручное управление кэшем заказов
+type CacheAdmin interface {
+	Entries(ctx context.Context) []entity.CacheEntry
+	Evict(ctx context.Context, UID string) bool
+	Flush(ctx context.Context) int
+	Stats() entity.CacheStats
+	LoadCache(ctx context.Context) error
+}
+
+// EnableCacheAdmin регистрирует эндпоинты /admin/cache, доступные только с заголовком
+// "Authorization: Bearer <token>". Вызывается до Start
+func (s *Server) EnableCacheAdmin(admin CacheAdmin, token string) {
+	auth := func(h http.HandlerFunc) http.HandlerFunc { return adminOnly(token, h) }
+
+	s.router.HandleFunc("GET /admin/cache", auth(s.handleCacheEntries(admin)))
+	s.router.HandleFunc("GET /admin/cache/stats", auth(s.handleCacheStats(admin)))
+	s.router.HandleFunc("DELETE /admin/cache/{UID}", auth(s.handleCacheEvict(admin)))
+	s.router.HandleFunc("DELETE /admin/cache", auth(s.handleCacheFlush(admin)))
+	s.router.HandleFunc("POST /admin/cache/reload", auth(s.handleCacheReload(admin)))
+}
+
+// adminOnly пропускает запрос дальше, только если в нём правильный токен
+func adminOnly(token string, next http.HandlerFunc) http.HandlerFunc {
+	expected := []byte("Bearer " + token)
+	return func(w http.ResponseWriter, r *http.Request) {
+		// сравнение за постоянное время, чтобы токен нельзя было подобрать по времени ответа
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), expected) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="admin"`)
+			writeProblem(w, r, http.StatusUnauthorized, "valid bearer token required")
+			return
+		}
+		next(w, r)
+	}
+}
+
+// список UID в кэше с временем последнего обращения
+func (s *Server) handleCacheEntries(admin CacheAdmin) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, admin.Entries(r.Context()))
+	}
+}
+
+// счётчики попаданий, промахов и вытеснений
+func (s *Server) handleCacheStats(admin CacheAdmin) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, admin.Stats())
+	}
+}
+
+// удаляет из кэша один заказ
+func (s *Server) handleCacheEvict(admin CacheAdmin) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		uid := r.PathValue("UID")
+		if !admin.Evict(r.Context(), uid) {
+			writeProblem(w, r, http.StatusNotFound, "order is not cached")
+			return
+		}
+		slog.InfoContext(r.Context(), "admin: order evicted from cache", "order_uid", uid)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// очищает кэш целиком
+func (s *Server) handleCacheFlush(admin CacheAdmin) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		removed := admin.Flush(r.Context())
+		slog.InfoContext(r.Context(), "admin: cache flushed", "orders_removed", removed)
+		writeJSON(w, http.StatusOK, map[string]int{"removed": removed})
+	}
+}
+
+// заново загружает в кэш последние заказы из БД, как при старте сервиса
+func (s *Server) handleCacheReload(admin CacheAdmin) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := admin.LoadCache(r.Context()); err != nil {
+			slog.ErrorContext(r.Context(), "admin: failed to reload cache", "error", err)
+			writeError(w, r, err)
+			return
+		}
+		slog.InfoContext(r.Context(), "admin: cache reloaded")
+		writeJSON(w, http.StatusOK, admin.Stats())
+	}
+}
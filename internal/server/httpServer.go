@@ -1,30 +1,38 @@
 package server
 
 import (
+	"context"
+	"embed"
 	"encoding/json"
 	"html/template"
 	"log/slog"
 	"net/http"
 	"strings"
+	"time"
 
 	"github.com/Asus/L0_DemoServise/internal/entity"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 type OrderGiver interface {
-	GiveOrderByUID(UID string) (entity.Order, error)
+	GiveOrderByUID(ctx context.Context, UID string) (entity.Order, error)
+	SearchOrders(ctx context.Context, q entity.OrderSearch) (entity.OrderPage, error)
 }
 
 type Server struct {
 	router  *http.ServeMux
+	handler http.Handler // router, обёрнутый в middleware
 	server  *http.Server
 	service OrderGiver
 }
 
-func NewServer(addr string, OrdService OrderGiver) *Server {
+// NewServer создаёт сервер, requestTimeout - дедлайн на обработку одного запроса (0 - без дедлайна)
+func NewServer(addr string, OrdService OrderGiver, requestTimeout time.Duration) *Server {
 	srv := &Server{
 		router:  http.NewServeMux(),
 		service: OrdService,
 	}
+	srv.handler = chain(srv.router, withRequestID, withAccessLog, withTimeout(requestTimeout))
 	srv.server = &http.Server{
 		Addr:    addr,
 		Handler: srv,
@@ -39,22 +47,43 @@ func (s *Server) Start() error {
 	return s.server.ListenAndServe()
 }
 
-// Для того чтобы не писать логирование в каждом HandleFunc логируем все тут
+// Shutdown перестаёт принимать новые соединения и ждёт завершения текущих запросов (не дольше ctx)
+func (s *Server) Shutdown(ctx context.Context) error {
+	slog.Info("server shutting down", "address", s.server.Addr)
+	return s.server.Shutdown(ctx)
+}
+
+// все запросы проходят через цепочку middleware: request ID, логирование и метрики, затем роутер
 func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	slog.Info("request received", "method", r.Method, "path", r.URL.Path)
-	s.router.ServeHTTP(w, r) // находим нужный хэндлер и вызываем
+	s.handler.ServeHTTP(w, r)
 }
 
 // эта функция заполняет наш маршрутизатор нужными хендлерами
 func (s *Server) routes() {
     s.router.HandleFunc("GET /", s.handleHomePage())      
     s.router.HandleFunc("GET /order/{UID}", s.handleOrderByUID()) 
+    s.router.HandleFunc("GET /orders", s.handleOrderSearch())
+    s.router.Handle("GET /metrics", promhttp.Handler())
 }
 
 
-// handleHomePage() просто загружает домашнюю страницу html
-var tmpl = template.Must(template.ParseGlob("internal/server/templates/*.html")) // загрузили все html
+// writeJSON отдаёт v в формате JSON с указанным статусом
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		slog.Error("failed to encode response to JSON", "error", err)
+	}
+}
+
+// шаблоны встроены в бинарник, поэтому сервер не зависит от рабочей директории
+//
+//go:embed templates/*.html
+var templatesFS embed.FS
 
+var tmpl = template.Must(template.ParseFS(templatesFS, "templates/*.html")) // загрузили все html
+
+// handleHomePage() просто загружает домашнюю страницу html
 func (s *Server) handleHomePage() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		tmpl.ExecuteTemplate(w, "homePage.html", nil)
@@ -67,21 +96,21 @@ func (s *Server) handleOrderByUID() http.HandlerFunc {
         // ожидаем URL вида: /order/<uid>
         uid := strings.TrimPrefix(r.URL.Path, "/order/")
         if uid == "" || strings.Contains(uid, "/") {
-            http.NotFound(w, r)
+            writeProblem(w, r, http.StatusNotFound, "expected /order/{UID}")
             return
         }
 
-        ord, err := s.service.GiveOrderByUID(uid)
+        ord, err := s.service.GiveOrderByUID(r.Context(), uid)
         if err != nil {
-            http.Error(w, "order not found", http.StatusNotFound)
+            slog.InfoContext(r.Context(), "failed to give order", "order_uid", uid, "error", err)
+            writeError(w, r, err)
             return
         }
 
         // Возвращаем JSON вместо рендеринга шаблона
         w.Header().Set("Content-Type", "application/json")
         if err := json.NewEncoder(w).Encode(ord); err != nil {
-            slog.Error("failed to encode order to JSON", "error", err)
-            http.Error(w, "internal server error", http.StatusInternalServerError)
+            slog.ErrorContext(r.Context(), "failed to encode order to JSON", "error", err)
         }
     }
 }
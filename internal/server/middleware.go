@@ -0,0 +1,118 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/Asus/L0_DemoServise/internal/logger"
+	"github.com/Asus/L0_DemoServise/internal/metrics"
+)
+
+const headerRequestID = "X-Request-ID"
+
+// middleware оборачивает обработчик, например добавляя логирование
+type middleware func(http.Handler) http.Handler
+
+// chain применяет middleware по порядку: первый в списке выполняется первым
+func chain(h http.Handler, mws ...middleware) http.Handler {
+	for i := len(mws) - 1; i >= 0; i-- {
+		h = mws[i](h)
+	}
+	return h
+}
+
+// withRequestID берёт ID запроса из заголовка X-Request-ID или генерирует новый,
+// кладёт его в контекст запроса и возвращает клиенту в том же заголовке
+func withRequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestID := r.Header.Get(headerRequestID)
+		if !validRequestID(requestID) {
+			requestID = newRequestID()
+		}
+		w.Header().Set(headerRequestID, requestID)
+		next.ServeHTTP(w, r.WithContext(logger.WithRequestID(r.Context(), requestID)))
+	})
+}
+
+// validRequestID не даёт клиенту записать в логи что угодно: только короткие печатные ID
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 128 {
+		return false
+	}
+	for _, c := range id {
+		if c < '!' || c > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+func newRequestID() string {
+	b := make([]byte, 16)
+	rand.Read(b) // crypto/rand.Read не возвращает ошибок
+	return hex.EncodeToString(b)
+}
+
+// withAccessLog логирует каждый запрос после ответа (код, размер, время) и пишет HTTP-метрики
+func withAccessLog(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &responseRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+		duration := time.Since(start)
+
+		// ServeMux записывает в r.Pattern шаблон маршрута ("GET /order/{UID}"), а не сам путь -
+		// так число серий в метриках не зависит от UID в запросах
+		metrics.ObserveHTTP(r.Pattern, rec.status, duration)
+		slog.InfoContext(r.Context(), "request completed",
+			"method", r.Method,
+			"path", r.URL.Path,
+			"route", r.Pattern,
+			"status", rec.status,
+			"bytes", rec.bytes,
+			"duration", duration,
+		)
+	})
+}
+
+// withTimeout ограничивает время обработки запроса: контекст запроса отменяется через timeout,
+// вместе с ним прерываются и запросы к БД
+func withTimeout(timeout time.Duration) middleware {
+	return func(next http.Handler) http.Handler {
+		if timeout <= 0 {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx, cancel := context.WithTimeout(r.Context(), timeout)
+			defer cancel()
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+// responseRecorder запоминает код и размер ответа
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+}
+
+func (r *responseRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *responseRecorder) Write(b []byte) (int, error) {
+	n, err := r.ResponseWriter.Write(b)
+	r.bytes += n
+	return n, err
+}
+
+// Unwrap нужен http.ResponseController, чтобы добраться до исходного ResponseWriter
+func (r *responseRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
@@ -0,0 +1,102 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/Asus/L0_DemoServise/internal/entity"
+)
+
+const (
+	defaultSearchLimit = 20
+	maxSearchLimit     = 100
+)
+
+// ищет заказы по фильтрам из query-параметров и отдаёт страницу с курсором на следующую:
+// GET /orders?customer_id=test&date_from=2021-11-01T00:00:00Z&limit=20&cursor=...
+func (s *Server) handleOrderSearch() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		search, err := parseOrderSearch(r.URL.Query())
+		if err != nil {
+			writeProblem(w, r, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		page, err := s.service.SearchOrders(r.Context(), search)
+		if err != nil {
+			slog.ErrorContext(r.Context(), "failed to search orders", "error", err)
+			writeError(w, r, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(page); err != nil {
+			slog.ErrorContext(r.Context(), "failed to encode orders page to JSON", "error", err)
+		}
+	}
+}
+
+// parseOrderSearch разбирает параметры поиска:
+// customer_id, track_number, delivery_service, locale, nm_id, brand - фильтры на точное совпадение;
+// date_from, date_to (RFC 3339) - диапазон date_created [date_from, date_to);
+// sort - date_created (сначала старые) или -date_created (по умолчанию, сначала новые);
+// limit - размер страницы, cursor - next_cursor из предыдущего ответа
+func parseOrderSearch(query url.Values) (entity.OrderSearch, error) {
+	search := entity.OrderSearch{
+		Filter: entity.OrderFilter{
+			CustomerID:      query.Get("customer_id"),
+			TrackNumber:     query.Get("track_number"),
+			DeliveryService: query.Get("delivery_service"),
+			Locale:          query.Get("locale"),
+			Brand:           query.Get("brand"),
+		},
+		Limit: defaultSearchLimit,
+	}
+
+	var err error
+	if v := query.Get("nm_id"); v != "" {
+		if search.Filter.NmID, err = strconv.Atoi(v); err != nil {
+			return search, fmt.Errorf("nm_id must be an integer")
+		}
+	}
+	if v := query.Get("date_from"); v != "" {
+		if search.Filter.CreatedFrom, err = time.Parse(time.RFC3339, v); err != nil {
+			return search, fmt.Errorf("date_from must be in RFC 3339 format")
+		}
+	}
+	if v := query.Get("date_to"); v != "" {
+		if search.Filter.CreatedTo, err = time.Parse(time.RFC3339, v); err != nil {
+			return search, fmt.Errorf("date_to must be in RFC 3339 format")
+		}
+	}
+
+	if v := query.Get("limit"); v != "" {
+		search.Limit, err = strconv.Atoi(v)
+		if err != nil || search.Limit < 1 || search.Limit > maxSearchLimit {
+			return search, fmt.Errorf("limit must be an integer from 1 to %d", maxSearchLimit)
+		}
+	}
+
+	switch query.Get("sort") {
+	case "", "-date_created":
+	case "date_created":
+		search.Ascending = true
+	default:
+		return search, fmt.Errorf("sort must be date_created or -date_created")
+	}
+
+	if v := query.Get("cursor"); v != "" {
+		cursor, err := entity.DecodeOrderCursor(v)
+		if err != nil {
+			return search, err
+		}
+		search.After = &cursor
+	}
+
+	return search, nil
+}
@@ -0,0 +1,33 @@
+package server
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+
+	"github.com/Asus/L0_DemoServise/internal/entity"
+)
+
+// StatusHistorian - история статусов заказа
+type StatusHistorian interface {
+	StatusHistory(ctx context.Context, UID string) ([]entity.StatusChange, error)
+}
+
+// EnableStatusHistory регистрирует эндпоинт GET /order/{UID}/history. Вызывается до Start
+func (s *Server) EnableStatusHistory(statuses StatusHistorian) {
+	s.router.HandleFunc("GET /order/{UID}/history", s.handleStatusHistory(statuses))
+}
+
+// история статусов заказа от старых записей к новым
+func (s *Server) handleStatusHistory(statuses StatusHistorian) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		uid := r.PathValue("UID")
+		history, err := statuses.StatusHistory(r.Context(), uid)
+		if err != nil {
+			slog.InfoContext(r.Context(), "failed to give status history", "order_uid", uid, "error", err)
+			writeError(w, r, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, history)
+	}
+}
@@ -0,0 +1,77 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+
+	"github.com/Asus/L0_DemoServise/internal/entity"
+	"github.com/Asus/L0_DemoServise/internal/logger"
+)
+
+// statusClientClosedRequest - клиент закрыл соединение, не дождавшись ответа (код из nginx).
+// Клиент его не увидит, он нужен для логов и метрик
+const statusClientClosedRequest = 499
+
+// problem - тело ответа с ошибкой по RFC 7807
+type problem struct {
+	Type     string `json:"type"`
+	Title    string `json:"title"`
+	Status   int    `json:"status"`
+	Detail   string `json:"detail,omitempty"`
+	Instance string `json:"instance,omitempty"`
+	// расширение RFC 7807: по нему запрос находится в логах
+	RequestID string `json:"request_id,omitempty"`
+	// нарушенные правила, если заказ не прошёл валидацию
+	Violations []entity.Violation `json:"violations,omitempty"`
+}
+
+// writeProblem отвечает ошибкой в формате application/problem+json
+func writeProblem(w http.ResponseWriter, r *http.Request, status int, detail string) {
+	writeProblemWithViolations(w, r, status, detail, nil)
+}
+
+func writeProblemWithViolations(w http.ResponseWriter, r *http.Request, status int, detail string, violations []entity.Violation) {
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(status)
+	err := json.NewEncoder(w).Encode(problem{
+		Type:       "about:blank", // отдельных типов ошибок нет, смысл передаёт статус
+		Title:      http.StatusText(status),
+		Status:     status,
+		Detail:     detail,
+		Instance:   r.URL.Path,
+		RequestID:  logger.RequestID(r.Context()),
+		Violations: violations,
+	})
+	if err != nil {
+		slog.ErrorContext(r.Context(), "failed to encode problem to JSON", "error", err)
+	}
+}
+
+// writeError переводит ошибку сервиса в HTTP-статус. Подробности 5xx ошибок клиенту не отдаются,
+// они есть в логе с тем же request_id
+func writeError(w http.ResponseWriter, r *http.Request, err error) {
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		writeProblem(w, r, http.StatusGatewayTimeout, "request timed out")
+	case errors.Is(err, context.Canceled):
+		w.WriteHeader(statusClientClosedRequest) // клиент ушёл, ответ всё равно никто не прочитает
+	case errors.Is(err, entity.ErrNotFound):
+		writeProblem(w, r, http.StatusNotFound, err.Error())
+	case errors.Is(err, entity.ErrInvalidOrder):
+		var verr *entity.ValidationError
+		if errors.As(err, &verr) {
+			writeProblemWithViolations(w, r, http.StatusUnprocessableEntity, err.Error(), verr.Violations)
+			return
+		}
+		writeProblem(w, r, http.StatusUnprocessableEntity, err.Error())
+	case errors.Is(err, entity.ErrDuplicate), errors.Is(err, entity.ErrInvalidTransition):
+		writeProblem(w, r, http.StatusConflict, err.Error())
+	case errors.Is(err, entity.ErrUnavailable):
+		writeProblem(w, r, http.StatusServiceUnavailable, "storage is temporarily unavailable")
+	default:
+		writeProblem(w, r, http.StatusInternalServerError, "internal server error")
+	}
+}
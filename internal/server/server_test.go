@@ -0,0 +1,328 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Asus/L0_DemoServise/internal/entity"
+)
+
+// fakeOrders отдаёт err или заказ с запрошенным UID и запоминает последний поисковый запрос
+type fakeOrders struct {
+	err    error
+	block  bool // ждать отмены контекста запроса
+	search entity.OrderSearch
+}
+
+func (f *fakeOrders) GiveOrderByUID(ctx context.Context, UID string) (entity.Order, error) {
+	if f.block {
+		<-ctx.Done()
+		return entity.Order{}, fmt.Errorf("order %s: %w", UID, ctx.Err())
+	}
+	if f.err != nil {
+		return entity.Order{}, f.err
+	}
+	return entity.Order{OrderUID: UID}, nil
+}
+
+func (f *fakeOrders) SearchOrders(ctx context.Context, q entity.OrderSearch) (entity.OrderPage, error) {
+	f.search = q
+	if f.err != nil {
+		return entity.OrderPage{}, f.err
+	}
+	return entity.OrderPage{Orders: []entity.Order{{OrderUID: "order-1"}}}, nil
+}
+
+// fakeAdmin - кэш, в котором лежат заказы из cached
+type fakeAdmin struct {
+	cached map[string]bool
+}
+
+func (a *fakeAdmin) Entries(ctx context.Context) []entity.CacheEntry {
+	var entries []entity.CacheEntry
+	for UID := range a.cached {
+		entries = append(entries, entity.CacheEntry{OrderUID: UID})
+	}
+	return entries
+}
+
+func (a *fakeAdmin) Evict(ctx context.Context, UID string) bool {
+	ok := a.cached[UID]
+	delete(a.cached, UID)
+	return ok
+}
+
+func (a *fakeAdmin) Flush(ctx context.Context) int {
+	n := len(a.cached)
+	clear(a.cached)
+	return n
+}
+
+func (a *fakeAdmin) Stats() entity.CacheStats { return entity.CacheStats{Size: len(a.cached)} }
+
+func (a *fakeAdmin) LoadCache(ctx context.Context) error { return nil }
+
+func serve(t *testing.T, srv *Server, r *http.Request) *httptest.ResponseRecorder {
+	t.Helper()
+	w := httptest.NewRecorder()
+	srv.ServeHTTP(w, r)
+	return w
+}
+
+func decodeProblem(t *testing.T, w *httptest.ResponseRecorder) problem {
+	t.Helper()
+	if ct := w.Header().Get("Content-Type"); ct != "application/problem+json" {
+		t.Fatalf("expected application/problem+json, got %q", ct)
+	}
+	var p problem
+	if err := json.NewDecoder(w.Body).Decode(&p); err != nil {
+		t.Fatalf("failed to decode problem: %v", err)
+	}
+	return p
+}
+
+func TestWriteErrorStatuses(t *testing.T) {
+	violations := []entity.Violation{{Rule: entity.RuleCurrency, Field: "Order.Payment.Currency", Message: "bad currency"}}
+
+	testCases := []struct {
+		name           string
+		err            error
+		expectedStatus int
+		expectedDetail string // пусто - не проверяется
+	}{
+		{name: "not found", err: fmt.Errorf("order x: %w", entity.ErrNotFound), expectedStatus: http.StatusNotFound},
+		{name: "invalid order", err: fmt.Errorf("bad: %w", entity.ErrInvalidOrder), expectedStatus: http.StatusUnprocessableEntity},
+		{name: "validation error", err: &entity.ValidationError{Violations: violations}, expectedStatus: http.StatusUnprocessableEntity},
+		{name: "duplicate", err: fmt.Errorf("x: %w", entity.ErrDuplicate), expectedStatus: http.StatusConflict},
+		{name: "invalid transition", err: fmt.Errorf("x: %w", entity.ErrInvalidTransition), expectedStatus: http.StatusConflict},
+		{
+			name:           "storage unavailable hides details",
+			err:            fmt.Errorf("dial tcp 10.0.0.1: %w", entity.ErrUnavailable),
+			expectedStatus: http.StatusServiceUnavailable,
+			expectedDetail: "storage is temporarily unavailable",
+		},
+		{
+			name:           "unknown error hides details",
+			err:            errors.New("pq: secret internals"),
+			expectedStatus: http.StatusInternalServerError,
+			expectedDetail: "internal server error",
+		},
+		{
+			name:           "deadline",
+			err:            fmt.Errorf("x: %w", context.DeadlineExceeded),
+			expectedStatus: http.StatusGatewayTimeout,
+			expectedDetail: "request timed out",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			srv := NewServer(":0", &fakeOrders{err: tc.err}, 0)
+			r := httptest.NewRequest(http.MethodGet, "/order/order-1", nil)
+			r.Header.Set(headerRequestID, "req-42")
+			w := serve(t, srv, r)
+
+			if w.Code != tc.expectedStatus {
+				t.Fatalf("expected status %d, got %d", tc.expectedStatus, w.Code)
+			}
+			p := decodeProblem(t, w)
+			expected := problem{
+				Type:      "about:blank",
+				Title:     http.StatusText(tc.expectedStatus),
+				Status:    tc.expectedStatus,
+				Detail:    p.Detail,
+				Instance:  "/order/order-1",
+				RequestID: "req-42",
+			}
+			var verr *entity.ValidationError
+			if errors.As(tc.err, &verr) {
+				expected.Violations = violations
+			}
+			if !reflect.DeepEqual(p, expected) {
+				t.Errorf("unexpected problem:\n got %+v\nwant %+v", p, expected)
+			}
+			if tc.expectedDetail != "" && p.Detail != tc.expectedDetail {
+				t.Errorf("expected detail %q, got %q", tc.expectedDetail, p.Detail)
+			}
+		})
+	}
+
+	t.Run("client gone", func(t *testing.T) {
+		srv := NewServer(":0", &fakeOrders{err: fmt.Errorf("x: %w", context.Canceled)}, 0)
+		w := serve(t, srv, httptest.NewRequest(http.MethodGet, "/order/order-1", nil))
+		if w.Code != statusClientClosedRequest || w.Body.Len() != 0 {
+			t.Errorf("expected empty %d response, got %d %q", statusClientClosedRequest, w.Code, w.Body.String())
+		}
+	})
+}
+
+func TestOrderByUID(t *testing.T) {
+	srv := NewServer(":0", &fakeOrders{}, 0)
+	w := serve(t, srv, httptest.NewRequest(http.MethodGet, "/order/order-1", nil))
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "application/json" {
+		t.Fatalf("expected 200 JSON, got %d %q", w.Code, w.Header().Get("Content-Type"))
+	}
+	var ord entity.Order
+	if err := json.NewDecoder(w.Body).Decode(&ord); err != nil || ord.OrderUID != "order-1" {
+		t.Errorf("expected order-1, got %+v, %v", ord, err)
+	}
+
+	home := serve(t, srv, httptest.NewRequest(http.MethodGet, "/", nil))
+	if home.Code != http.StatusOK || !strings.Contains(home.Body.String(), "<html") {
+		t.Errorf("expected home page, got %d", home.Code)
+	}
+}
+
+func TestRequestTimeout(t *testing.T) {
+	srv := NewServer(":0", &fakeOrders{block: true}, 20*time.Millisecond)
+	w := serve(t, srv, httptest.NewRequest(http.MethodGet, "/order/order-1", nil))
+	if w.Code != http.StatusGatewayTimeout {
+		t.Fatalf("expected 504, got %d", w.Code)
+	}
+	if p := decodeProblem(t, w); p.Detail != "request timed out" {
+		t.Errorf("unexpected detail %q", p.Detail)
+	}
+}
+
+func TestRequestID(t *testing.T) {
+	srv := NewServer(":0", &fakeOrders{}, 0)
+
+	testCases := []struct {
+		name     string
+		incoming string
+		keep     bool
+	}{
+		{name: "incoming ID is kept", incoming: "abc-123", keep: true},
+		{name: "ID is generated when missing"},
+		{name: "unprintable ID is replaced", incoming: "bad id\n"},
+		{name: "too long ID is replaced", incoming: strings.Repeat("a", 129)},
+	}
+	generated := regexp.MustCompile(`^[0-9a-f]{32}$`)
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/order/order-1", nil)
+			if tc.incoming != "" {
+				r.Header.Set(headerRequestID, tc.incoming)
+			}
+			got := serve(t, srv, r).Header().Get(headerRequestID)
+			if tc.keep && got != tc.incoming {
+				t.Errorf("expected %q, got %q", tc.incoming, got)
+			}
+			if !tc.keep && !generated.MatchString(got) {
+				t.Errorf("expected generated ID, got %q", got)
+			}
+		})
+	}
+}
+
+func TestOrderSearch(t *testing.T) {
+	cursor := entity.OrderCursor{DateCreated: time.Date(2021, 11, 26, 6, 22, 19, 0, time.UTC), OrderUID: "order-9"}
+
+	testCases := []struct {
+		name           string
+		query          string
+		expectedStatus int
+		expected       entity.OrderSearch
+	}{
+		{
+			name:           "defaults",
+			query:          "",
+			expectedStatus: http.StatusOK,
+			expected:       entity.OrderSearch{Limit: defaultSearchLimit},
+		},
+		{
+			name: "all filters",
+			query: "customer_id=c1&track_number=T1&delivery_service=meest&locale=en&nm_id=42&brand=B" +
+				"&date_from=2021-11-01T00:00:00Z&date_to=2021-12-01T00:00:00Z&limit=5&sort=date_created&cursor=" + cursor.Encode(),
+			expectedStatus: http.StatusOK,
+			expected: entity.OrderSearch{
+				Filter: entity.OrderFilter{
+					CustomerID: "c1", TrackNumber: "T1", DeliveryService: "meest", Locale: "en", NmID: 42, Brand: "B",
+					CreatedFrom: time.Date(2021, 11, 1, 0, 0, 0, 0, time.UTC),
+					CreatedTo:   time.Date(2021, 12, 1, 0, 0, 0, 0, time.UTC),
+				},
+				Limit:     5,
+				Ascending: true,
+				After:     &cursor,
+			},
+		},
+		{name: "bad nm_id", query: "nm_id=x", expectedStatus: http.StatusBadRequest},
+		{name: "bad date", query: "date_from=yesterday", expectedStatus: http.StatusBadRequest},
+		{name: "limit too big", query: "limit=101", expectedStatus: http.StatusBadRequest},
+		{name: "limit zero", query: "limit=0", expectedStatus: http.StatusBadRequest},
+		{name: "bad sort", query: "sort=price", expectedStatus: http.StatusBadRequest},
+		{name: "bad cursor", query: "cursor=not-base64!", expectedStatus: http.StatusBadRequest},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			orders := &fakeOrders{}
+			srv := NewServer(":0", orders, 0)
+			w := serve(t, srv, httptest.NewRequest(http.MethodGet, "/orders?"+tc.query, nil))
+
+			if w.Code != tc.expectedStatus {
+				t.Fatalf("expected status %d, got %d: %s", tc.expectedStatus, w.Code, w.Body.String())
+			}
+			if tc.expectedStatus != http.StatusOK {
+				if p := decodeProblem(t, w); p.Status != tc.expectedStatus || p.Detail == "" {
+					t.Errorf("unexpected problem %+v", p)
+				}
+				return
+			}
+			if !reflect.DeepEqual(orders.search, tc.expected) {
+				t.Errorf("unexpected search:\n got %+v\nwant %+v", orders.search, tc.expected)
+			}
+		})
+	}
+
+	t.Run("storage error", func(t *testing.T) {
+		srv := NewServer(":0", &fakeOrders{err: fmt.Errorf("x: %w", entity.ErrUnavailable)}, 0)
+		if w := serve(t, srv, httptest.NewRequest(http.MethodGet, "/orders", nil)); w.Code != http.StatusServiceUnavailable {
+			t.Errorf("expected 503, got %d", w.Code)
+		}
+	})
+}
+
+func TestCacheAdminAuth(t *testing.T) {
+	admin := &fakeAdmin{cached: map[string]bool{"order-1": true}}
+	srv := NewServer(":0", &fakeOrders{}, 0)
+	srv.EnableCacheAdmin(admin, "secret")
+
+	request := func(method, path, auth string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, path, nil)
+		if auth != "" {
+			r.Header.Set("Authorization", auth)
+		}
+		return serve(t, srv, r)
+	}
+
+	for _, auth := range []string{"", "Bearer wrong", "secret", "Basic secret"} {
+		w := request(http.MethodGet, "/admin/cache", auth)
+		if w.Code != http.StatusUnauthorized || w.Header().Get("WWW-Authenticate") == "" {
+			t.Errorf("auth %q: expected 401 with WWW-Authenticate, got %d", auth, w.Code)
+		}
+	}
+
+	if w := request(http.MethodGet, "/admin/cache", "Bearer secret"); w.Code != http.StatusOK {
+		t.Errorf("expected 200 with valid token, got %d", w.Code)
+	}
+	if w := request(http.MethodDelete, "/admin/cache/order-1", "Bearer secret"); w.Code != http.StatusNoContent {
+		t.Errorf("expected 204 for cached order, got %d", w.Code)
+	}
+	if w := request(http.MethodDelete, "/admin/cache/order-1", "Bearer secret"); w.Code != http.StatusNotFound {
+		t.Errorf("expected 404 for evicted order, got %d", w.Code)
+	}
+	if w := request(http.MethodPost, "/admin/cache/reload", "Bearer secret"); w.Code != http.StatusOK {
+		t.Errorf("expected 200 for reload, got %d", w.Code)
+	}
+}
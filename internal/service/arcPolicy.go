@@ -0,0 +1,132 @@
+package service
+
+import "container/list"
+
+// списки ARC
+const (
+	arcT1 = iota // заказы в кэше, к которым обратились один раз
+	arcT2        // заказы в кэше, к которым обращались больше одного раза
+	arcB1        // "призраки" - UID недавно вытесненных из T1
+	arcB2        // "призраки" - UID недавно вытесненных из T2
+)
+
+type arcEntry struct {
+	UID  string
+	list int
+}
+
+// ARCPolicy - Adaptive Replacement Cache (Megiddo, Modha).
+// Кэш делится между недавними (T1) и частыми (T2) заказами, а граница p между ними сдвигается
+// по промахам: попадание в призрака B1 говорит, что T1 мал, в призрака B2 - что мал T2.
+// Призраки хранят только UID и ограничены capacity
+type ARCPolicy struct {
+	capacity int
+	p        int // целевой размер T1
+	lists    [4]*list.List
+	elements map[string]*list.Element // Value - *arcEntry
+}
+
+func NewARCPolicy(capacity int) *ARCPolicy {
+	p := &ARCPolicy{
+		capacity: capacity,
+		elements: make(map[string]*list.Element),
+	}
+	for i := range p.lists {
+		p.lists[i] = list.New()
+	}
+	return p
+}
+
+func (p *ARCPolicy) Add(UID string) {
+	if elem, ok := p.elements[UID]; ok {
+		switch entry := elem.Value.(*arcEntry); entry.list {
+		case arcT1, arcT2:
+			p.Touch(UID)
+			return
+		case arcB1:
+			// T1 оказался слишком мал - увеличиваем его долю
+			p.p = min(p.p+max(p.lists[arcB2].Len()/p.lists[arcB1].Len(), 1), p.capacity)
+		case arcB2:
+			p.p = max(p.p-max(p.lists[arcB1].Len()/p.lists[arcB2].Len(), 1), 0)
+		}
+		p.move(elem, arcT2) // заказ уже встречался недавно - он "частый"
+		return
+	}
+
+	p.push(UID, arcT1)
+	p.trimGhosts()
+}
+
+func (p *ARCPolicy) Touch(UID string) {
+	elem, ok := p.elements[UID]
+	if !ok {
+		return
+	}
+	if entry := elem.Value.(*arcEntry); entry.list == arcT1 || entry.list == arcT2 {
+		p.move(elem, arcT2)
+	}
+}
+
+func (p *ARCPolicy) Remove(UID string) {
+	elem, ok := p.elements[UID]
+	if !ok {
+		return
+	}
+	if entry := elem.Value.(*arcEntry); entry.list == arcT1 || entry.list == arcT2 {
+		p.lists[entry.list].Remove(elem)
+		delete(p.elements, UID)
+	}
+}
+
+// Evict - процедура REPLACE из ARC: вытесняем из T1, если он больше целевого размера, иначе из T2.
+// Вытесненный UID становится призраком
+func (p *ARCPolicy) Evict(incoming string) (string, bool) {
+	t1, t2 := p.lists[arcT1], p.lists[arcT2]
+	if t1.Len()+t2.Len() == 0 {
+		return "", false
+	}
+
+	incomingInB2 := false
+	if elem, ok := p.elements[incoming]; ok {
+		incomingInB2 = elem.Value.(*arcEntry).list == arcB2
+	}
+
+	from, ghost := arcT2, arcB2
+	if t1.Len() > 0 && (t1.Len() > p.p || (incomingInB2 && t1.Len() == p.p) || t2.Len() == 0) {
+		from, ghost = arcT1, arcB1
+	}
+
+	elem := p.lists[from].Back()
+	p.move(elem, ghost)
+	return elem.Value.(*arcEntry).UID, true
+}
+
+func (p *ARCPolicy) Len() int { return p.lists[arcT1].Len() + p.lists[arcT2].Len() }
+
+func (p *ARCPolicy) push(UID string, to int) {
+	p.elements[UID] = p.lists[to].PushFront(&arcEntry{UID: UID, list: to})
+}
+
+// move переносит элемент в начало списка to
+func (p *ARCPolicy) move(elem *list.Element, to int) {
+	entry := elem.Value.(*arcEntry)
+	p.lists[entry.list].Remove(elem)
+	p.push(entry.UID, to)
+}
+
+// trimGhosts держит инварианты ARC: |T1|+|B1| <= c и |T1|+|T2|+|B1|+|B2| <= 2c
+func (p *ARCPolicy) trimGhosts() {
+	t1, t2, b1, b2 := p.lists[arcT1], p.lists[arcT2], p.lists[arcB1], p.lists[arcB2]
+	for t1.Len()+b1.Len() > p.capacity && b1.Len() > 0 {
+		p.dropGhost(arcB1)
+	}
+	for t1.Len()+t2.Len()+b1.Len()+b2.Len() > 2*p.capacity && b2.Len() > 0 {
+		p.dropGhost(arcB2)
+	}
+}
+
+func (p *ARCPolicy) dropGhost(ghost int) {
+	elem := p.lists[ghost].Back()
+	p.lists[ghost].Remove(elem)
+	delete(p.elements, elem.Value.(*arcEntry).UID)
+}
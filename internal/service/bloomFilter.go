@@ -0,0 +1,257 @@
+package service
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"log/slog"
+	"math"
+	"sync"
+	"time"
+)
+
+// bloomFilter - обычный фильтр Блума на capacity элементов с заданной вероятностью ложного срабатывания
+type bloomFilter struct {
+	bits     []uint64
+	m        uint64 // число бит
+	k        int    // число хэш-функций
+	capacity int
+	count    int
+}
+
+func newBloomFilter(capacity int, fpRate float64) *bloomFilter {
+	// оптимальные размеры: m = -n*ln(p)/ln(2)^2, k = m/n*ln(2)
+	m := uint64(math.Ceil(-float64(capacity) * math.Log(fpRate) / (math.Ln2 * math.Ln2)))
+	m = max(m, 64)
+	k := max(int(math.Round(float64(m)/float64(capacity)*math.Ln2)), 1)
+	return &bloomFilter{
+		bits:     make([]uint64, (m+63)/64),
+		m:        m,
+		k:        k,
+		capacity: capacity,
+	}
+}
+
+// positions - двойное хэширование (Kirsch, Mitzenmacher): i-я позиция = h1 + i*h2
+func (f *bloomFilter) positions(h1, h2 uint64, fn func(pos uint64) bool) bool {
+	for i := range uint64(f.k) {
+		if !fn((h1 + i*h2) % f.m) {
+			return false
+		}
+	}
+	return true
+}
+
+func (f *bloomFilter) add(h1, h2 uint64) {
+	f.positions(h1, h2, func(pos uint64) bool {
+		f.bits[pos/64] |= 1 << (pos % 64)
+		return true
+	})
+	f.count++
+}
+
+func (f *bloomFilter) mayContain(h1, h2 uint64) bool {
+	return f.positions(h1, h2, func(pos uint64) bool {
+		return f.bits[pos/64]&(1<<(pos%64)) != 0
+	})
+}
+
+// fpRate - ожидаемая вероятность ложного срабатывания при текущем заполнении: (1 - e^(-kn/m))^k
+func (f *bloomFilter) fpRate() float64 {
+	return math.Pow(1-math.Exp(-float64(f.k)*float64(f.count)/float64(f.m)), float64(f.k))
+}
+
+// параметры масштабирования (Almeida et al., "Scalable Bloom Filters")
+const (
+	bloomGrowth     = 2   // каждый следующий фильтр вдвое больше
+	bloomTightening = 0.5 // и с вдвое меньшей вероятностью ошибки, так что суммарная не больше 2*fpRate
+)
+
+// ScalableBloom - масштабируемый фильтр Блума: когда текущий фильтр заполнен, добавляется новый,
+// побольше и построже. Ложных отрицаний не бывает: если MayContain вернул false, UID точно не добавлялся
+type ScalableBloom struct {
+	mu      sync.RWMutex
+	filters []*bloomFilter
+	fpRate  float64 // для следующего фильтра
+}
+
+func NewScalableBloom(capacity int, fpRate float64) *ScalableBloom {
+	return &ScalableBloom{
+		filters: []*bloomFilter{newBloomFilter(capacity, fpRate*(1-bloomTightening))},
+		fpRate:  fpRate * (1 - bloomTightening) * bloomTightening,
+	}
+}
+
+func bloomHash(UID string) (uint64, uint64) {
+	h := fnv.New128a()
+	h.Write([]byte(UID))
+	sum := h.Sum(nil)
+	return binary.BigEndian.Uint64(sum[:8]), binary.BigEndian.Uint64(sum[8:]) | 1 // h2 нечётный - позиции не зацикливаются
+}
+
+func (b *ScalableBloom) Add(UID string) {
+	h1, h2 := bloomHash(UID)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for _, f := range b.filters {
+		if f.mayContain(h1, h2) {
+			return // уже есть (или ложное срабатывание) - не тратим место
+		}
+	}
+	last := b.filters[len(b.filters)-1]
+	if last.count >= last.capacity {
+		last = newBloomFilter(last.capacity*bloomGrowth, b.fpRate)
+		b.filters = append(b.filters, last)
+		b.fpRate *= bloomTightening
+	}
+	last.add(h1, h2)
+}
+
+func (b *ScalableBloom) MayContain(UID string) bool {
+	h1, h2 := bloomHash(UID)
+
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	for _, f := range b.filters {
+		if f.mayContain(h1, h2) {
+			return true
+		}
+	}
+	return false
+}
+
+// FalsePositiveRate - ожидаемая вероятность ложного срабатывания при текущем заполнении
+func (b *ScalableBloom) FalsePositiveRate() float64 {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	pass := 1.0 // вероятность, что ни один фильтр не ошибся
+	for _, f := range b.filters {
+		pass *= 1 - f.fpRate()
+	}
+	return 1 - pass
+}
+
+// SizeBytes - память под биты всех фильтров
+func (b *ScalableBloom) SizeBytes() int {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	size := 0
+	for _, f := range b.filters {
+		size += len(f.bits) * 8
+	}
+	return size
+}
+
+// bloomState - фильтр кэша и его перестройка из хранилища
+type bloomState struct {
+	mu       sync.RWMutex
+	filter   *ScalableBloom // nil - фильтр ещё не построен, отсекать запросы нельзя
+	building *ScalableBloom // строящийся фильтр, в него тоже попадают сохраняемые UID
+	// время, с которого фильтр ещё не сверялся с хранилищем
+	syncedAt time.Time
+}
+
+func (b *bloomState) ready() bool {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.filter != nil
+}
+
+// mayContain - false, только если фильтр построен и UID в нём точно нет
+func (b *bloomState) mayContain(UID string) bool {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.filter == nil || b.filter.MayContain(UID)
+}
+
+func (b *bloomState) add(UID string) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	if b.filter != nil {
+		b.filter.Add(UID)
+	}
+	if b.building != nil {
+		b.building.Add(UID)
+	}
+}
+
+// LoadBloomFilter заново строит фильтр Блума из всех UID в хранилище: capacity - ожидаемое число заказов
+// (дальше фильтр растёт сам), fpRate - допустимая доля ложных срабатываний. Пока фильтр строится,
+// работает старый (или никакой), а сохраняемые в это время заказы попадают в оба
+func (s *Cache) LoadBloomFilter(ctx context.Context, capacity int, fpRate float64) error {
+	building := NewScalableBloom(capacity, fpRate)
+	startedAt := time.Now()
+	s.bloom.mu.Lock()
+	s.bloom.building = building
+	s.bloom.mu.Unlock()
+
+	uids, err := s.OrderTaker.GetOrderUIDs(ctx)
+	if err != nil {
+		s.bloom.mu.Lock()
+		s.bloom.building = nil
+		s.bloom.mu.Unlock()
+		return fmt.Errorf("error occured while tryed load bloom filter: %w", err)
+	}
+	for _, UID := range uids {
+		building.Add(UID)
+	}
+
+	s.bloom.mu.Lock()
+	s.bloom.filter, s.bloom.building, s.bloom.syncedAt = building, nil, startedAt
+	s.bloom.mu.Unlock()
+	slog.InfoContext(ctx, "Bloom filter loaded", "orders", len(uids), "size_bytes", building.SizeBytes())
+	return nil
+}
+
+// bloomSyncOverlap - на сколько раньше прошлой сверки начинается следующая: часы сервиса и БД
+// могут расходиться, а повторно добавить UID в фильтр безопасно
+const bloomSyncOverlap = time.Minute
+
+// SyncBloomFilter добавляет в фильтр UID заказов, записанных в хранилище после прошлой сверки.
+// Другие реплики сообщают о своих заказах событиями инвалидации, а сверка догоняет пропущенные события:
+// без неё реплика отвечала бы 404 на существующий заказ до перезапуска
+func (s *Cache) SyncBloomFilter(ctx context.Context) (int, error) {
+	s.bloom.mu.RLock()
+	ready, since := s.bloom.filter != nil, s.bloom.syncedAt
+	s.bloom.mu.RUnlock()
+	if !ready {
+		return 0, nil
+	}
+
+	startedAt := time.Now()
+	uids, err := s.OrderTaker.GetOrderUIDsUpdatedSince(ctx, since.Add(-bloomSyncOverlap))
+	if err != nil {
+		return 0, fmt.Errorf("error occured while tryed sync bloom filter: %w", err)
+	}
+	for _, UID := range uids {
+		s.bloom.add(UID)
+	}
+
+	s.bloom.mu.Lock()
+	s.bloom.syncedAt = startedAt
+	s.bloom.mu.Unlock()
+	return len(uids), nil
+}
+
+// RunBloomSync сверяет фильтр с хранилищем каждые interval, пока не отменён ctx
+func (s *Cache) RunBloomSync(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if _, err := s.SyncBloomFilter(ctx); err != nil {
+				slog.Error("Failed to sync bloom filter", "error", err)
+			}
+		}
+	}
+}
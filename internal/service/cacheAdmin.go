@@ -0,0 +1,94 @@
+package service
+
+import (
+	"context"
+	"log/slog"
+	"slices"
+
+	"github.com/Asus/L0_DemoServise/internal/entity"
+)
+
+// методы для ручного управления кэшем через админские эндпоинты
+
+// Entries возвращает UID всех заказов в кэше, сначала те, к которым обращались последними
+func (s *Cache) Entries(ctx context.Context) []entity.CacheEntry {
+	var entries []entity.CacheEntry
+	for _, sh := range s.shards {
+		sh.lock()
+		for uid, lastAccess := range sh.lastAccess {
+			entries = append(entries, entity.CacheEntry{OrderUID: uid, LastAccess: lastAccess, SizeBytes: sh.sizes[uid]})
+		}
+		sh.mu.Unlock()
+	}
+	slices.SortFunc(entries, func(a, b entity.CacheEntry) int {
+		return b.LastAccess.Compare(a.LastAccess)
+	})
+	return entries
+}
+
+// Evict удаляет заказ из кэша, false - если его там не было
+func (s *Cache) Evict(ctx context.Context, UID string) bool {
+	sh := s.shard(UID)
+	sh.lock()
+	defer sh.mu.Unlock()
+
+	if _, exists := sh.orders[UID]; !exists {
+		return false
+	}
+	sh.policy.Remove(UID)
+	sh.remove(UID)
+	slog.InfoContext(ctx, "Order evicted from cache manually", "order_uid", UID)
+	return true
+}
+
+// Flush очищает кэш и возвращает, сколько заказов было удалено
+func (s *Cache) Flush(ctx context.Context) int {
+	n := 0
+	for _, sh := range s.shards {
+		sh.lock()
+		n += len(sh.orders)
+		for UID := range sh.orders {
+			sh.policy.Remove(UID)
+		}
+		sh.reset()
+		sh.mu.Unlock()
+	}
+	s.notFound.reset()
+	slog.InfoContext(ctx, "Cache flushed", "orders_removed", n)
+	return n
+}
+
+func (s *Cache) Stats() entity.CacheStats {
+	stats := entity.CacheStats{
+		Capacity: s.cacheCap,
+		MaxBytes: s.maxBytes,
+		Shards:   len(s.shards),
+
+		NegativeHits: s.negativeHits.Load(),
+
+		BloomRejects:        s.bloomRejects.Load(),
+		BloomFalsePositives: s.bloomFalse.Load(),
+	}
+	for _, sh := range s.shards {
+		sh.mu.RLock()
+		stats.Size += len(sh.orders)
+		stats.Bytes += sh.usedBytes
+		stats.Hits += sh.hits.Load()
+		stats.Misses += sh.misses.Load()
+		stats.Evictions += sh.evictions
+		sh.mu.RUnlock()
+	}
+
+	var (
+		fpRate     float64
+		bloomBytes int
+	)
+	s.bloom.mu.RLock()
+	if filter := s.bloom.filter; filter != nil {
+		fpRate, bloomBytes = filter.FalsePositiveRate(), filter.SizeBytes()
+	}
+	s.bloom.mu.RUnlock()
+
+	stats.BloomFPRate, stats.BloomBytes = fpRate, bloomBytes
+	return stats
+}
@@ -0,0 +1,235 @@
+package service
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Asus/L0_DemoServise/internal/entity"
+)
+
+// accessBufferSize - сколько обращений шард копит до передачи политике
+const accessBufferSize = 128
+
+// cacheShard - часть кэша со своей блокировкой и своей политикой вытеснения.
+// Заказ всегда попадает в шард по хэшу UID, поэтому обращения к разным шардам не ждут друг друга,
+// а чтения одного шарда идут под RLock и не ждут друг друга тоже
+type cacheShard struct {
+	mu         sync.RWMutex
+	orders     map[string]entity.Order
+	lastAccess map[string]time.Time // время последнего обращения к заказу, для админки
+	policy     EvictionPolicy       // решает, какой заказ этого шарда вытеснить при заполнении
+	capacity   int
+	// режим бюджета памяти: maxBytes > 0 - шард ограничен оценкой размера заказов, а не их числом
+	maxBytes  int64
+	usedBytes int64
+	sizes     map[string]int64 // оценка размера каждого заказа в шарде
+
+	// обращения, ещё не переданные политике. Под RLock политику менять нельзя, поэтому чтение кладёт
+	// обращение в буфер, а политика получает его при следующей записи в шард (lock). Если буфер полон,
+	// а шард занят записью, обращение теряется: порядок вытеснения приблизителен, зато попадания
+	// не выстраиваются в очередь за одной блокировкой
+	accesses chan access
+
+	hits      atomic.Uint64
+	misses    atomic.Uint64
+	evictions uint64 // меняется под mu
+}
+
+// access - обращение к заказу, ожидающее передачи политике
+type access struct {
+	UID string
+	at  time.Time
+}
+
+func newCacheShard(capacity int, policy EvictionPolicy) *cacheShard {
+	sh := &cacheShard{policy: policy, capacity: capacity, accesses: make(chan access, accessBufferSize)}
+	sh.reset()
+	return sh
+}
+
+// reset очищает map шарда, политику вызывающий обновляет сам. Вызывается под sh.mu
+func (sh *cacheShard) reset() {
+	sh.orders = make(map[string]entity.Order, sh.capacity)
+	sh.lastAccess = make(map[string]time.Time, sh.capacity)
+	sh.sizes = make(map[string]int64, sh.capacity)
+	sh.usedBytes = 0
+}
+
+// get возвращает заказ и отмечает обращение к нему. Если заказ успел устареть (TTL),
+// он удаляется и возвращается false - тогда заказ нужно перечитать из хранилища
+func (sh *cacheShard) get(UID string) (entity.Order, bool) {
+	sh.mu.RLock()
+	ord, exists := sh.orders[UID]
+	expired := false
+	if exp, ok := sh.policy.(expiringPolicy); ok && exists {
+		expired = exp.Expired(UID)
+	}
+	sh.mu.RUnlock()
+
+	if !exists {
+		sh.misses.Add(1)
+		return entity.Order{}, false
+	}
+	if expired {
+		sh.lock()
+		// пока блокировка была отпущена, заказ могли удалить или заменить свежим
+		if _, exists := sh.orders[UID]; exists && sh.policy.(expiringPolicy).Expired(UID) {
+			sh.policy.Remove(UID)
+			sh.remove(UID)
+		}
+		sh.mu.Unlock()
+		sh.misses.Add(1)
+		return entity.Order{}, false
+	}
+
+	sh.recordAccess(access{UID: UID, at: time.Now()})
+	sh.hits.Add(1)
+	return ord, true
+}
+
+// recordAccess кладёт обращение в буфер. Полный буфер сливается в политику, если шард свободен,
+// иначе обращение теряется
+func (sh *cacheShard) recordAccess(a access) {
+	select {
+	case sh.accesses <- a:
+		return
+	default:
+	}
+	if sh.mu.TryLock() {
+		sh.drainAccesses()
+		sh.touch(a)
+		sh.mu.Unlock()
+	}
+}
+
+// lock берёт блокировку на запись и передаёт политике накопленные обращения,
+// так что политика видит все обращения, сделанные до записи. Отпускается через sh.mu.Unlock
+func (sh *cacheShard) lock() {
+	sh.mu.Lock()
+	sh.drainAccesses()
+}
+
+// drainAccesses передаёт политике обращения из буфера. Вызывается под sh.mu
+func (sh *cacheShard) drainAccesses() {
+	for {
+		select {
+		case a := <-sh.accesses:
+			sh.touch(a)
+		default:
+			return
+		}
+	}
+}
+
+// touch отмечает обращение, если заказ ещё в шарде. Вызывается под sh.mu
+func (sh *cacheShard) touch(a access) {
+	if _, exists := sh.orders[a.UID]; !exists {
+		return
+	}
+	sh.policy.Touch(a.UID)
+	sh.lastAccess[a.UID] = a.at
+}
+
+// peek возвращает заказ, не считая это обращением
+func (sh *cacheShard) peek(UID string) (entity.Order, bool) {
+	sh.mu.RLock()
+	defer sh.mu.RUnlock()
+
+	ord, exists := sh.orders[UID]
+	return ord, exists
+}
+
+// put кладёт заказ в шард, если заказ уже там - заменяет его и считает это обращением.
+// Вызывается под sh.mu
+func (sh *cacheShard) put(ctx context.Context, ord entity.Order) {
+	UID := ord.OrderUID
+	var size int64
+	if sh.maxBytes > 0 {
+		size = orderSize(ord)
+		if size > sh.maxBytes {
+			// ради такого заказа пришлось бы вытеснить весь шард
+			slog.WarnContext(ctx, "Order is larger than the cache budget, not cached", "order_uid", UID, "size_bytes", size, "max_bytes", sh.maxBytes)
+			if _, exists := sh.orders[UID]; exists {
+				sh.policy.Remove(UID)
+				sh.remove(UID)
+			}
+			return
+		}
+	}
+
+	if _, exists := sh.orders[UID]; exists {
+		sh.orders[UID] = ord
+		sh.lastAccess[UID] = time.Now()
+		sh.usedBytes += size - sh.sizes[UID]
+		sh.sizes[UID] = size
+		sh.policy.Add(UID)
+		// новая версия заказа могла оказаться больше старой
+		for sh.maxBytes > 0 && sh.usedBytes > sh.maxBytes {
+			if !sh.evictOne(ctx, UID) {
+				break
+			}
+		}
+		return
+	}
+
+	// Если шард заполнен, вытесняем заказы, выбранные политикой.
+	for sh.full(size) {
+		if !sh.evictOne(ctx, UID) {
+			break
+		}
+	}
+
+	// Добавляем новый элемент.
+	sh.policy.Add(UID)
+	sh.orders[UID] = ord
+	sh.lastAccess[UID] = time.Now()
+	sh.usedBytes += size
+	sh.sizes[UID] = size
+	slog.InfoContext(ctx, "Order added to cache", "order_uid", UID)
+}
+
+// full - для заказа размером size нет места. Вызывается под sh.mu
+func (sh *cacheShard) full(size int64) bool {
+	if sh.maxBytes > 0 {
+		return len(sh.orders) > 0 && sh.usedBytes+size > sh.maxBytes
+	}
+	return len(sh.orders) >= sh.capacity
+}
+
+// evictOne вытесняет заказ, выбранный политикой, false - вытеснять нечего. Вызывается под sh.mu
+func (sh *cacheShard) evictOne(ctx context.Context, incoming string) bool {
+	UID, ok := sh.policy.Evict(incoming)
+	if !ok {
+		return false
+	}
+	slog.InfoContext(ctx, "Evicting order from cache", "order_uid", UID)
+	sh.remove(UID)
+	sh.evictions++
+	return true
+}
+
+// remove удаляет заказ из map шарда, политику вызывающий обновляет сам. Вызывается под sh.mu
+func (sh *cacheShard) remove(UID string) {
+	delete(sh.orders, UID)
+	delete(sh.lastAccess, UID)
+	sh.usedBytes -= sh.sizes[UID]
+	delete(sh.sizes, UID)
+}
+
+// shardIndex - номер шарда для UID: FNV-1a по байтам строки без лишних аллокаций,
+// mask = число шардов - 1, число шардов - степень двойки
+func shardIndex(UID string, mask uint32) uint32 {
+	const (
+		offset32 = 2166136261
+		prime32  = 16777619
+	)
+	h := uint32(offset32)
+	for i := 0; i < len(UID); i++ {
+		h ^= uint32(UID[i])
+		h *= prime32
+	}
+	return h & mask
+}
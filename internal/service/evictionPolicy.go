@@ -0,0 +1,62 @@
+package service
+
+import (
+	"fmt"
+	"time"
+)
+
+// названия политик вытеснения для config.Config.CachePolicy
+const (
+	PolicyLRU = "lru"
+	PolicyLFU = "lfu"
+	PolicyTTL = "ttl"
+	PolicyARC = "arc"
+)
+
+// EvictionPolicy решает, какой заказ вытеснить, когда кэш заполнен.
+// Политика хранит только UID, сами заказы лежат в Cache. Методы вызываются под блокировкой кэша,
+// поэтому реализации не обязаны быть потокобезопасными
+type EvictionPolicy interface {
+	Add(UID string)    // заказ добавлен в кэш
+	Touch(UID string)  // к заказу в кэше обратились
+	Remove(UID string) // заказ удалён из кэша в обход политики (например, через админку)
+	// Evict выбирает заказ для вытеснения перед добавлением incoming и перестаёт его отслеживать
+	Evict(incoming string) (UID string, ok bool)
+	Len() int
+}
+
+// expiringPolicy - политика, у которой заказы устаревают сами по себе (TTL)
+type expiringPolicy interface {
+	Expired(UID string) bool
+}
+
+// NewEvictionPolicy создаёт политику по названию из конфига, пустое название - LRU
+func NewEvictionPolicy(name string, capacity int, ttl time.Duration) (EvictionPolicy, error) {
+	switch name {
+	case "", PolicyLRU:
+		return NewLRUPolicy(), nil
+	case PolicyLFU:
+		return NewLFUPolicy(), nil
+	case PolicyTTL:
+		if ttl <= 0 {
+			return nil, fmt.Errorf("cache_ttl must be positive for %q policy", PolicyTTL)
+		}
+		return NewTTLPolicy(ttl), nil
+	case PolicyARC:
+		return NewARCPolicy(capacity), nil
+	default:
+		return nil, fmt.Errorf("unknown cache policy %q, expected one of %q, %q, %q, %q", name, PolicyLRU, PolicyLFU, PolicyTTL, PolicyARC)
+	}
+}
+
+// NewPolicyFactory проверяет название политики из конфига и возвращает конструктор
+// политики для шардов кэша
+func NewPolicyFactory(name string, ttl time.Duration) (PolicyFactory, error) {
+	if _, err := NewEvictionPolicy(name, 1, ttl); err != nil {
+		return nil, err
+	}
+	return func(capacity int) EvictionPolicy {
+		policy, _ := NewEvictionPolicy(name, capacity, ttl)
+		return policy
+	}, nil
+}
@@ -6,7 +6,8 @@ import (
 )
 
 type OrderCache interface {
-	GiveOrderByUID(UID string) (entity.Order, error)
-	SaveOrder(ctx context.Context, o entity.Order) error
+	GiveOrderByUID(ctx context.Context, UID string) (entity.Order, error)
+	SaveOrder(ctx context.Context, o entity.Order) (entity.SaveResult, error)
 	LoadCache(ctx context.Context) error
+	SearchOrders(ctx context.Context, q entity.OrderSearch) (entity.OrderPage, error)
 }
\ No newline at end of file
@@ -0,0 +1,123 @@
+package service
+
+import (
+	"context"
+	"log/slog"
+
+	"github.com/Asus/L0_DemoServise/internal/entity"
+)
+
+// InvalidationPublisher рассылает остальным репликам событие о том, что заказ изменился
+type InvalidationPublisher interface {
+	PublishInvalidation(ctx context.Context, UID string, action entity.InvalidationAction) error
+}
+
+// EnableInvalidationFanOut включает рассылку событий о сохранённых заказах через publisher.
+// Вызывается до начала работы с кэшем
+func (s *Cache) EnableInvalidationFanOut(publisher InvalidationPublisher) {
+	s.publisher = publisher
+}
+
+// ApplyInvalidation применяет событие другой реплики: заказ удаляется из кэша и будет перечитан
+// из хранилища при следующем обращении. Сохранённый заказ к тому же больше не "неизвестен":
+// он попадает в фильтр Блума и пропадает из негативного кэша
+func (s *Cache) ApplyInvalidation(ctx context.Context, ev entity.CacheInvalidation) {
+	if ev.Action == entity.InvalidationSaved {
+		s.bloom.add(ev.OrderUID)
+	}
+	s.notFound.invalidate(ev.OrderUID)
+	if s.forget(ev.OrderUID) {
+		slog.DebugContext(ctx, "Order invalidated by another replica", "order_uid", ev.OrderUID, "origin", ev.Origin)
+	}
+}
+
+// Forget удаляет устаревшую копию заказа из кэша, следующее обращение перечитает его из хранилища
+func (s *Cache) Forget(ctx context.Context, UID string) {
+	s.forget(UID)
+}
+
+// Refresh заменяет копию заказа в кэше свежей версией из хранилища. Если прочитать заказ не удалось,
+// в кэше его просто не будет до следующего обращения
+func (s *Cache) Refresh(ctx context.Context, UID string) {
+	s.forget(UID)
+	if _, err := s.load(ctx, UID); err != nil {
+		slog.WarnContext(ctx, "Failed to refresh cached order", "order_uid", UID, "error", err)
+	}
+}
+
+// forget удаляет заказ из шарда, false - заказа в кэше не было
+func (s *Cache) forget(UID string) bool {
+	// загрузки, начатые раньше, могли прочитать старую версию - в кэш они её не положат
+	s.invalidations.Add(1)
+
+	sh := s.shard(UID)
+	sh.lock()
+	defer sh.mu.Unlock()
+	if _, exists := sh.orders[UID]; !exists {
+		return false
+	}
+	sh.policy.Remove(UID)
+	sh.remove(UID)
+	return true
+}
+
+// EnableInvalidationFanOut включает рассылку событий о сохранённых заказах через publisher.
+// Сам Redis общий, события нужны для near-cache и негативного кэша других реплик
+func (s *RedisCache) EnableInvalidationFanOut(publisher InvalidationPublisher) {
+	s.publisher = publisher
+}
+
+// ApplyInvalidation применяет событие другой реплики: в Redis уже лежит новая версия,
+// локально устарели только near-cache и негативный кэш
+func (s *RedisCache) ApplyInvalidation(ctx context.Context, ev entity.CacheInvalidation) {
+	s.notFound.invalidate(ev.OrderUID)
+	s.nearRemove(ev.OrderUID)
+}
+
+// Forget удаляет устаревшую копию заказа из Redis и near-cache и меняет поколение заказа:
+// загрузки, которые прочитали его из хранилища раньше, на любой реплике уже не положат его в Redis.
+// Redis общий, поэтому остальным репликам остаётся сбросить только свои near-cache
+func (s *RedisCache) Forget(ctx context.Context, UID string) {
+	s.nearRemove(UID)
+
+	generationKey := redisGenerationPrefix + UID
+	pipe := s.client.TxPipeline()
+	pipe.Incr(ctx, generationKey)
+	pipe.PExpire(ctx, generationKey, redisGenerationTTL)
+	pipe.Del(ctx, redisKeyPrefix+UID)
+	if _, err := pipe.Exec(ctx); err != nil {
+		slog.WarnContext(ctx, "Failed to delete order from redis cache", "order_uid", UID, "error", err)
+	}
+}
+
+// Refresh заменяет копию заказа в Redis и near-cache свежей версией из хранилища.
+// Если прочитать заказ не удалось, в Redis его не будет до следующего обращения
+func (s *RedisCache) Refresh(ctx context.Context, UID string) {
+	s.Forget(ctx, UID)
+	if _, err := s.load(ctx, UID, true); err != nil {
+		slog.WarnContext(ctx, "Failed to refresh cached order", "order_uid", UID, "error", err)
+	}
+}
+
+// publishSaved сообщает другим репликам о сохранённом заказе. Дубликат ничего не изменил,
+// отклонённая версия не сохранена - о них сообщать незачем. Ошибка только логируется:
+// заказ уже сохранён, а другие реплики в худшем случае отдадут старую копию до её вытеснения
+func publishSaved(ctx context.Context, publisher InvalidationPublisher, UID string, result entity.SaveResult) {
+	if publisher == nil || (result != entity.SaveInserted && result != entity.SaveUpdated) {
+		return
+	}
+	if err := publisher.PublishInvalidation(ctx, UID, entity.InvalidationSaved); err != nil {
+		slog.WarnContext(ctx, "Failed to publish cache invalidation", "order_uid", UID, "error", err)
+	}
+}
+
+// refreshChanged обновляет копию изменённого заказа в своём кэше и сообщает об изменении другим репликам
+func refreshChanged(ctx context.Context, cache orderRefresher, publisher InvalidationPublisher, UID string) {
+	cache.Refresh(ctx, UID)
+	if publisher == nil {
+		return
+	}
+	if err := publisher.PublishInvalidation(ctx, UID, entity.InvalidationSaved); err != nil {
+		slog.WarnContext(ctx, "Failed to publish cache invalidation", "order_uid", UID, "error", err)
+	}
+}
@@ -0,0 +1,96 @@
+package service
+
+import "container/list"
+
+type lfuEntry struct {
+	UID  string
+	freq int
+}
+
+// LFUPolicy вытесняет заказ с наименьшим числом обращений, среди равных - самый давний.
+// Заказы разложены по спискам-"корзинам" с одинаковой частотой, поэтому Add и Touch работают за O(1)
+type LFUPolicy struct {
+	elements map[string]*list.Element // Value - *lfuEntry
+	buckets  map[int]*list.List       // частота -> заказы, в начале самые свежие
+	minFreq  int
+}
+
+func NewLFUPolicy() *LFUPolicy {
+	return &LFUPolicy{
+		elements: make(map[string]*list.Element),
+		buckets:  make(map[int]*list.List),
+	}
+}
+
+func (p *LFUPolicy) Add(UID string) {
+	if _, ok := p.elements[UID]; ok {
+		p.Touch(UID)
+		return
+	}
+	p.elements[UID] = p.bucket(1).PushFront(&lfuEntry{UID: UID, freq: 1})
+	p.minFreq = 1
+}
+
+func (p *LFUPolicy) Touch(UID string) {
+	elem, ok := p.elements[UID]
+	if !ok {
+		return
+	}
+	entry := elem.Value.(*lfuEntry)
+	p.unlink(elem)
+	entry.freq++
+	p.elements[UID] = p.bucket(entry.freq).PushFront(entry)
+	if p.minFreq == 0 || entry.freq < p.minFreq {
+		p.minFreq = entry.freq
+	}
+}
+
+func (p *LFUPolicy) Remove(UID string) {
+	if elem, ok := p.elements[UID]; ok {
+		p.unlink(elem)
+		delete(p.elements, UID)
+	}
+}
+
+func (p *LFUPolicy) Evict(incoming string) (string, bool) {
+	bucket, ok := p.buckets[p.minFreq]
+	if !ok {
+		return "", false
+	}
+	elem := bucket.Back()
+	UID := elem.Value.(*lfuEntry).UID
+	p.unlink(elem)
+	delete(p.elements, UID)
+	return UID, true
+}
+
+func (p *LFUPolicy) Len() int { return len(p.elements) }
+
+func (p *LFUPolicy) bucket(freq int) *list.List {
+	bucket, ok := p.buckets[freq]
+	if !ok {
+		bucket = list.New()
+		p.buckets[freq] = bucket
+	}
+	return bucket
+}
+
+// unlink убирает элемент из его корзины, пустые корзины удаляются, minFreq пересчитывается
+func (p *LFUPolicy) unlink(elem *list.Element) {
+	freq := elem.Value.(*lfuEntry).freq
+	bucket := p.buckets[freq]
+	bucket.Remove(elem)
+	if bucket.Len() > 0 {
+		return
+	}
+	delete(p.buckets, freq)
+	if freq != p.minFreq {
+		return
+	}
+	p.minFreq = 0
+	for f := range p.buckets {
+		if p.minFreq == 0 || f < p.minFreq {
+			p.minFreq = f
+		}
+	}
+}
@@ -0,0 +1,50 @@
+package service
+
+import "container/list"
+
+// LRUPolicy вытесняет заказ, к которому дольше всех не обращались.
+// Двусвязный список (в начале - самые свежие) + map до элементов списка, все операции O(1)
+type LRUPolicy struct {
+	order    *list.List
+	elements map[string]*list.Element
+}
+
+func NewLRUPolicy() *LRUPolicy {
+	return &LRUPolicy{
+		order:    list.New(),
+		elements: make(map[string]*list.Element),
+	}
+}
+
+func (p *LRUPolicy) Add(UID string) {
+	if elem, ok := p.elements[UID]; ok {
+		p.order.MoveToFront(elem)
+		return
+	}
+	p.elements[UID] = p.order.PushFront(UID)
+}
+
+func (p *LRUPolicy) Touch(UID string) {
+	if elem, ok := p.elements[UID]; ok {
+		p.order.MoveToFront(elem)
+	}
+}
+
+func (p *LRUPolicy) Remove(UID string) {
+	if elem, ok := p.elements[UID]; ok {
+		p.order.Remove(elem)
+		delete(p.elements, UID)
+	}
+}
+
+func (p *LRUPolicy) Evict(incoming string) (string, bool) {
+	elem := p.order.Back()
+	if elem == nil {
+		return "", false
+	}
+	UID := p.order.Remove(elem).(string)
+	delete(p.elements, UID)
+	return UID, true
+}
+
+func (p *LRUPolicy) Len() int { return p.order.Len() }
@@ -0,0 +1,92 @@
+package service
+
+import (
+	"sync"
+	"time"
+)
+
+// negativeCache помнит UID, которых нет в хранилище, чтобы повторные запросы
+// несуществующих заказов (сканеры, опечатки в ссылках) не доходили до БД.
+// Размер ограничен, записи живут не дольше ttl. Методы можно вызывать у nil - тогда кэш выключен
+type negativeCache struct {
+	mu       sync.Mutex
+	capacity int
+	ttl      time.Duration
+	entries  *TTLPolicy // при переполнении вытесняется запись, которая устареет первой
+	// generation растёт при каждой инвалидации, см. addIfUnchanged
+	generation uint64
+}
+
+func newNegativeCache(capacity int, ttl time.Duration) *negativeCache {
+	return &negativeCache{capacity: capacity, ttl: ttl, entries: NewTTLPolicy(ttl)}
+}
+
+// contains - UID недавно не нашёлся в хранилище
+func (n *negativeCache) contains(UID string) bool {
+	if n == nil {
+		return false
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if !n.entries.Contains(UID) {
+		return false
+	}
+	if n.entries.Expired(UID) {
+		n.entries.Remove(UID)
+		return false
+	}
+	return true
+}
+
+// currentGeneration запоминается перед запросом к хранилищу
+func (n *negativeCache) currentGeneration() uint64 {
+	if n == nil {
+		return 0
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.generation
+}
+
+// addIfUnchanged запоминает ненайденный UID, если с момента generation не было инвалидаций.
+// Иначе заказ мог сохраниться, пока шёл запрос к БД, и запись "не найден" была бы ложной
+func (n *negativeCache) addIfUnchanged(UID string, generation uint64) {
+	if n == nil {
+		return
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if n.generation != generation {
+		return
+	}
+	if !n.entries.Contains(UID) && n.entries.Len() >= n.capacity {
+		n.entries.Evict(UID)
+	}
+	n.entries.Add(UID)
+}
+
+// invalidate забывает UID, например когда заказ с ним сохранён
+func (n *negativeCache) invalidate(UID string) {
+	if n == nil {
+		return
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.generation++
+	n.entries.Remove(UID)
+}
+
+// reset забывает все UID
+func (n *negativeCache) reset() {
+	if n == nil {
+		return
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.generation++
+	n.entries = NewTTLPolicy(n.ttl)
+}
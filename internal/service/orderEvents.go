@@ -0,0 +1,81 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/Asus/L0_DemoServise/internal/entity"
+)
+
+var (
+	// состав заказа и доставку можно менять, пока заказ не отгружен
+	editableStatuses = []entity.OrderStatus{entity.StatusCreated, entity.StatusPaid, entity.StatusAssembled}
+	// вернуть можно только товары, которые уже отгружены
+	returnableStatuses = []entity.OrderStatus{entity.StatusShipped, entity.StatusDelivered}
+)
+
+type eventStorage interface {
+	UpdateOrder(ctx context.Context, UID string, patch entity.OrderPatch, allowed []entity.OrderStatus) error
+	ChangeDelivery(ctx context.Context, UID string, d entity.Delivery, allowed []entity.OrderStatus) error
+	ReturnItems(ctx context.Context, UID string, rids []string, returnedAt time.Time, allowed []entity.OrderStatus) error
+}
+
+// OrderEvents применяет к сохранённым заказам события изменения, возврата и отмены.
+// После каждого изменения копия заказа в кэше заменяется свежей
+type OrderEvents struct {
+	storage   eventStorage
+	cache     orderRefresher
+	statuses  *StatusService        // отмена - это смена статуса
+	publisher InvalidationPublisher // сообщает другим репликам об изменении; nil - не сообщаем
+}
+
+func NewOrderEvents(storage eventStorage, cache orderRefresher, statuses *StatusService) *OrderEvents {
+	return &OrderEvents{storage: storage, cache: cache, statuses: statuses}
+}
+
+// EnableInvalidationFanOut включает рассылку событий об изменённых заказах через publisher
+func (s *OrderEvents) EnableInvalidationFanOut(publisher InvalidationPublisher) {
+	s.publisher = publisher
+}
+
+// UpdateOrder меняет переданные в patch поля заказа
+func (s *OrderEvents) UpdateOrder(ctx context.Context, UID string, patch entity.OrderPatch) error {
+	if err := s.storage.UpdateOrder(ctx, UID, patch, editableStatuses); err != nil {
+		return fmt.Errorf("failed to update order %s: %w", UID, err)
+	}
+	slog.InfoContext(ctx, "Order updated", "order_uid", UID)
+	refreshChanged(ctx, s.cache, s.publisher, UID)
+	return nil
+}
+
+// ChangeDelivery заменяет адрес и контакты доставки заказа
+func (s *OrderEvents) ChangeDelivery(ctx context.Context, UID string, d entity.Delivery) error {
+	if err := s.storage.ChangeDelivery(ctx, UID, d, editableStatuses); err != nil {
+		return fmt.Errorf("failed to change delivery of order %s: %w", UID, err)
+	}
+	slog.InfoContext(ctx, "Order delivery changed", "order_uid", UID)
+	refreshChanged(ctx, s.cache, s.publisher, UID)
+	return nil
+}
+
+// ReturnItems отмечает товары заказа возвращёнными
+func (s *OrderEvents) ReturnItems(ctx context.Context, UID string, ret entity.ItemsReturn) error {
+	if err := s.storage.ReturnItems(ctx, UID, ret.Rids, ret.ReturnedAt, returnableStatuses); err != nil {
+		return fmt.Errorf("failed to return items of order %s: %w", UID, err)
+	}
+	slog.InfoContext(ctx, "Order items returned", "order_uid", UID, "items", len(ret.Rids), "reason", ret.Reason)
+	refreshChanged(ctx, s.cache, s.publisher, UID)
+	return nil
+}
+
+// CancelOrder отменяет заказ через state machine статусов
+func (s *OrderEvents) CancelOrder(ctx context.Context, UID string, c entity.Cancellation) error {
+	_, err := s.statuses.ChangeStatus(ctx, entity.StatusEvent{
+		OrderUID: UID,
+		Status:   entity.StatusCancelled,
+		Reason:   c.Reason,
+	})
+	return err
+}
@@ -0,0 +1,41 @@
+package service
+
+import (
+	"reflect"
+	"unsafe"
+
+	"github.com/Asus/L0_DemoServise/internal/entity"
+)
+
+// cacheEntryOverhead - примерная память на служебные записи кэша для одного заказа:
+// элементы map orders и lastAccess шарда, узел политики вытеснения
+const cacheEntryOverhead = 256
+
+// orderSize оценивает, сколько памяти занимает заказ в кэше: сама структура плюс всё,
+// на что ссылаются её строки и слайсы (товары). Оценка обходит поля через reflect,
+// поэтому новые поля заказа учитываются без правок здесь
+func orderSize(o entity.Order) int64 {
+	return int64(unsafe.Sizeof(o)) + indirectSize(reflect.ValueOf(o)) + int64(len(o.OrderUID)) + cacheEntryOverhead
+}
+
+// indirectSize - память за пределами самого значения v: байты строк и массивы слайсов
+func indirectSize(v reflect.Value) int64 {
+	switch v.Kind() {
+	case reflect.String:
+		return int64(v.Len())
+	case reflect.Slice:
+		size := int64(v.Cap()) * int64(v.Type().Elem().Size())
+		for i := range v.Len() {
+			size += indirectSize(v.Index(i))
+		}
+		return size
+	case reflect.Struct:
+		var size int64
+		for i := range v.NumField() {
+			size += indirectSize(v.Field(i))
+		}
+		return size
+	default:
+		return 0 // числа лежат в самой структуре, указатели (time.Location) общие для всех заказов
+	}
+}
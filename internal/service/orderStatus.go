@@ -0,0 +1,111 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/Asus/L0_DemoServise/internal/entity"
+)
+
+// жизненный цикл заказа: created -> paid -> assembled -> shipped -> delivered,
+// отменить можно до отгрузки, вернуть - уже отгруженный или доставленный заказ
+var transitions = map[entity.OrderStatus][]entity.OrderStatus{
+	entity.StatusCreated:   {entity.StatusPaid, entity.StatusCancelled},
+	entity.StatusPaid:      {entity.StatusAssembled, entity.StatusCancelled},
+	entity.StatusAssembled: {entity.StatusShipped, entity.StatusCancelled},
+	entity.StatusShipped:   {entity.StatusDelivered, entity.StatusReturned},
+	entity.StatusDelivered: {entity.StatusReturned},
+	entity.StatusCancelled: nil,
+	entity.StatusReturned:  nil,
+}
+
+// CanTransition проверяет, можно ли перевести заказ из статуса from в статус to
+func CanTransition(from, to entity.OrderStatus) error {
+	if _, known := transitions[to]; !known {
+		return fmt.Errorf("%w: unknown status %q", entity.ErrInvalidTransition, to)
+	}
+	next, known := transitions[from]
+	if !known {
+		return fmt.Errorf("%w: unknown status %q", entity.ErrInvalidTransition, from)
+	}
+	for _, status := range next {
+		if status == to {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: %s -> %s", entity.ErrInvalidTransition, from, to)
+}
+
+type statusStorage interface {
+	GetOrderStatus(ctx context.Context, UID string) (entity.OrderStatus, error)
+	ChangeOrderStatus(ctx context.Context, change entity.StatusChange) error
+	GetStatusHistory(ctx context.Context, UID string) ([]entity.StatusChange, error)
+}
+
+// orderRefresher - кэш, в котором можно заменить устаревшую копию заказа
+type orderRefresher interface {
+	Refresh(ctx context.Context, UID string)
+}
+
+// StatusService меняет статусы заказов по state machine и отдаёт их историю
+type StatusService struct {
+	storage   statusStorage
+	cache     orderRefresher        // копия заказа в кэше устаревает при смене статуса
+	publisher InvalidationPublisher // сообщает другим репликам о смене статуса; nil - не сообщаем
+}
+
+func NewStatusService(storage statusStorage, cache orderRefresher) *StatusService {
+	return &StatusService{storage: storage, cache: cache}
+}
+
+// EnableInvalidationFanOut включает рассылку событий о смене статуса через publisher
+func (s *StatusService) EnableInvalidationFanOut(publisher InvalidationPublisher) {
+	s.publisher = publisher
+}
+
+// ChangeStatus переводит заказ в статус ev.Status. Повтор уже применённого события
+// (заказ уже в этом статусе) ничего не меняет и ошибкой не считается: Kafka доставляет
+// сообщения как минимум один раз
+func (s *StatusService) ChangeStatus(ctx context.Context, ev entity.StatusEvent) (entity.StatusChange, error) {
+	current, err := s.storage.GetOrderStatus(ctx, ev.OrderUID)
+	if err != nil {
+		return entity.StatusChange{}, fmt.Errorf("failed to read status of order %s: %w", ev.OrderUID, err)
+	}
+
+	change := entity.StatusChange{
+		OrderUID:  ev.OrderUID,
+		From:      current,
+		To:        ev.Status,
+		ChangedAt: ev.ChangedAt,
+		Reason:    ev.Reason,
+	}
+	if change.ChangedAt.IsZero() {
+		change.ChangedAt = time.Now()
+	}
+	if current == ev.Status {
+		slog.DebugContext(ctx, "Order already has this status, event skipped", "order_uid", ev.OrderUID, "status", ev.Status)
+		return change, nil
+	}
+	if err := CanTransition(current, ev.Status); err != nil {
+		return entity.StatusChange{}, fmt.Errorf("order %s: %w", ev.OrderUID, err)
+	}
+
+	if err := s.storage.ChangeOrderStatus(ctx, change); err != nil {
+		return entity.StatusChange{}, fmt.Errorf("failed to change status of order %s: %w", ev.OrderUID, err)
+	}
+	slog.InfoContext(ctx, "Order status changed", "order_uid", ev.OrderUID, "from", current, "to", ev.Status)
+
+	refreshChanged(ctx, s.cache, s.publisher, ev.OrderUID)
+	return change, nil
+}
+
+// StatusHistory возвращает историю статусов заказа от старых записей к новым
+func (s *StatusService) StatusHistory(ctx context.Context, UID string) ([]entity.StatusChange, error) {
+	history, err := s.storage.GetStatusHistory(ctx, UID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get status history of order %s: %w", UID, err)
+	}
+	return history, nil
+}
@@ -0,0 +1,430 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"sync/atomic"
+	"time"
+
+	"github.com/Asus/L0_DemoServise/internal/entity"
+	"github.com/redis/go-redis/v9"
+	"golang.org/x/sync/singleflight"
+)
+
+// бэкенды кэша для config.Config.CacheBackend
+const (
+	BackendMemory = "memory"
+	BackendRedis  = "redis"
+)
+
+// redisKeyPrefix - префикс ключей заказов в Redis, по нему админка находит и чистит кэш
+const redisKeyPrefix = "order:"
+
+// поколение заказа в Redis растёт при каждом его изменении. Загрузка из хранилища запоминает
+// поколение до чтения и кладёт заказ в Redis, только если оно не изменилось: версия, прочитанная
+// до изменения, не перезапишет новую ни на этой реплике, ни на других. Ключ поколения нужен,
+// пока идут начатые до изменения загрузки, поэтому живёт недолго
+const (
+	redisGenerationPrefix = "ordergen:"
+	redisGenerationTTL    = time.Minute
+)
+
+// setIfGeneration кладёт заказ в KEYS[1], только если поколение KEYS[2] равно ARGV[1]
+// (пустая строка - поколения нет). ARGV[2] - заказ, ARGV[3] - TTL в мс, ARGV[4] = "1" - SET NX.
+// 1 - заказ записан, 0 - поколение изменилось или при NX ключ уже есть
+var setIfGeneration = redis.NewScript(`
+local generation = redis.call('GET', KEYS[2]) or ''
+if generation ~= ARGV[1] then
+	return 0
+end
+if ARGV[4] == '1' then
+	if redis.call('SET', KEYS[1], ARGV[2], 'PX', ARGV[3], 'NX') then
+		return 1
+	end
+	return 0
+end
+redis.call('SET', KEYS[1], ARGV[2], 'PX', ARGV[3])
+return 1
+`)
+
+// redisSizeRefresh - как часто Stats спрашивает у Redis число ключей: метрики
+// снимаются при каждом запросе Prometheus, и DBSIZE на каждый из них не нужен
+const redisSizeRefresh = 10 * time.Second
+
+// RedisCache - кэш заказов в Redis, общий для всех реплик сервиса. Заказы хранятся в JSON,
+// каждое обращение продлевает TTL ключа. Перед Redis может стоять небольшой локальный near-cache:
+// он снимает сетевой запрос с самых горячих заказов, но может отставать от Redis на свой TTL
+type RedisCache struct {
+	client     redis.UniversalClient
+	OrderTaker getOrder
+	ttl        time.Duration // время жизни заказа в Redis без обращений
+	warmCount  int           // сколько последних заказов класть в Redis при старте
+	near       *cacheShard   // локальный near-cache; nil - не используется
+	notFound   *negativeCache
+	publisher  InvalidationPublisher // nil - события другим репликам не рассылаются
+	loads      singleflight.Group
+
+	hits         atomic.Uint64
+	misses       atomic.Uint64
+	negativeHits atomic.Uint64
+
+	dbSize        atomic.Int64 // последний ответ DBSIZE
+	sizeCheckedAt atomic.Int64 // когда его запрашивали, UnixNano
+}
+
+// NewRedisCache создаёт кэш поверх client: заказ живёт в Redis ttl с последнего обращения,
+// LoadCache кладёт туда warmCount самых новых заказов
+func NewRedisCache(client redis.UniversalClient, storage getOrder, warmCount int, ttl time.Duration) *RedisCache {
+	return &RedisCache{
+		client:     client,
+		OrderTaker: storage,
+		ttl:        ttl,
+		warmCount:  warmCount,
+	}
+}
+
+// EnableNearCache включает локальный кэш на size заказов, каждый живёт в нём ttl.
+// Вызывается до начала работы с кэшем
+func (s *RedisCache) EnableNearCache(size int, ttl time.Duration) {
+	s.near = newCacheShard(size, NewTTLPolicy(ttl))
+}
+
+// EnableNegativeCache включает запоминание ненайденных UID: до size записей, каждая живёт ttl.
+// Вызывается до начала работы с кэшем
+func (s *RedisCache) EnableNegativeCache(size int, ttl time.Duration) {
+	s.notFound = newNegativeCache(size, ttl)
+}
+
+// Close закрывает соединения с Redis
+func (s *RedisCache) Close() error {
+	return s.client.Close()
+}
+
+// LoadCache кладёт в Redis warmCount самых новых заказов. Реплики делают это независимо,
+// заказы, которые уже есть в Redis или недавно менялись, не перезаписываются
+func (s *RedisCache) LoadCache(ctx context.Context) error {
+	orders, err := s.OrderTaker.GetLastNOrders(ctx, s.warmCount)
+	if err != nil {
+		return fmt.Errorf("error occured while tryed load cache in service.RedisCache.LoadCache() %w", err)
+	}
+
+	pipe := s.client.Pipeline()
+	for _, ord := range orders {
+		data, err := json.Marshal(ord)
+		if err != nil {
+			return fmt.Errorf("failed to encode order %s: %w", ord.OrderUID, err)
+		}
+		// поколения до чтения не знаем, поэтому заказ, изменённый за последние redisGenerationTTL,
+		// пропускаем: его версия из запроса могла устареть
+		setIfGeneration.Run(ctx, pipe, s.generationKeys(ord.OrderUID), "", data, s.ttl.Milliseconds(), "1")
+	}
+	if _, err := pipe.Exec(ctx); err != nil && !errors.Is(err, redis.Nil) {
+		return fmt.Errorf("failed to warm redis cache: %w", err)
+	}
+	return nil
+}
+
+// GiveOrderByUID ищет заказ в near-cache, потом в Redis, потом в хранилище.
+// Недоступный Redis не ломает чтение: заказ просто берётся из хранилища
+func (s *RedisCache) GiveOrderByUID(ctx context.Context, UID string) (entity.Order, error) {
+	if ord, ok := s.nearGet(UID); ok {
+		s.hits.Add(1)
+		return ord, nil
+	}
+
+	ord, ok, err := s.get(ctx, UID)
+	if err != nil {
+		slog.WarnContext(ctx, "Redis cache is unavailable, reading order from storage", "order_uid", UID, "error", err)
+	}
+	if ok {
+		s.hits.Add(1)
+		s.nearPut(ctx, ord)
+		return ord, nil
+	}
+	s.misses.Add(1)
+
+	if s.notFound.contains(UID) {
+		s.negativeHits.Add(1)
+		return entity.Order{}, fmt.Errorf("order with UID %s: %w", UID, entity.ErrNotFound)
+	}
+
+	// одновременные промахи по одному UID объединяются в одну загрузку из хранилища
+	loaded := s.loads.DoChan(UID, func() (any, error) {
+		return s.load(ctx, UID, false)
+	})
+	select {
+	case res := <-loaded:
+		if res.Err != nil {
+			return entity.Order{}, res.Err
+		}
+		return res.Val.(entity.Order), nil
+	case <-ctx.Done():
+		return entity.Order{}, fmt.Errorf("error occurred while trying to get order with UID %s: %w", UID, ctx.Err())
+	}
+}
+
+// load читает заказ из хранилища и кладёт его в Redis, как Cache.load. overwrite = false - только если
+// в Redis заказа ещё нет, true - заменяя копию, которую туда успели положить после Forget
+func (s *RedisCache) load(ctx context.Context, UID string, overwrite bool) (entity.Order, error) {
+	loadCtx := context.WithoutCancel(ctx)
+	if deadline, ok := ctx.Deadline(); ok {
+		var cancel context.CancelFunc
+		loadCtx, cancel = context.WithDeadline(loadCtx, deadline)
+		defer cancel()
+	}
+
+	generation := s.notFound.currentGeneration()
+	version, versionErr := s.generation(loadCtx, UID)
+	ord, err := s.OrderTaker.GetOrderByUID(loadCtx, UID)
+	if err != nil {
+		if errors.Is(err, entity.ErrNotFound) {
+			s.notFound.addIfUnchanged(UID, generation)
+		}
+		return entity.Order{}, fmt.Errorf("error occurred while trying to get order with UID %s: %w", UID, err)
+	}
+	if versionErr != nil {
+		// без поколения не понять, не устарел ли заказ к моменту записи - отдаём, но не кэшируем
+		slog.WarnContext(ctx, "Failed to read order generation from redis", "order_uid", UID, "error", versionErr)
+		return ord, nil
+	}
+
+	// без overwrite - SET NX: пока шёл запрос к БД, другая реплика могла положить в Redis ту же версию
+	s.addIfUnchanged(loadCtx, ord, version, overwrite)
+	return ord, nil
+}
+
+// ищет заказы прямо в хранилище, как и Cache.SearchOrders
+func (s *RedisCache) SearchOrders(ctx context.Context, q entity.OrderSearch) (entity.OrderPage, error) {
+	page, err := s.OrderTaker.SearchOrders(ctx, q)
+	if err != nil {
+		return entity.OrderPage{}, fmt.Errorf("error occurred while searching orders: %w", err)
+	}
+	return page, nil
+}
+
+// сохраняет Order в БД и в Redis, отклонённую (SaveConflict) версию в кэш не кладём
+func (s *RedisCache) SaveOrder(ctx context.Context, o entity.Order) (entity.SaveResult, error) {
+	// поколение до записи: если заказ успеют изменить после неё, новый заказ в Redis не попадёт
+	version, versionErr := s.generation(ctx, o.OrderUID)
+	result, err := s.OrderTaker.SaveOrder(ctx, o)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to save order to database", "order_uid", o.OrderUID, "error", err)
+		return 0, fmt.Errorf("error occurred while trying to save order: %w", err)
+	}
+	s.notFound.invalidate(o.OrderUID)
+	switch result {
+	case entity.SaveInserted:
+		if versionErr == nil {
+			s.addIfUnchanged(ctx, asInserted(o), version, true)
+		} else {
+			slog.WarnContext(ctx, "Failed to read order generation from redis", "order_uid", o.OrderUID, "error", versionErr)
+		}
+	case entity.SaveUpdated, entity.SaveDuplicate:
+		s.Refresh(ctx, o.OrderUID) // статус заказа есть только в хранилище
+	}
+	publishSaved(ctx, s.publisher, o.OrderUID, result)
+	return result, nil
+}
+
+// get читает заказ из Redis и продлевает его TTL, false - заказа там нет
+func (s *RedisCache) get(ctx context.Context, UID string) (entity.Order, bool, error) {
+	data, err := s.client.GetEx(ctx, redisKeyPrefix+UID, s.ttl).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return entity.Order{}, false, nil
+	}
+	if err != nil {
+		return entity.Order{}, false, err
+	}
+	var ord entity.Order
+	if err := json.Unmarshal(data, &ord); err != nil {
+		return entity.Order{}, false, fmt.Errorf("failed to decode order %s from redis: %w", UID, err)
+	}
+	return ord, true, nil
+}
+
+// addIfUnchanged кладёт заказ в Redis и near-cache, только если поколение заказа всё ещё version,
+// overwrite = false - только если в Redis его ещё нет
+func (s *RedisCache) addIfUnchanged(ctx context.Context, ord entity.Order, version string, overwrite bool) {
+	data, err := json.Marshal(ord)
+	if err != nil {
+		slog.WarnContext(ctx, "Failed to put order to redis cache", "order_uid", ord.OrderUID, "error", err)
+		return
+	}
+	nx := "1"
+	if overwrite {
+		nx = ""
+	}
+	written, err := setIfGeneration.Run(ctx, s.client, s.generationKeys(ord.OrderUID), version, data, s.ttl.Milliseconds(), nx).Int()
+	if err != nil {
+		slog.WarnContext(ctx, "Failed to put order to redis cache", "order_uid", ord.OrderUID, "error", err)
+		return
+	}
+	if written == 1 {
+		s.nearPut(ctx, ord)
+	}
+}
+
+// generation - текущее поколение заказа, пустая строка - заказ давно не менялся
+func (s *RedisCache) generation(ctx context.Context, UID string) (string, error) {
+	version, err := s.client.Get(ctx, redisGenerationPrefix+UID).Result()
+	if errors.Is(err, redis.Nil) {
+		return "", nil
+	}
+	return version, err
+}
+
+// generationKeys - ключи заказа и его поколения для setIfGeneration
+func (s *RedisCache) generationKeys(UID string) []string {
+	return []string{redisKeyPrefix + UID, redisGenerationPrefix + UID}
+}
+
+func (s *RedisCache) nearGet(UID string) (entity.Order, bool) {
+	if s.near == nil {
+		return entity.Order{}, false
+	}
+	return s.near.get(UID)
+}
+
+func (s *RedisCache) nearPut(ctx context.Context, ord entity.Order) {
+	if s.near == nil {
+		return
+	}
+	s.near.lock()
+	defer s.near.mu.Unlock()
+	s.near.put(ctx, ord)
+}
+
+func (s *RedisCache) nearRemove(UID string) {
+	if s.near == nil {
+		return
+	}
+	s.near.lock()
+	defer s.near.mu.Unlock()
+	if _, exists := s.near.orders[UID]; exists {
+		s.near.policy.Remove(UID)
+		s.near.remove(UID)
+	}
+}
+
+// методы для админских эндпоинтов, ключи заказов ищутся через SCAN по префиксу
+
+// Entries возвращает UID всех заказов в Redis, сначала те, к которым обращались последними.
+// Время обращения восстанавливается по оставшемуся TTL, который каждое обращение продлевает
+func (s *RedisCache) Entries(ctx context.Context) []entity.CacheEntry {
+	keys, err := s.keys(ctx)
+	if err != nil {
+		slog.ErrorContext(ctx, "admin: failed to list redis cache", "error", err)
+		return nil
+	}
+
+	pipe := s.client.Pipeline()
+	ttls := make([]*redis.DurationCmd, len(keys))
+	for i, key := range keys {
+		ttls[i] = pipe.PTTL(ctx, key)
+	}
+	pipe.Exec(ctx)
+
+	now := time.Now()
+	entries := make([]entity.CacheEntry, 0, len(keys))
+	for i, key := range keys {
+		left, err := ttls[i].Result()
+		if err != nil || left < 0 {
+			continue // ключ успел истечь
+		}
+		entries = append(entries, entity.CacheEntry{
+			OrderUID:   key[len(redisKeyPrefix):],
+			LastAccess: now.Add(left - s.ttl),
+		})
+	}
+	slices.SortFunc(entries, func(a, b entity.CacheEntry) int {
+		return b.LastAccess.Compare(a.LastAccess)
+	})
+	return entries
+}
+
+// Evict удаляет заказ из Redis и near-cache, false - если его там не было
+func (s *RedisCache) Evict(ctx context.Context, UID string) bool {
+	s.nearRemove(UID)
+	n, err := s.client.Del(ctx, redisKeyPrefix+UID).Result()
+	if err != nil {
+		slog.ErrorContext(ctx, "admin: failed to evict order from redis cache", "order_uid", UID, "error", err)
+		return false
+	}
+	if n > 0 {
+		slog.InfoContext(ctx, "Order evicted from cache manually", "order_uid", UID)
+	}
+	return n > 0
+}
+
+// Flush удаляет из Redis все заказы и очищает near-cache, возвращает число удалённых заказов
+func (s *RedisCache) Flush(ctx context.Context) int {
+	if s.near != nil {
+		s.near.lock()
+		for UID := range s.near.orders {
+			s.near.policy.Remove(UID)
+		}
+		s.near.reset()
+		s.near.mu.Unlock()
+	}
+	s.notFound.reset()
+
+	keys, err := s.keys(ctx)
+	if err != nil {
+		slog.ErrorContext(ctx, "admin: failed to list redis cache", "error", err)
+		return 0
+	}
+	var removed int64
+	for chunk := range slices.Chunk(keys, 500) {
+		n, err := s.client.Del(ctx, chunk...).Result()
+		if err != nil {
+			slog.ErrorContext(ctx, "admin: failed to flush redis cache", "error", err)
+			break
+		}
+		removed += n
+	}
+	slog.InfoContext(ctx, "Cache flushed", "orders_removed", removed)
+	return int(removed)
+}
+
+// Stats - счётчики этой реплики. Size - число ключей в базе Redis (DBSIZE), вместе с короткоживущими
+// ключами поколений, поэтому база redis.db должна использоваться только кэшем заказов.
+// DBSIZE запрашивается не чаще раза в redisSizeRefresh, между запросами отдаётся прошлое значение
+func (s *RedisCache) Stats() entity.CacheStats {
+	return entity.CacheStats{
+		Capacity:     s.warmCount,
+		Size:         s.size(),
+		Hits:         s.hits.Load(),
+		Misses:       s.misses.Load(),
+		NegativeHits: s.negativeHits.Load(),
+	}
+}
+
+// size - число ключей в Redis, обновляется одним вызовом Stats, остальные не ждут его
+func (s *RedisCache) size() int {
+	now := time.Now().UnixNano()
+	checked := s.sizeCheckedAt.Load()
+	if now-checked < int64(redisSizeRefresh) || !s.sizeCheckedAt.CompareAndSwap(checked, now) {
+		return int(s.dbSize.Load())
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if size, err := s.client.DBSize(ctx).Result(); err == nil {
+		s.dbSize.Store(size)
+	}
+	return int(s.dbSize.Load())
+}
+
+// keys - все ключи заказов в Redis
+func (s *RedisCache) keys(ctx context.Context) ([]string, error) {
+	var keys []string
+	iter := s.client.Scan(ctx, 0, redisKeyPrefix+"*", 500).Iterator()
+	for iter.Next(ctx) {
+		keys = append(keys, iter.Val())
+	}
+	return keys, iter.Err()
+}
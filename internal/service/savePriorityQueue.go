@@ -52,6 +52,17 @@ func (spq *SafePriorityQueue) Update(item *Item, newPriority time.Time) {
 	heap.Fix(&spq.pq, item.Index)
 }
 
+// Remove безопасно удаляет элемент из очереди.
+func (spq *SafePriorityQueue) Remove(item *Item) {
+	spq.mu.Lock()
+	defer spq.mu.Unlock()
+
+	if item.Index < 0 || item.Index >= spq.pq.Len() || spq.pq[item.Index] != item {
+		return // элемента уже нет в очереди
+	}
+	heap.Remove(&spq.pq, item.Index)
+}
+
 // Len возвращает количество элементов в очереди безопасно.
 func (spq *SafePriorityQueue) Len() int {
 	spq.mu.Lock()
@@ -7,40 +7,97 @@ import (
 	"errors"
 	"fmt"
 	"log/slog"
-	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/Asus/L0_DemoServise/internal/entity"
-	"github.com/jackc/pgx/v5"
+	"golang.org/x/sync/singleflight"
 )
 
 type getOrder interface {
 	GetOrderByUID(ctx context.Context, in string) (entity.Order, error)
 	GetLastNOrders(ctx context.Context, numberOfgetOrders int) ([]entity.Order, error)
+	SearchOrders(ctx context.Context, q entity.OrderSearch) (entity.OrderPage, error)
+	GetOrderUIDs(ctx context.Context) ([]string, error)
+	GetOrderUIDsUpdatedSince(ctx context.Context, since time.Time) ([]string, error)
+	GetOrdersUpdatedSince(ctx context.Context, since time.Time) ([]entity.Order, error)
 	saver
 }
 
 type saver interface {
-	SaveOrder(ctx context.Context, o entity.Order) error
+	SaveOrder(ctx context.Context, o entity.Order) (entity.SaveResult, error)
 }
 
 type Cache struct {
-	OrderMap   map[string]entity.Order // Хранилище данных
-	orderItems map[string]*Item        // Быстрый доступ к элементам в очереди по UID
+	shards     []*cacheShard      // заказы, разложенные по хэшу UID; у каждого шарда своя блокировка
+	shardMask  uint32             // len(shards) - 1
 	OrderTaker getOrder				// Интерфейс для получения заказов из хранилища
-	prQ        *SafePriorityQueue      // Указатель, чтобы избежать копирования
+	loads      singleflight.Group // загрузки из хранилища по UID, идущие прямо сейчас
+	notFound   *negativeCache     // UID, которых нет в хранилище; nil - не используется
+	bloom      bloomState         // все известные UID, отсекает запросы несуществующих без БД
+	publisher  InvalidationPublisher // рассылает другим репликам события о сохранённых заказах; nil - не рассылаем
 	cacheCap   int
-	mu 	sync.RWMutex
+	maxBytes   int64 // бюджет памяти всего кэша, 0 - кэш ограничен числом заказов
+
+	// счётчики для админки и метрик, попадания и вытеснения считают сами шарды
+	negativeHits atomic.Uint64
+	bloomRejects atomic.Uint64
+	bloomFalse   atomic.Uint64 // фильтр пропустил UID, которого не оказалось в БД
+	// события инвалидации от других реплик, заодно поколение для загрузок из хранилища
+	invalidations atomic.Uint64
 }
 
-func NewCache(storage getOrder, cacheCap int) *Cache {
+// PolicyFactory создаёт политику вытеснения для одного шарда на capacity заказов
+type PolicyFactory func(capacity int) EvictionPolicy
+
+// NewCache создаёт кэш из одного шарда на cacheCap заказов, nil policy - LRU
+func NewCache(storage getOrder, cacheCap int, policy EvictionPolicy) *Cache {
+	if policy == nil {
+		policy = NewLRUPolicy()
+	}
 	return &Cache{
-		OrderMap:   make(map[string]entity.Order, cacheCap),
-		orderItems: make(map[string]*Item, cacheCap),
+		shards:     []*cacheShard{newCacheShard(cacheCap, policy)},
 		OrderTaker: storage,
-		prQ:        NewSafePriorityQueue(cacheCap),
 		cacheCap:   cacheCap,
-		mu:      sync.RWMutex{},
+	}
+}
+
+// NewShardedCache создаёт кэш на cacheCap заказов, разбитый на shards частей (округляется вверх
+// до степени двойки). Каждый шард вмещает свою долю cacheCap и вытесняет заказы своей политикой,
+// поэтому порядок вытеснения точен только внутри шарда. nil newPolicy - LRU
+func NewShardedCache(storage getOrder, cacheCap, shards int, newPolicy PolicyFactory) *Cache {
+	if newPolicy == nil {
+		newPolicy = func(int) EvictionPolicy { return NewLRUPolicy() }
+	}
+	n := 1
+	for n < shards {
+		n <<= 1
+	}
+	perShard := max((cacheCap+n-1)/n, 1)
+	c := &Cache{
+		shards:     make([]*cacheShard, n),
+		shardMask:  uint32(n - 1),
+		OrderTaker: storage,
+		cacheCap:   cacheCap,
+	}
+	for i := range c.shards {
+		c.shards[i] = newCacheShard(perShard, newPolicy(perShard))
+	}
+	return c
+}
+
+// shard - шард, в котором лежит (или будет лежать) заказ UID
+func (s *Cache) shard(UID string) *cacheShard {
+	return s.shards[shardIndex(UID, s.shardMask)]
+}
+
+// EnableByteBudget ограничивает кэш оценкой занимаемой памяти вместо числа заказов:
+// заказы вытесняются, пока их суммарный размер больше maxBytes (поровну на каждый шард).
+// cacheCap по-прежнему задаёт, сколько заказов загружать при старте. Вызывается до начала работы с кэшем
+func (s *Cache) EnableByteBudget(maxBytes int64) {
+	s.maxBytes = maxBytes
+	for _, sh := range s.shards {
+		sh.maxBytes = max(maxBytes/int64(len(s.shards)), 1)
 	}
 }
 
@@ -48,94 +105,143 @@ func NewCache(storage getOrder, cacheCap int) *Cache {
 func (s *Cache) LoadCache(ctx context.Context) error {
 	orders, err := s.OrderTaker.GetLastNOrders(ctx, s.cacheCap) // достаём из хранилища N заказов
 	if err != nil {
-		slog.Info("s.OrderTaker.GetLastNOrders(ctx, s.cacheCap)", "error", err)
+		slog.InfoContext(ctx, "s.OrderTaker.GetLastNOrders(ctx, s.cacheCap)", "error", err)
 		return fmt.Errorf("error occured while tryed load cache in service.LoadCache() %w", err)
 	}
 
-	s.mu.Lock()
-	defer s.mu.Unlock()
-
-	for _, ord := range orders {
-		s.OrderMap[ord.OrderUID] = ord
-		item := makeItem(ord.OrderUID)
-		s.prQ.Push(item)
-		s.orderItems[ord.OrderUID] = item
+	// заказы приходят от новых к старым, добавляем с конца, чтобы самые новые
+	// получили самый свежий приоритет и вытеснялись последними
+	for i := len(orders) - 1; i >= 0; i-- {
+		s.addToCache(ctx, orders[i])
 	}
 	return nil
 }
 
-// возвращает Order по UID
-func (s *Cache) GiveOrderByUID(UID string) (entity.Order, error) {
-	s.mu.RLock()
+// возвращает Order по UID, при промахе идёт в хранилище с ctx запроса:
+// отмена или дедлайн запроса прерывают и запрос к БД
+func (s *Cache) GiveOrderByUID(ctx context.Context, UID string) (entity.Order, error) {
+	if ord, ok := s.shard(UID).get(UID); ok {
+		return ord, nil
+	}
+
+	if !s.bloom.mayContain(UID) {
+		s.bloomRejects.Add(1)
+		return entity.Order{}, fmt.Errorf("order with UID %s: %w", UID, entity.ErrNotFound)
+	}
+	if s.notFound.contains(UID) {
+		s.negativeHits.Add(1)
+		return entity.Order{}, fmt.Errorf("order with UID %s: %w", UID, entity.ErrNotFound)
+	}
+
+	// одновременные промахи по одному UID объединяются в одну загрузку из хранилища
+	loaded := s.loads.DoChan(UID, func() (any, error) {
+		return s.load(ctx, UID)
+	})
+	select {
+	case res := <-loaded:
+		if res.Err != nil {
+			return entity.Order{}, res.Err
+		}
+		return res.Val.(entity.Order), nil
+	case <-ctx.Done():
+		return entity.Order{}, fmt.Errorf("error occurred while trying to get order with UID %s: %w", UID, ctx.Err())
+	}
+}
 
-	ord, isIn := s.OrderMap[UID]
-	s.mu.RUnlock()
+// load загружает заказ из хранилища и кладёт его в кэш, один раз на группу одновременных промахов.
+// Загрузку разделяют несколько запросов, поэтому отмена того, который её начал, её не прерывает:
+// каждый ждущий запрос сам уходит по своему ctx, а дедлайн первого запроса ограничивает запрос к БД
+func (s *Cache) load(ctx context.Context, UID string) (entity.Order, error) {
+	loadCtx := context.WithoutCancel(ctx)
+	if deadline, ok := ctx.Deadline(); ok {
+		var cancel context.CancelFunc
+		loadCtx, cancel = context.WithDeadline(loadCtx, deadline)
+		defer cancel()
+	}
 
-	if isIn {
-		s.updateOrderPriority(UID)
+	// заказ мог загрузить предыдущий промах, который закончился между нашей проверкой кэша и DoChan
+	if ord, ok := s.shard(UID).peek(UID); ok {
 		return ord, nil
 	}
 
-	ord, err := s.OrderTaker.GetOrderByUID(context.Background(), UID)
+	generation := s.notFound.currentGeneration()
+	invalidations := s.invalidations.Load()
+	ord, err := s.OrderTaker.GetOrderByUID(loadCtx, UID)
 	if err != nil {
-		if errors.Is(err, pgx.ErrNoRows) {
-			return entity.Order{}, fmt.Errorf("order with UID %s not found", UID)
+		if errors.Is(err, entity.ErrNotFound) {
+			s.notFound.addIfUnchanged(UID, generation)
+			if s.bloom.ready() {
+				s.bloomFalse.Add(1)
+			}
 		}
 		return entity.Order{}, fmt.Errorf("error occurred while trying to get order with UID %s: %w", UID, err)
 	}
-	
-	s.addToCache(ord)
+
+	// пока шёл запрос, другая реплика могла изменить заказ: прочитанная версия, возможно, уже старая,
+	// отдаём её, но в кэш не кладём
+	if s.invalidations.Load() == invalidations {
+		s.addToCache(loadCtx, ord)
+	}
 	return ord, nil
 }
 
-// сохраняет Order в БД и в Cache
-func (s *Cache) SaveOrder(ctx context.Context, o entity.Order) error {
-	if err := s.OrderTaker.SaveOrder(ctx, o); err != nil {
-		slog.Error("Failed to save order to database", "order_uid", o.OrderUID, "error", err)
-		return fmt.Errorf("error occurred while trying to save order: %w", err)
-	}
-	s.addToCache(o)
-	return nil
+// EnableNegativeCache включает запоминание ненайденных UID: до size записей, каждая живёт ttl.
+// Вызывается до начала работы с кэшем
+func (s *Cache) EnableNegativeCache(size int, ttl time.Duration) {
+	s.notFound = newNegativeCache(size, ttl)
 }
 
-// добавляет Order в cache
-func (s *Cache) addToCache(ord entity.Order) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-	// Если кэш заполнен, вытесняем самый старый элемент.
-	if len(s.OrderMap) >= s.cacheCap {
-		item := s.prQ.Pop()
-		if item != nil {
-			slog.Info("Evicting order from cache", "order_uid", item.Value)
-			delete(s.OrderMap, item.Value)
-			delete(s.orderItems, item.Value)
-		}
+// ищет заказы прямо в хранилище: результаты поиска в кэш не попадают,
+// чтобы просмотр списков не вытеснял из него "горячие" заказы
+func (s *Cache) SearchOrders(ctx context.Context, q entity.OrderSearch) (entity.OrderPage, error) {
+	page, err := s.OrderTaker.SearchOrders(ctx, q)
+	if err != nil {
+		return entity.OrderPage{}, fmt.Errorf("error occurred while searching orders: %w", err)
 	}
-
-	// Добавляем новый элемент.
-	itm := makeItem(ord.OrderUID)
-	s.prQ.Push(itm)
-	s.OrderMap[ord.OrderUID] = ord
-	s.orderItems[ord.OrderUID] = itm
-	slog.Info("Order added to cache", "order_uid", ord.OrderUID)
+	return page, nil
 }
 
-func (s *Cache) updateOrderPriority(UID string) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-	
-	item, exists := s.orderItems[UID]
-	if !exists {
-		return
-	}
+// сохраняет Order в БД и в Cache, отклонённую (SaveConflict) версию в кэш не кладём
+func (s *Cache) SaveOrder(ctx context.Context, o entity.Order) (entity.SaveResult, error) {
+	// в фильтр добавляем до записи в БД: иначе в промежутке между ними фильтр отвечал бы "не найден"
+	// на уже сохранённый заказ. Если сохранить не удастся, это будет лишь ложное срабатывание
+	s.bloom.add(o.OrderUID)
 
-	s.prQ.Update(item, time.Now())
+	result, err := s.OrderTaker.SaveOrder(ctx, o)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to save order to database", "order_uid", o.OrderUID, "error", err)
+		return 0, fmt.Errorf("error occurred while trying to save order: %w", err)
+	}
+	s.notFound.invalidate(o.OrderUID) // заказ с этим UID теперь точно есть в хранилище
+	switch result {
+	case entity.SaveInserted:
+		s.addToCache(ctx, asInserted(o))
+	case entity.SaveUpdated, entity.SaveDuplicate:
+		// статус уже сохранённого заказа живёт только в хранилище, заказ перечитается при обращении
+		s.forget(o.OrderUID)
+	}
+	publishSaved(ctx, s.publisher, o.OrderUID, result)
+	return result, nil
 }
 
-func (s *Cache) GetPriorityQueue() *SafePriorityQueue {
-	return s.prQ
+// asInserted - заказ в том виде, в котором его только что вставило хранилище: статус нового заказа
+// и отметки о возврате товаров задаёт хранилище, а не сообщение
+func asInserted(o entity.Order) entity.Order {
+	o.Status = entity.StatusCreated
+	items := make([]entity.Item, len(o.Items))
+	copy(items, o.Items) // копия, чтобы не менять слайс вызывающего
+	for i := range items {
+		items[i].ReturnedAt = nil
+	}
+	o.Items = items
+	return o
 }
 
-func (s *Cache) PrinPriorityQueue() string{
-	return s.prQ.String()
-}
\ No newline at end of file
+// добавляет Order в cache
+func (s *Cache) addToCache(ctx context.Context, ord entity.Order) {
+	sh := s.shard(ord.OrderUID)
+	sh.lock()
+	defer sh.mu.Unlock()
+
+	sh.put(ctx, ord)
+}
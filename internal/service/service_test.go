@@ -3,14 +3,23 @@ package service
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
+	"log/slog"
+	"maps"
+	"math/rand"
 	"os"
 	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/Asus/L0_DemoServise/internal/entity"
-	"github.com/jackc/pgx/v5"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
 )
 
 type TestData struct {
@@ -131,22 +140,88 @@ func TestPriorityQueue(T *testing.T) {
 }
 
 type mockStorage struct {
-	mockDB map[string]entity.Order
+	mockDB  map[string]entity.Order
+	updated []entity.Order // что вернёт GetOrdersUpdatedSince
 }
 
 func (m *mockStorage) GetOrderByUID(ctx context.Context, uid string) (entity.Order, error) {
+	if err := ctx.Err(); err != nil {
+		return entity.Order{}, err // как pgx: отменённый контекст прерывает запрос
+	}
 	if order, ok := m.mockDB[uid]; ok {
 		return order, nil
 	}
-	return entity.Order{}, pgx.ErrNoRows
+	return entity.Order{}, entity.ErrNotFound
+}
+
+func (m *mockStorage) GetOrderUIDs(ctx context.Context) ([]string, error) {
+	return slices.Collect(maps.Keys(m.mockDB)), nil
+}
+
+func (m *mockStorage) GetOrdersUpdatedSince(ctx context.Context, since time.Time) ([]entity.Order, error) {
+	return m.updated, nil
+}
+
+func (m *mockStorage) GetOrderUIDsUpdatedSince(ctx context.Context, since time.Time) ([]string, error) {
+	uids := make([]string, 0, len(m.updated))
+	for _, o := range m.updated {
+		uids = append(uids, o.OrderUID)
+	}
+	return uids, nil
 }
 
 func (m *mockStorage) GetLastNOrders(ctx context.Context, n int) ([]entity.Order, error) {
 	return []entity.Order{}, nil
 }
 
-func (m *mockStorage) SaveOrder(ctx context.Context, o entity.Order) error {
-	return nil
+func (m *mockStorage) SearchOrders(ctx context.Context, q entity.OrderSearch) (entity.OrderPage, error) {
+	return entity.OrderPage{}, nil
+}
+
+func (m *mockStorage) SaveOrder(ctx context.Context, o entity.Order) (entity.SaveResult, error) {
+	return entity.SaveInserted, nil
+}
+
+// blockingStorage считает обращения к БД и держит их, пока не закрыт release
+type blockingStorage struct {
+	mockStorage
+	calls   atomic.Int32
+	entered chan struct{} // если задан, сюда приходит сигнал о каждом обращении
+	release chan struct{}
+}
+
+func (m *blockingStorage) GetOrderByUID(ctx context.Context, uid string) (entity.Order, error) {
+	m.calls.Add(1)
+	if m.entered != nil {
+		m.entered <- struct{}{}
+	}
+	<-m.release
+	return m.mockStorage.GetOrderByUID(ctx, uid)
+}
+
+// policies - все политики вытеснения, общие тесты кэша прогоняются для каждой
+var policies = map[string]PolicyFactory{
+	PolicyLRU: func(int) EvictionPolicy { return NewLRUPolicy() },
+	PolicyLFU: func(int) EvictionPolicy { return NewLFUPolicy() },
+	PolicyTTL: func(int) EvictionPolicy { return NewTTLPolicy(time.Hour) },
+	PolicyARC: func(capacity int) EvictionPolicy { return NewARCPolicy(capacity) },
+}
+
+// contains - лежит ли заказ в кэше, без отметки об обращении
+func (s *Cache) contains(UID string) bool {
+	_, ok := s.shard(UID).peek(UID)
+	return ok
+}
+
+// policyLen - сколько заказов отслеживают политики вытеснения всех шардов
+func (s *Cache) policyLen() int {
+	n := 0
+	for _, sh := range s.shards {
+		sh.mu.Lock()
+		n += sh.policy.Len()
+		sh.mu.Unlock()
+	}
+	return n
 }
 
 func TestCache(t *testing.T) {
@@ -158,91 +233,1300 @@ func TestCache(t *testing.T) {
 	}
 	storage := &mockStorage{mockDB: mockOrders}
 
-	t.Run("Get from empty cache (miss and fill)", func(t *testing.T) {
-		// Создаем новый кэш для каждого теста, чтобы они не влияли друг на друга
-		cache := NewCache(storage, 3)
+	for name, newPolicy := range policies {
+		t.Run(name, func(t *testing.T) {
+			t.Run("Get from empty cache (miss and fill)", func(t *testing.T) {
+				// Создаем новый кэш для каждого теста, чтобы они не влияли друг на друга
+				cache := NewCache(storage, 3, newPolicy(3))
 
-		order, err := cache.GiveOrderByUID("order-1")
+				order, err := cache.GiveOrderByUID(t.Context(), "order-1")
 
-		if err != nil {
-			t.Fatalf("expected no error, but got: %v", err)
-		}
-		if order.OrderUID != "order-1" {
-			t.Errorf("expected to get order-1, but got: %s", order.OrderUID)
-		}
+				if err != nil {
+					t.Fatalf("expected no error, but got: %v", err)
+				}
+				if order.OrderUID != "order-1" {
+					t.Errorf("expected to get order-1, but got: %s", order.OrderUID)
+				}
+
+				// Проверяем, что кэш теперь содержит этот элемент
+				if exists := cache.contains("order-1"); !exists {
+					t.Error("order-1 was not added to the cache after a miss")
+				}
+				if cache.Stats().Size != 1 {
+					t.Errorf("expected cache size to be 1, but got: %d", cache.Stats().Size)
+				}
+			})
+
+			t.Run("Cache never grows beyond its capacity", func(t *testing.T) {
+				cache := NewCache(storage, 2, newPolicy(2))
+
+				for _, uid := range []string{"order-1", "order-2", "order-3", "order-1", "order-4", "order-2"} {
+					if _, err := cache.GiveOrderByUID(t.Context(), uid); err != nil {
+						t.Fatalf("expected no error for %s, but got: %v", uid, err)
+					}
+					if cache.Stats().Size > 2 || cache.policyLen() != cache.Stats().Size {
+						t.Fatalf("after %s cache holds %d orders, policy tracks %d", uid, cache.Stats().Size, cache.policyLen())
+					}
+				}
+				if exists := cache.contains("order-2"); !exists {
+					t.Error("just requested order-2 must be in cache")
+				}
+			})
+
+			t.Run("Getting a non-existent item returns an error", func(t *testing.T) {
+				cache := NewCache(storage, 3, newPolicy(3))
+
+				// Пытаемся получить заказ, которого нет ни в кэше, ни в моке БД
+				_, err := cache.GiveOrderByUID(t.Context(), "non-existent-order")
+
+				if err == nil {
+					t.Fatal("expected an error for a non-existent item, but got nil")
+				}
+			})
+		})
+	}
 
-		// Проверяем, что кэш теперь содержит этот элемент
-		if _, exists := cache.OrderMap["order-1"]; !exists {
-			t.Error("order-1 was not added to the cache after a miss")
+	t.Run("Expired request context cancels the storage lookup", func(t *testing.T) {
+		cache := NewCache(storage, 3, NewLRUPolicy())
+		cache.GiveOrderByUID(t.Context(), "order-1")
+
+		ctx, cancel := context.WithTimeout(t.Context(), time.Nanosecond)
+		defer cancel()
+		<-ctx.Done()
+
+		if _, err := cache.GiveOrderByUID(ctx, "order-1"); err != nil {
+			t.Errorf("cached order must be served without storage, got: %v", err)
 		}
-		if len(cache.OrderMap) != 1 {
-			t.Errorf("expected cache size to be 1, but got: %d", len(cache.OrderMap))
+		_, err := cache.GiveOrderByUID(ctx, "order-2")
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("expected context.DeadlineExceeded on a miss, got: %v", err)
+		}
+		if exists := cache.contains("order-2"); exists {
+			t.Error("order-2 must not be cached after a failed lookup")
 		}
 	})
 
-	t.Run("Eviction of least recently used item", func(t *testing.T) {
+	t.Run("LRU: eviction of least recently used item", func(t *testing.T) {
 		// Используем кэш с маленькой емкостью для проверки вытеснения
-		cache := NewCache(storage, 2)
+		cache := NewCache(storage, 2, NewLRUPolicy())
 
-		cache.GiveOrderByUID("order-1")
-		time.Sleep(10 * time.Millisecond)
-		cache.GiveOrderByUID("order-2")
-		time.Sleep(10 * time.Millisecond)
+		cache.GiveOrderByUID(t.Context(), "order-1")
+		cache.GiveOrderByUID(t.Context(), "order-2")
 
-		if len(cache.OrderMap) != 2 {
-			t.Fatalf("expected cache size to be 2 before eviction, but got: %d", len(cache.OrderMap))
+		if cache.Stats().Size != 2 {
+			t.Fatalf("expected cache size to be 2 before eviction, but got: %d", cache.Stats().Size)
 		}
 
-		cache.GiveOrderByUID("order-3")
+		cache.GiveOrderByUID(t.Context(), "order-3")
 
 		// Проверяем состояние кэша после вытеснения
-		if len(cache.OrderMap) != 2 {
-			t.Errorf("expected cache size to be 2 after eviction, but got: %d", len(cache.OrderMap))
+		if cache.Stats().Size != 2 {
+			t.Errorf("expected cache size to be 2 after eviction, but got: %d", cache.Stats().Size)
 		}
-		if _, exists := cache.OrderMap["order-3"]; !exists {
+		if exists := cache.contains("order-3"); !exists {
 			t.Error("new item order-3 was not added to cache")
 		}
-		if _, exists := cache.OrderMap["order-2"]; !exists {
+		if exists := cache.contains("order-2"); !exists {
 			t.Error("item order-2 should not have been evicted")
 		}
-		if _, exists := cache.OrderMap["order-1"]; exists {
+		if exists := cache.contains("order-1"); exists {
 			t.Error("least recently used item order-1 was not evicted")
 		}
 	})
 
-	t.Run("Accessing an item updates its priority and prevents eviction", func(t *testing.T) {
-		cache := NewCache(storage, 2)
+	t.Run("LRU: accessing an item updates its priority and prevents eviction", func(t *testing.T) {
+		cache := NewCache(storage, 2, NewLRUPolicy())
 
 		// 1. Добавляем order-1, потом order-2. Порядок старости: 1, 2.
-		cache.GiveOrderByUID("order-1")
-		time.Sleep(10 * time.Millisecond)
-		cache.GiveOrderByUID("order-2")
-		time.Sleep(10 * time.Millisecond)
-
-		cache.GiveOrderByUID("order-1")
-		time.Sleep(10 * time.Millisecond)
+		cache.GiveOrderByUID(t.Context(), "order-1")
+		cache.GiveOrderByUID(t.Context(), "order-2")
+		cache.GiveOrderByUID(t.Context(), "order-1")
 
-		cache.GiveOrderByUID("order-3")
+		cache.GiveOrderByUID(t.Context(), "order-3")
 
-		if len(cache.OrderMap) != 2 {
-			t.Errorf("expected cache size to be 2, but got: %d", len(cache.OrderMap))
+		if cache.Stats().Size != 2 {
+			t.Errorf("expected cache size to be 2, but got: %d", cache.Stats().Size)
 		}
-		if _, exists := cache.OrderMap["order-1"]; !exists {
+		if exists := cache.contains("order-1"); !exists {
 			t.Error("order-1 should have been kept in cache because it was recently accessed")
 		}
-		if _, exists := cache.OrderMap["order-2"]; exists {
+		if exists := cache.contains("order-2"); exists {
 			t.Error("order-2 should have been evicted as the new least recently used item")
 		}
 	})
 
-	t.Run("Getting a non-existent item returns an error", func(t *testing.T) {
-		cache := NewCache(storage, 3)
+	t.Run("LFU: frequently used item survives newer ones", func(t *testing.T) {
+		cache := NewCache(storage, 2, NewLFUPolicy())
+
+		cache.GiveOrderByUID(t.Context(), "order-1")
+		cache.GiveOrderByUID(t.Context(), "order-1")
+		cache.GiveOrderByUID(t.Context(), "order-1")
+		cache.GiveOrderByUID(t.Context(), "order-2")
+		cache.GiveOrderByUID(t.Context(), "order-3") // вытесняет order-2: к нему обращались реже
+
+		if exists := cache.contains("order-1"); !exists {
+			t.Error("frequently used order-1 must stay in cache")
+		}
+		if exists := cache.contains("order-2"); exists {
+			t.Error("order-2 has the lowest frequency and must be evicted")
+		}
+	})
+
+	t.Run("TTL: expired item is reloaded from storage", func(t *testing.T) {
+		now := time.Now()
+		policy := NewTTLPolicy(time.Minute)
+		policy.now = func() time.Time { return now }
+		cache := NewCache(storage, 2, policy)
+
+		cache.GiveOrderByUID(t.Context(), "order-1")
+		cache.GiveOrderByUID(t.Context(), "order-1")
+		now = now.Add(2 * time.Minute)
+		cache.GiveOrderByUID(t.Context(), "order-1")
+
+		if stats := cache.Stats(); stats.Hits != 1 || stats.Misses != 2 {
+			t.Errorf("expected 1 hit and 2 misses, got %+v", stats)
+		}
+		if policy.Len() != 1 || policy.Expired("order-1") {
+			t.Errorf("reloaded order must be tracked once with a fresh ttl, policy len %d", policy.Len())
+		}
+	})
+
+	t.Run("ARC: one-off scan does not flush frequently used items", func(t *testing.T) {
+		cache := NewCache(storage, 2, NewARCPolicy(2))
+
+		cache.GiveOrderByUID(t.Context(), "order-1")
+		cache.GiveOrderByUID(t.Context(), "order-1") // order-1 переходит в T2
+		cache.GiveOrderByUID(t.Context(), "order-2")
+		cache.GiveOrderByUID(t.Context(), "order-3")
+		cache.GiveOrderByUID(t.Context(), "order-4")
+
+		if exists := cache.contains("order-1"); !exists {
+			t.Error("order-1 was used twice and must survive a scan of one-off orders")
+		}
+	})
+}
+
+// waitSignalCtx сообщает в waiting о первом обращении к Done: GiveOrderByUID обращается к нему,
+// только когда уже ждёт загрузку заказа
+type waitSignalCtx struct {
+	context.Context
+	once    sync.Once
+	waiting chan<- struct{}
+}
+
+func (c *waitSignalCtx) Done() <-chan struct{} {
+	c.once.Do(func() { c.waiting <- struct{}{} })
+	return c.Context.Done()
+}
+
+func TestCacheCoalescesConcurrentMisses(t *testing.T) {
+	storage := &blockingStorage{
+		mockStorage: mockStorage{mockDB: map[string]entity.Order{"order-1": {OrderUID: "order-1"}}},
+		entered:     make(chan struct{}, 1),
+		release:     make(chan struct{}),
+	}
+	cache := NewCache(storage, 3, NewLRUPolicy())
+
+	// первый запрос начинает загрузку и уходит, не дождавшись её: загрузка должна достаться остальным
+	firstCtx, cancelFirst := context.WithCancel(t.Context())
+	firstDone := make(chan struct{})
+	go func() {
+		defer close(firstDone)
+		cache.GiveOrderByUID(firstCtx, "order-1")
+	}()
+	<-storage.entered
+
+	const callers = 50
+	errs := make(chan error, callers)
+	waiting := make(chan struct{}, callers)
+	var wg sync.WaitGroup
+	for range callers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ctx := &waitSignalCtx{Context: t.Context(), waiting: waiting}
+			order, err := cache.GiveOrderByUID(ctx, "order-1")
+			if err == nil && order.OrderUID != "order-1" {
+				err = fmt.Errorf("got order %q", order.OrderUID)
+			}
+			errs <- err
+		}()
+	}
+
+	for range callers {
+		<-waiting // запрос присоединился к загрузке и ждёт её
+	}
+	cancelFirst()
+	<-firstDone
+	close(storage.release)
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			t.Errorf("expected every waiting caller to get the order, got: %v", err)
+		}
+	}
+	if calls := storage.calls.Load(); calls != 1 {
+		t.Errorf("expected one storage load for concurrent misses, got %d", calls)
+	}
+	if n := cache.policyLen(); n != 1 || cache.Stats().Size != 1 {
+		t.Errorf("expected exactly one cache entry for order-1, policy tracks %d, map holds %d", n, cache.Stats().Size)
+	}
+}
+
+func TestNegativeCache(t *testing.T) {
+	storage := &blockingStorage{mockStorage: mockStorage{mockDB: map[string]entity.Order{}}, release: make(chan struct{})}
+	close(storage.release)
+	cache := NewCache(storage, 3, NewLRUPolicy())
+	cache.EnableNegativeCache(2, time.Minute)
+	now := time.Now()
+	cache.notFound.entries.now = func() time.Time { return now }
+
+	for range 3 {
+		if _, err := cache.GiveOrderByUID(t.Context(), "missing-1"); err == nil {
+			t.Fatal("expected an error for a non-existent order")
+		}
+	}
+	if calls := storage.calls.Load(); calls != 1 {
+		t.Errorf("repeated lookups of a missing UID must reach storage once, got %d calls", calls)
+	}
+	if hits := cache.Stats().NegativeHits; hits != 2 {
+		t.Errorf("expected 2 negative hits, got %d", hits)
+	}
+
+	// размер ограничен: самая старая запись вытесняется
+	cache.GiveOrderByUID(t.Context(), "missing-2")
+	cache.GiveOrderByUID(t.Context(), "missing-3")
+	if cache.notFound.contains("missing-1") || !cache.notFound.contains("missing-2") || cache.notFound.entries.Len() != 2 {
+		t.Errorf("negative cache must keep only 2 newest UIDs, has %d", cache.notFound.entries.Len())
+	}
+
+	// сохранённый заказ сразу перестаёт считаться несуществующим
+	if _, err := cache.SaveOrder(t.Context(), entity.Order{OrderUID: "missing-3"}); err != nil {
+		t.Fatalf("unexpected save error: %v", err)
+	}
+	if cache.notFound.contains("missing-3") {
+		t.Error("saved UID must be removed from the negative cache")
+	}
+	if _, err := cache.GiveOrderByUID(t.Context(), "missing-3"); err != nil {
+		t.Errorf("saved order must be returned, got: %v", err)
+	}
+
+	// запись устаревает через ttl
+	now = now.Add(2 * time.Minute)
+	if cache.notFound.contains("missing-2") {
+		t.Error("negative entry must expire after ttl")
+	}
+}
+
+func TestScalableBloom(t *testing.T) {
+	const (
+		added  = 10000
+		fpRate = 0.01
+	)
+	bloom := NewScalableBloom(1000, fpRate)
+	for i := range added {
+		bloom.Add(fmt.Sprintf("order-%d", i))
+	}
+
+	for i := range added {
+		if uid := fmt.Sprintf("order-%d", i); !bloom.MayContain(uid) {
+			t.Fatalf("bloom filter must never reject an added UID, rejected %s", uid)
+		}
+	}
+	if len(bloom.filters) < 2 {
+		t.Errorf("filter must grow past its initial capacity, has %d filters", len(bloom.filters))
+	}
+
+	falsePositives := 0
+	for i := range added {
+		if bloom.MayContain(fmt.Sprintf("unknown-%d", i)) {
+			falsePositives++
+		}
+	}
+	// суммарная вероятность ошибки масштабируемого фильтра не больше fpRate, небольшой запас на случайность
+	if rate := float64(falsePositives) / added; rate > 1.5*fpRate {
+		t.Errorf("measured false-positive rate %.4f is above %.4f", rate, fpRate)
+	}
+	if rate := bloom.FalsePositiveRate(); rate <= 0 || rate > fpRate {
+		t.Errorf("expected estimated false-positive rate in (0, %v], got %v", fpRate, rate)
+	}
+	if bloom.SizeBytes() == 0 {
+		t.Error("size must be reported")
+	}
+}
+
+func TestCacheBloomFilter(t *testing.T) {
+	storage := &blockingStorage{
+		mockStorage: mockStorage{mockDB: map[string]entity.Order{"order-1": {OrderUID: "order-1"}}},
+		release:     make(chan struct{}),
+	}
+	close(storage.release)
+	cache := NewCache(storage, 3, NewLRUPolicy())
+
+	// пока фильтр не построен, он ничего не отсекает
+	cache.GiveOrderByUID(t.Context(), "unknown-1")
+	if calls := storage.calls.Load(); calls != 1 {
+		t.Fatalf("lookup before the filter is loaded must reach storage, got %d calls", calls)
+	}
+
+	if err := cache.LoadBloomFilter(t.Context(), 100, 0.01); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	_, err := cache.GiveOrderByUID(t.Context(), "unknown-2")
+	if !errors.Is(err, entity.ErrNotFound) {
+		t.Errorf("expected entity.ErrNotFound, got: %v", err)
+	}
+	if calls := storage.calls.Load(); calls != 1 {
+		t.Errorf("UID rejected by the filter must not reach storage, got %d calls", calls)
+	}
+	if _, err := cache.GiveOrderByUID(t.Context(), "order-1"); err != nil {
+		t.Errorf("known order must pass the filter, got: %v", err)
+	}
+
+	if _, err := cache.SaveOrder(t.Context(), entity.Order{OrderUID: "order-2"}); err != nil {
+		t.Fatalf("unexpected save error: %v", err)
+	}
+	if !cache.bloom.mayContain("order-2") {
+		t.Error("saved UID must be added to the filter")
+	}
+
+	stats := cache.Stats()
+	if stats.BloomRejects != 1 || stats.BloomBytes == 0 || stats.BloomFPRate <= 0 {
+		t.Errorf("unexpected bloom stats: %+v", stats)
+	}
+
+	// заказ сохранила другая реплика, а событие инвалидации потерялось: сверка с БД добавляет его в фильтр
+	other := entity.Order{OrderUID: "order-from-other-replica"}
+	storage.mockDB[other.OrderUID] = other
+	storage.updated = []entity.Order{other}
+	if _, err := cache.GiveOrderByUID(t.Context(), other.OrderUID); !errors.Is(err, entity.ErrNotFound) {
+		t.Fatalf("expected the filter to reject the unsynced UID, got: %v", err)
+	}
+	if n, err := cache.SyncBloomFilter(t.Context()); err != nil || n != 1 {
+		t.Fatalf("expected 1 synced order, got %d, %v", n, err)
+	}
+	if _, err := cache.GiveOrderByUID(t.Context(), other.OrderUID); err != nil {
+		t.Errorf("synced order must pass the filter, got: %v", err)
+	}
+}
+
+func TestCacheByteBudget(t *testing.T) {
+	withItems := func(uid string, n int) entity.Order {
+		o := entity.Order{OrderUID: uid, TrackNumber: "TRACK"}
+		for i := range n {
+			o.Items = append(o.Items, entity.Item{Rid: fmt.Sprintf("%s-rid-%d", uid, i), Name: "Mascaras", Brand: "Vivienne Sabo"})
+		}
+		return o
+	}
+	small := orderSize(withItems("small-0", 1))
+	if big := orderSize(withItems("small-0", 50)); big <= small {
+		t.Fatalf("order with more items must be estimated as larger: %d <= %d", big, small)
+	}
+
+	storage := &mockStorage{mockDB: map[string]entity.Order{}}
+	for i := range 3 {
+		uid := fmt.Sprintf("small-%d", i)
+		storage.mockDB[uid] = withItems(uid, 1)
+	}
+	storage.mockDB["huge"] = withItems("huge", 100)
+
+	// места хватает на два маленьких заказа; cacheCap в этом режиме не ограничивает
+	budget := 2*small + small/2
+	cache := NewCache(storage, 1, NewLRUPolicy())
+	cache.EnableByteBudget(budget)
+
+	for i := range 3 {
+		cache.GiveOrderByUID(t.Context(), fmt.Sprintf("small-%d", i))
+	}
+	stats := cache.Stats()
+	if stats.Size != 2 || stats.Evictions != 1 {
+		t.Errorf("expected 2 orders and 1 eviction, got %+v", stats)
+	}
+	if stats.Bytes > budget || stats.MaxBytes != budget {
+		t.Errorf("cache uses %d bytes with budget %d, reported budget %d", stats.Bytes, budget, stats.MaxBytes)
+	}
+
+	// заказ больше всего бюджета не кэшируется и ничего не вытесняет
+	if _, err := cache.GiveOrderByUID(t.Context(), "huge"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cached := cache.contains("huge"); cached || cache.Stats().Size != 2 {
+		t.Error("order larger than the budget must not be cached")
+	}
+
+	// заказ вырос при перезаписи так, что вдвоём с соседом не помещается - сосед вытесняется
+	// размер считаем по копии, которая попадёт в кэш
+	grown := withItems("small-2", 2)
+	for orderSize(asInserted(grown)) <= budget-small {
+		grown = withItems("small-2", len(grown.Items)+1)
+	}
+	if orderSize(asInserted(grown)) > budget {
+		t.Fatalf("test setup: grown order %d does not fit budget %d", orderSize(asInserted(grown)), budget)
+	}
+	if _, err := cache.SaveOrder(t.Context(), grown); err != nil {
+		t.Fatalf("unexpected save error: %v", err)
+	}
+	var sum int64
+	for _, entry := range cache.Entries(t.Context()) {
+		sum += entry.SizeBytes
+	}
+	stats = cache.Stats()
+	if stats.Size != 1 || stats.Bytes != sum || stats.Bytes > budget {
+		t.Errorf("expected one order within budget with consistent usage, got %+v (entries sum %d)", stats, sum)
+	}
+
+	cache.Flush(t.Context())
+	if stats := cache.Stats(); stats.Bytes != 0 {
+		t.Errorf("flush must reset memory usage, got %d", stats.Bytes)
+	}
+}
+
+func TestCacheAdmin(t *testing.T) {
+	storage := &mockStorage{mockDB: map[string]entity.Order{
+		"order-1": {OrderUID: "order-1"},
+		"order-2": {OrderUID: "order-2"},
+		"order-3": {OrderUID: "order-3"},
+	}}
+	cache := NewCache(storage, 2, NewLRUPolicy())
+
+	cache.GiveOrderByUID(t.Context(), "order-1") // промах
+	time.Sleep(10 * time.Millisecond)
+	cache.GiveOrderByUID(t.Context(), "order-2") // промах
+	time.Sleep(10 * time.Millisecond)
+	cache.GiveOrderByUID(t.Context(), "order-2") // попадание
+	cache.GiveOrderByUID(t.Context(), "order-3") // промах, вытесняет order-1
+
+	stats := cache.Stats()
+	expected := entity.CacheStats{Size: 2, Capacity: 2, Shards: 1, Hits: 1, Misses: 3, Evictions: 1}
+	if stats != expected {
+		t.Errorf("expected stats %+v, got %+v", expected, stats)
+	}
+
+	entries := cache.Entries(t.Context())
+	if len(entries) != 2 || entries[0].OrderUID != "order-3" || entries[1].OrderUID != "order-2" {
+		t.Errorf("expected entries order-3, order-2 (most recent first), got %+v", entries)
+	}
+
+	if !cache.Evict(t.Context(), "order-2") {
+		t.Error("expected order-2 to be evicted")
+	}
+	if cache.Evict(t.Context(), "order-2") {
+		t.Error("evicting an uncached order must return false")
+	}
+	if cache.policyLen() != 1 {
+		t.Errorf("evicted order must be removed from the eviction policy, policy len %d", cache.policyLen())
+	}
+
+	if removed := cache.Flush(t.Context()); removed != 1 {
+		t.Errorf("expected flush to remove 1 order, got %d", removed)
+	}
+	if cache.Stats().Size != 0 || cache.policyLen() != 0 {
+		t.Error("cache must be empty after flush")
+	}
+}
+
+func TestShardedCache(t *testing.T) {
+	const (
+		ordersTotal = 200
+		cacheCap    = 64
+	)
+	mockOrders := make(map[string]entity.Order, ordersTotal)
+	for i := range ordersTotal {
+		uid := fmt.Sprintf("order-%d", i)
+		mockOrders[uid] = entity.Order{OrderUID: uid, TrackNumber: "TRACK-" + uid}
+	}
+	storage := &mockStorage{mockDB: mockOrders}
+
+	defaultLogger := slog.Default()
+	slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	defer slog.SetDefault(defaultLogger)
+
+	cache := NewShardedCache(storage, cacheCap, 6, policies[PolicyLRU])
+	if len(cache.shards) != 8 {
+		t.Fatalf("shard count must be rounded up to a power of two, got %d", len(cache.shards))
+	}
+
+	// конкурентные чтения и записи разных заказов, под -race проверяет блокировки шардов
+	var wg sync.WaitGroup
+	for w := range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range ordersTotal {
+				uid := fmt.Sprintf("order-%d", (i*7+w)%ordersTotal)
+				order, err := cache.GiveOrderByUID(t.Context(), uid)
+				if err != nil || order.TrackNumber != "TRACK-"+uid {
+					t.Errorf("expected %s from cache, got %+v, err %v", uid, order, err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	stats := cache.Stats()
+	if stats.Shards != 8 || stats.Size == 0 || stats.Size > cacheCap {
+		t.Errorf("cache of %d orders over %d shards holds %d", cacheCap, stats.Shards, stats.Size)
+	}
+	if stats.Size != cache.policyLen() || stats.Size != len(cache.Entries(t.Context())) {
+		t.Errorf("cache holds %d orders, policies track %d, entries %d", stats.Size, cache.policyLen(), len(cache.Entries(t.Context())))
+	}
+	if stats.Hits+stats.Misses != 8*ordersTotal {
+		t.Errorf("expected %d lookups counted, got %d hits and %d misses", 8*ordersTotal, stats.Hits, stats.Misses)
+	}
+
+	uid := cache.Entries(t.Context())[0].OrderUID
+	if !cache.Evict(t.Context(), uid) || cache.contains(uid) {
+		t.Errorf("%s must be evicted from its shard", uid)
+	}
+	if removed := cache.Flush(t.Context()); removed != stats.Size-1 || cache.Stats().Size != 0 || cache.policyLen() != 0 {
+		t.Errorf("flush must empty every shard, removed %d of %d", removed, stats.Size-1)
+	}
+}
+
+func TestCacheShardReadsShareLock(t *testing.T) {
+	sh := newCacheShard(4, NewLRUPolicy())
+	for _, uid := range []string{"order-1", "order-2", "order-3", "order-4"} {
+		sh.lock()
+		sh.put(t.Context(), entity.Order{OrderUID: uid})
+		sh.mu.Unlock()
+	}
+
+	// пока шард читают другие, попадания не ждут блокировку; обращения сверх буфера теряются
+	sh.mu.RLock()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for range accessBufferSize + 10 {
+			sh.get("order-1")
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("cache hits must not wait for other readers")
+	}
+	sh.mu.RUnlock()
+	if hits := sh.hits.Load(); hits != accessBufferSize+10 {
+		t.Errorf("expected every hit counted, got %d", hits)
+	}
+
+	// накопленные обращения доходят до политики перед записью: order-1 самый свежий, вытесняется order-2
+	sh.lock()
+	sh.put(t.Context(), entity.Order{OrderUID: "order-5"})
+	sh.mu.Unlock()
+	if _, ok := sh.peek("order-1"); !ok {
+		t.Error("recently read order-1 must survive eviction")
+	}
+	if _, ok := sh.peek("order-2"); ok {
+		t.Error("least recently used order-2 must be evicted")
+	}
+}
+
+func TestCacheSnapshot(t *testing.T) {
+	mockOrders := map[string]entity.Order{
+		"order-1": {OrderUID: "order-1", TrackNumber: "TRACK_A", Items: []entity.Item{{Rid: "rid-1", Name: "Товар"}}},
+		"order-2": {OrderUID: "order-2", TrackNumber: "TRACK_B"},
+		"order-3": {OrderUID: "order-3", TrackNumber: "TRACK_C"},
+		"order-4": {OrderUID: "order-4", TrackNumber: "TRACK_D"},
+	}
+	storage := &mockStorage{mockDB: mockOrders}
+	dir := t.TempDir()
+	path := dir + "/cache.snapshot"
+
+	cache := NewCache(storage, 3, NewLRUPolicy())
+	for _, uid := range []string{"order-1", "order-2", "order-3", "order-1"} {
+		cache.GiveOrderByUID(t.Context(), uid)
+		time.Sleep(time.Millisecond) // разное время обращения - порядок LRU в снапшоте
+	}
+	before := time.Now()
+	if err := cache.WriteSnapshot(path); err != nil {
+		t.Fatalf("failed to write snapshot: %v", err)
+	}
+	after := time.Now()
+	if files, _ := os.ReadDir(dir); len(files) != 1 {
+		t.Errorf("temporary files must not be left next to the snapshot, got %d files", len(files))
+	}
+
+	restored := NewCache(storage, 3, NewLRUPolicy())
+	createdAt, err := restored.LoadSnapshot(t.Context(), path)
+	if err != nil {
+		t.Fatalf("failed to load snapshot: %v", err)
+	}
+	if createdAt.Before(before) || createdAt.After(after) {
+		t.Errorf("snapshot time %v must be taken while the snapshot is written", createdAt)
+	}
+	if order, _ := restored.shard("order-1").peek("order-1"); order.Items[0].Name != "Товар" {
+		t.Errorf("order must be restored with its items, got %+v", order)
+	}
+	// порядок LRU сохранился: самый давний - order-2, его и вытесняет новый заказ
+	restored.GiveOrderByUID(t.Context(), "order-4")
+	if restored.contains("order-2") || !restored.contains("order-3") || !restored.contains("order-1") {
+		t.Errorf("expected order-2 to be evicted first after restore, entries %+v", restored.Entries(t.Context()))
+	}
+
+	t.Run("Reconcile loads orders saved after the snapshot", func(t *testing.T) {
+		storage.updated = []entity.Order{{OrderUID: "order-2", TrackNumber: "TRACK_B_NEW"}}
+		defer func() { storage.updated = nil }()
+
+		n, err := restored.Reconcile(t.Context(), createdAt)
+		if err != nil || n != 1 {
+			t.Fatalf("expected 1 reconciled order, got %d, err %v", n, err)
+		}
+		if order, _ := restored.shard("order-2").peek("order-2"); order.TrackNumber != "TRACK_B_NEW" {
+			t.Errorf("reconciled order must replace the snapshot version, got %+v", order)
+		}
+	})
+
+	t.Run("Corrupt snapshot is rejected", func(t *testing.T) {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data[len(data)-2] ^= 0xff
+		corrupt := dir + "/corrupt.snapshot"
+		if err := os.WriteFile(corrupt, data, 0o600); err != nil {
+			t.Fatal(err)
+		}
+
+		empty := NewCache(storage, 3, NewLRUPolicy())
+		if _, err := empty.LoadSnapshot(t.Context(), corrupt); !errors.Is(err, ErrSnapshotCorrupt) {
+			t.Errorf("expected ErrSnapshotCorrupt, got %v", err)
+		}
+		if empty.Stats().Size != 0 {
+			t.Error("nothing must be loaded from a corrupt snapshot")
+		}
+		if _, err := empty.LoadSnapshot(t.Context(), dir+"/missing.snapshot"); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("expected os.ErrNotExist for a missing snapshot, got %v", err)
+		}
+	})
+}
+
+// conflictStorage отклоняет любое сохранение как заказ с тем же UID, но другим содержимым
+type conflictStorage struct {
+	mockStorage
+}
+
+func (m *conflictStorage) SaveOrder(ctx context.Context, o entity.Order) (entity.SaveResult, error) {
+	return entity.SaveConflict, nil
+}
+
+func TestRedisCache(t *testing.T) {
+	mockOrders := map[string]entity.Order{
+		"order-1": {OrderUID: "order-1", TrackNumber: "TRACK_A", Items: []entity.Item{{Rid: "rid-1", Name: "Товар"}}},
+		"order-2": {OrderUID: "order-2", TrackNumber: "TRACK_B"},
+	}
+	const ttl = time.Hour
+
+	newRedis := func(t *testing.T) (*miniredis.Miniredis, *redis.Client) {
+		mr := miniredis.RunT(t)
+		client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+		t.Cleanup(func() { client.Close() })
+		return mr, client
+	}
+
+	t.Run("Replicas share orders through redis", func(t *testing.T) {
+		mr, client := newRedis(t)
+		storage := &blockingStorage{mockStorage: mockStorage{mockDB: mockOrders}, release: make(chan struct{})}
+		close(storage.release)
+
+		replica1 := NewRedisCache(client, storage, 10, ttl)
+		replica2 := NewRedisCache(client, storage, 10, ttl)
+
+		if _, err := replica1.GiveOrderByUID(t.Context(), "order-1"); err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		if !mr.Exists(redisKeyPrefix+"order-1") || mr.TTL(redisKeyPrefix+"order-1") != ttl {
+			t.Fatalf("order-1 must be stored in redis with ttl %v, got ttl %v", ttl, mr.TTL(redisKeyPrefix+"order-1"))
+		}
+
+		order, err := replica2.GiveOrderByUID(t.Context(), "order-1")
+		if err != nil || order.Items[0].Name != "Товар" {
+			t.Fatalf("replica2 must read order-1 with its items from redis, got %+v, err %v", order, err)
+		}
+		if calls := storage.calls.Load(); calls != 1 {
+			t.Errorf("expected 1 storage call for both replicas, got %d", calls)
+		}
+		if stats := replica2.Stats(); stats.Hits != 1 || stats.Misses != 0 || stats.Size != 1 {
+			t.Errorf("expected replica2 to count a hit in a cache of 1 order, got %+v", stats)
+		}
+
+		// без обращений заказ истекает, каждое обращение продлевает TTL
+		mr.FastForward(ttl / 2)
+		replica2.GiveOrderByUID(t.Context(), "order-1")
+		if mr.TTL(redisKeyPrefix+"order-1") != ttl {
+			t.Errorf("read must extend the ttl, got %v", mr.TTL(redisKeyPrefix+"order-1"))
+		}
+		mr.FastForward(ttl)
+		if mr.Exists(redisKeyPrefix + "order-1") {
+			t.Error("order-1 must expire from redis")
+		}
+	})
+
+	t.Run("Near-cache serves hot orders without redis", func(t *testing.T) {
+		mr, client := newRedis(t)
+		cache := NewRedisCache(client, &mockStorage{mockDB: mockOrders}, 10, ttl)
+		cache.EnableNearCache(10, time.Minute)
+
+		cache.GiveOrderByUID(t.Context(), "order-1")
+		mr.FlushAll()
+		if _, err := cache.GiveOrderByUID(t.Context(), "order-1"); err != nil {
+			t.Fatalf("order-1 must be served from the near-cache, got %v", err)
+		}
+		if mr.Exists(redisKeyPrefix + "order-1") {
+			t.Error("near-cache hit must not go to redis")
+		}
+
+		cache.Evict(t.Context(), "order-1")
+		if cache.near.policy.Len() != 0 || len(cache.near.orders) != 0 {
+			t.Error("evict must remove the order from the near-cache")
+		}
+	})
+
+	t.Run("Save puts order to redis, conflict does not", func(t *testing.T) {
+		mr, client := newRedis(t)
+		cache := NewRedisCache(client, &mockStorage{mockDB: mockOrders}, 10, ttl)
+		if _, err := cache.SaveOrder(t.Context(), entity.Order{OrderUID: "order-3"}); err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		if !mr.Exists(redisKeyPrefix + "order-3") {
+			t.Error("saved order must be put to redis")
+		}
+
+		conflicting := NewRedisCache(client, &conflictStorage{mockStorage{mockDB: mockOrders}}, 10, ttl)
+		conflicting.SaveOrder(t.Context(), entity.Order{OrderUID: "order-4"})
+		if mr.Exists(redisKeyPrefix + "order-4") {
+			t.Error("rejected version must not be put to redis")
+		}
+	})
+
+	t.Run("Order read before an update does not overwrite the new version", func(t *testing.T) {
+		mr, client := newRedis(t)
+		stale := &blockingStorage{mockStorage: mockStorage{mockDB: mockOrders}, release: make(chan struct{})}
+		replica1 := NewRedisCache(client, stale, 10, ttl)
+		replica2 := NewRedisCache(client, &duplicateStorage{mockStorage{mockDB: map[string]entity.Order{
+			"order-1": {OrderUID: "order-1", TrackNumber: "TRACK_NEW"},
+		}}}, 10, ttl)
+
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			replica1.GiveOrderByUID(t.Context(), "order-1")
+		}()
+		for stale.calls.Load() == 0 {
+			time.Sleep(time.Millisecond)
+		}
+		// пока replica1 читает старую версию, replica2 меняет заказ, но перечитать его ещё не успела
+		replica2.Forget(t.Context(), "order-1")
+		close(stale.release)
+		<-done
+		if mr.Exists(redisKeyPrefix + "order-1") {
+			t.Error("order read before the update must not be put to redis")
+		}
+		if mr.TTL(redisGenerationPrefix+"order-1") != redisGenerationTTL {
+			t.Errorf("generation key must expire after %v, got %v", redisGenerationTTL, mr.TTL(redisGenerationPrefix+"order-1"))
+		}
+
+		// сохранение уже известного заказа перезаписывает устаревшую копию свежей версией из хранилища
+		mr.Set(redisKeyPrefix+"order-1", `{"order_uid":"order-1","track_number":"TRACK_A"}`)
+		if _, err := replica2.SaveOrder(t.Context(), entity.Order{OrderUID: "order-1"}); err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		if data, _ := mr.Get(redisKeyPrefix + "order-1"); !strings.Contains(data, "TRACK_NEW") {
+			t.Errorf("redis must hold the version reloaded after the save, got %s", data)
+		}
+	})
+
+	t.Run("Unknown UID and unavailable redis", func(t *testing.T) {
+		mr, client := newRedis(t)
+		cache := NewRedisCache(client, &mockStorage{mockDB: mockOrders}, 10, ttl)
+		cache.EnableNegativeCache(10, time.Minute)
+
+		for range 2 {
+			if _, err := cache.GiveOrderByUID(t.Context(), "missing"); !errors.Is(err, entity.ErrNotFound) {
+				t.Fatalf("expected ErrNotFound, got %v", err)
+			}
+		}
+		if cache.Stats().NegativeHits != 1 {
+			t.Errorf("second request of a missing UID must hit the negative cache, got %+v", cache.Stats())
+		}
+
+		mr.Close()
+		if order, err := cache.GiveOrderByUID(t.Context(), "order-2"); err != nil || order.OrderUID != "order-2" {
+			t.Errorf("order must be read from storage when redis is down, got %+v, err %v", order, err)
+		}
+	})
+
+	t.Run("Admin lists and flushes orders", func(t *testing.T) {
+		mr, client := newRedis(t)
+		cache := NewRedisCache(client, &mockStorage{mockDB: mockOrders}, 10, ttl)
+		mr.Set("foreign-key", "not an order")
+
+		cache.GiveOrderByUID(t.Context(), "order-1")
+		mr.FastForward(time.Minute)
+		cache.GiveOrderByUID(t.Context(), "order-2")
+
+		entries := cache.Entries(t.Context())
+		if len(entries) != 2 || entries[0].OrderUID != "order-2" || entries[1].OrderUID != "order-1" {
+			t.Errorf("expected entries order-2, order-1 (most recent first), got %+v", entries)
+		}
+		if removed := cache.Flush(t.Context()); removed != 2 || !mr.Exists("foreign-key") {
+			t.Errorf("flush must remove only the 2 orders, removed %d", removed)
+		}
+	})
+
+	t.Run("Stats does not query DBSIZE on every call", func(t *testing.T) {
+		mr, client := newRedis(t)
+		cache := NewRedisCache(client, &mockStorage{mockDB: mockOrders}, 10, ttl)
+		mr.Set(redisKeyPrefix+"order-1", "{}")
+		if size := cache.Stats().Size; size != 1 {
+			t.Fatalf("expected size 1, got %d", size)
+		}
+
+		mr.Set(redisKeyPrefix+"order-2", "{}")
+		if size := cache.Stats().Size; size != 1 {
+			t.Errorf("size must be reused until the refresh interval passes, got %d", size)
+		}
+		cache.sizeCheckedAt.Add(-int64(redisSizeRefresh))
+		if size := cache.Stats().Size; size != 2 {
+			t.Errorf("expected refreshed size 2, got %d", size)
+		}
+	})
+}
+
+// fakePublisher запоминает опубликованные события инвалидации
+type fakePublisher struct {
+	mu        sync.Mutex
+	published []string
+}
+
+func (p *fakePublisher) PublishInvalidation(ctx context.Context, UID string, action entity.InvalidationAction) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.published = append(p.published, UID)
+	return nil
+}
+
+// duplicateStorage считает каждое сохранение повтором уже сохранённого заказа
+type duplicateStorage struct {
+	mockStorage
+}
+
+func (m *duplicateStorage) SaveOrder(ctx context.Context, o entity.Order) (entity.SaveResult, error) {
+	return entity.SaveDuplicate, nil
+}
+
+func TestCacheInvalidation(t *testing.T) {
+	mockOrders := map[string]entity.Order{
+		"order-1": {OrderUID: "order-1", TrackNumber: "TRACK_A"},
+		"order-2": {OrderUID: "order-2", TrackNumber: "TRACK_B"},
+	}
+
+	t.Run("Only changed orders are published", func(t *testing.T) {
+		publisher := &fakePublisher{}
+		cache := NewCache(&mockStorage{mockDB: mockOrders}, 3, NewLRUPolicy())
+		cache.EnableInvalidationFanOut(publisher)
+		cache.SaveOrder(t.Context(), entity.Order{OrderUID: "order-3"})
+
+		duplicates := NewCache(&duplicateStorage{mockStorage{mockDB: mockOrders}}, 3, NewLRUPolicy())
+		duplicates.EnableInvalidationFanOut(publisher)
+		duplicates.SaveOrder(t.Context(), entity.Order{OrderUID: "order-4"})
+
+		conflicts := NewCache(&conflictStorage{mockStorage{mockDB: mockOrders}}, 3, NewLRUPolicy())
+		conflicts.EnableInvalidationFanOut(publisher)
+		conflicts.SaveOrder(t.Context(), entity.Order{OrderUID: "order-5"})
+
+		if !slices.Equal(publisher.published, []string{"order-3"}) {
+			t.Errorf("expected only the inserted order-3 to be published, got %v", publisher.published)
+		}
+	})
+
+	t.Run("Event from another replica drops the local copy", func(t *testing.T) {
+		storage := &mockStorage{mockDB: map[string]entity.Order{}}
+		cache := NewCache(storage, 3, NewLRUPolicy())
+		cache.EnableNegativeCache(10, time.Hour)
+		if err := cache.LoadBloomFilter(t.Context(), 100, 0.01); err != nil {
+			t.Fatalf("failed to load bloom filter: %v", err)
+		}
+
+		// order-1 ещё не сохранён: реплика помнит, что его нет
+		cache.GiveOrderByUID(t.Context(), "order-1")
+		cache.addToCache(t.Context(), entity.Order{OrderUID: "order-2", TrackNumber: "OLD"})
+
+		// другая реплика сохранила оба заказа
+		storage.mockDB = mockOrders
+		for _, uid := range []string{"order-1", "order-2"} {
+			cache.ApplyInvalidation(t.Context(), entity.CacheInvalidation{OrderUID: uid, Action: entity.InvalidationSaved, Origin: "replica-b"})
+		}
+
+		if cache.contains("order-2") {
+			t.Error("invalidated order-2 must be removed from the cache")
+		}
+		for uid, track := range map[string]string{"order-1": "TRACK_A", "order-2": "TRACK_B"} {
+			order, err := cache.GiveOrderByUID(t.Context(), uid)
+			if err != nil || order.TrackNumber != track {
+				t.Errorf("expected fresh %s from storage, got %+v, err %v", uid, order, err)
+			}
+		}
+	})
+
+	t.Run("Load racing with an event does not cache the old version", func(t *testing.T) {
+		storage := &blockingStorage{mockStorage: mockStorage{mockDB: mockOrders}, release: make(chan struct{})}
+		cache := NewCache(storage, 3, NewLRUPolicy())
+
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			cache.GiveOrderByUID(t.Context(), "order-1")
+		}()
+		for storage.calls.Load() == 0 {
+			time.Sleep(time.Millisecond)
+		}
+		cache.ApplyInvalidation(t.Context(), entity.CacheInvalidation{OrderUID: "order-1", Action: entity.InvalidationSaved, Origin: "replica-b"})
+		close(storage.release)
+		<-done
 
-		// Пытаемся получить заказ, которого нет ни в кэше, ни в моке БД
-		_, err := cache.GiveOrderByUID("non-existent-order")
+		if cache.contains("order-1") {
+			t.Error("order read before the invalidation must not be cached")
+		}
+	})
+
+	t.Run("Redis cache drops the near-cache copy", func(t *testing.T) {
+		mr := miniredis.RunT(t)
+		client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+		defer client.Close()
+
+		cache := NewRedisCache(client, &mockStorage{mockDB: mockOrders}, 10, time.Hour)
+		cache.EnableNearCache(10, time.Hour)
+		cache.GiveOrderByUID(t.Context(), "order-1")
+		mr.Set(redisKeyPrefix+"order-1", `{"order_uid":"order-1","track_number":"TRACK_NEW"}`)
 
-		if err == nil {
-			t.Fatal("expected an error for a non-existent item, but got nil")
+		cache.ApplyInvalidation(t.Context(), entity.CacheInvalidation{OrderUID: "order-1", Action: entity.InvalidationSaved, Origin: "replica-b"})
+		if order, _ := cache.GiveOrderByUID(t.Context(), "order-1"); order.TrackNumber != "TRACK_NEW" {
+			t.Errorf("expected the new version from redis after invalidation, got %+v", order)
 		}
 	})
 }
+
+// BenchmarkCacheHitRate сравнивает политики на трафике, где большая часть запросов
+// приходится на несколько "горячих" заказов (распределение Ципфа), метрика hit-rate в выводе
+func BenchmarkCacheHitRate(b *testing.B) {
+	const (
+		ordersTotal = 10000
+		cacheCap    = 100
+	)
+	mockOrders := make(map[string]entity.Order, ordersTotal)
+	for i := range ordersTotal {
+		uid := fmt.Sprintf("order-%d", i)
+		mockOrders[uid] = entity.Order{OrderUID: uid}
+	}
+	storage := &mockStorage{mockDB: mockOrders}
+
+	// кэш логирует каждое добавление и вытеснение - в бенчмарке это только шум
+	defaultLogger := slog.Default()
+	slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	defer slog.SetDefault(defaultLogger)
+
+	for name, newPolicy := range policies {
+		b.Run(name, func(b *testing.B) {
+			cache := NewCache(storage, cacheCap, newPolicy(cacheCap))
+			zipf := rand.NewZipf(rand.New(rand.NewSource(1)), 1.1, 1, ordersTotal-1)
+
+			b.ResetTimer()
+			for range b.N {
+				cache.GiveOrderByUID(b.Context(), fmt.Sprintf("order-%d", zipf.Uint64()))
+			}
+			stats := cache.Stats()
+			b.ReportMetric(float64(stats.Hits)/float64(stats.Hits+stats.Misses), "hit-rate")
+		})
+	}
+}
+
+// BenchmarkCacheParallelHits - чтения заказов, которые уже лежат в кэше, из b.RunParallel.
+// Масштабирование по ядрам видно при запуске с -cpu, например:
+//
+//	go test ./internal/service -run '^$' -bench CacheParallelHits -cpu 1,2,4,8
+func BenchmarkCacheParallelHits(b *testing.B) {
+	const cacheCap = 4096
+	mockOrders := make(map[string]entity.Order, cacheCap)
+	uids := make([]string, cacheCap)
+	for i := range cacheCap {
+		uids[i] = fmt.Sprintf("order-%d", i)
+		mockOrders[uids[i]] = entity.Order{OrderUID: uids[i]}
+	}
+	storage := &mockStorage{mockDB: mockOrders}
+
+	defaultLogger := slog.Default()
+	slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	defer slog.SetDefault(defaultLogger)
+
+	for _, shards := range []int{1, 16, 64} {
+		b.Run(fmt.Sprintf("shards=%d", shards), func(b *testing.B) {
+			cache := NewShardedCache(storage, cacheCap, shards, policies[PolicyLRU])
+			// запас по ёмкости, чтобы неравномерность хэша не вытесняла заказы
+			for _, sh := range cache.shards {
+				sh.capacity *= 2
+			}
+			for _, uid := range uids {
+				cache.GiveOrderByUID(b.Context(), uid)
+			}
+
+			var seed atomic.Int64
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				rnd := rand.New(rand.NewSource(seed.Add(1)))
+				for pb.Next() {
+					cache.GiveOrderByUID(b.Context(), uids[rnd.Intn(cacheCap)])
+				}
+			})
+			b.StopTimer()
+			if stats := cache.Stats(); stats.Misses != uint64(cacheCap) {
+				b.Fatalf("benchmark must measure hits only, got %d misses", stats.Misses-uint64(cacheCap))
+			}
+		})
+	}
+}
+
+func TestCanTransition(t *testing.T) {
+	allowed := [][2]entity.OrderStatus{
+		{entity.StatusCreated, entity.StatusPaid},
+		{entity.StatusPaid, entity.StatusAssembled},
+		{entity.StatusAssembled, entity.StatusShipped},
+		{entity.StatusShipped, entity.StatusDelivered},
+		{entity.StatusCreated, entity.StatusCancelled},
+		{entity.StatusAssembled, entity.StatusCancelled},
+		{entity.StatusShipped, entity.StatusReturned},
+		{entity.StatusDelivered, entity.StatusReturned},
+	}
+	for _, tr := range allowed {
+		if err := CanTransition(tr[0], tr[1]); err != nil {
+			t.Errorf("expected %s -> %s to be allowed, got %v", tr[0], tr[1], err)
+		}
+	}
+
+	forbidden := [][2]entity.OrderStatus{
+		{entity.StatusCreated, entity.StatusShipped},
+		{entity.StatusPaid, entity.StatusCreated},
+		{entity.StatusShipped, entity.StatusCancelled},
+		{entity.StatusDelivered, entity.StatusShipped},
+		{entity.StatusCancelled, entity.StatusPaid},
+		{entity.StatusReturned, entity.StatusDelivered},
+		{entity.StatusCreated, "lost"},
+		{"lost", entity.StatusPaid},
+	}
+	for _, tr := range forbidden {
+		if err := CanTransition(tr[0], tr[1]); !errors.Is(err, entity.ErrInvalidTransition) {
+			t.Errorf("expected %s -> %s to be rejected with ErrInvalidTransition, got %v", tr[0], tr[1], err)
+		}
+	}
+}
+
+// fakeStatusStorage хранит статусы и историю в памяти
+type fakeStatusStorage struct {
+	statuses map[string]entity.OrderStatus
+	history  []entity.StatusChange
+}
+
+func (m *fakeStatusStorage) GetOrderStatus(ctx context.Context, UID string) (entity.OrderStatus, error) {
+	status, ok := m.statuses[UID]
+	if !ok {
+		return "", entity.ErrNotFound
+	}
+	return status, nil
+}
+
+func (m *fakeStatusStorage) ChangeOrderStatus(ctx context.Context, change entity.StatusChange) error {
+	if m.statuses[change.OrderUID] != change.From {
+		return entity.ErrInvalidTransition
+	}
+	m.statuses[change.OrderUID] = change.To
+	m.history = append(m.history, change)
+	return nil
+}
+
+func (m *fakeStatusStorage) GetStatusHistory(ctx context.Context, UID string) ([]entity.StatusChange, error) {
+	return m.history, nil
+}
+
+func TestStatusService(t *testing.T) {
+	storage := &fakeStatusStorage{statuses: map[string]entity.OrderStatus{"order-1": entity.StatusCreated}}
+	// так заказ выглядит в хранилище после смены статуса
+	db := map[string]entity.Order{"order-1": {OrderUID: "order-1", Status: entity.StatusPaid}}
+	cache := NewCache(&mockStorage{mockDB: db}, 3, NewLRUPolicy())
+	cache.addToCache(t.Context(), entity.Order{OrderUID: "order-1", Status: entity.StatusCreated})
+	publisher := &fakePublisher{}
+	statuses := NewStatusService(storage, cache)
+	statuses.EnableInvalidationFanOut(publisher)
+
+	change, err := statuses.ChangeStatus(t.Context(), entity.StatusEvent{OrderUID: "order-1", Status: entity.StatusPaid, Reason: "payment confirmed"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if change.From != entity.StatusCreated || change.To != entity.StatusPaid || change.ChangedAt.IsZero() {
+		t.Errorf("unexpected change %+v", change)
+	}
+	if cached, ok := cache.shard("order-1").peek("order-1"); !ok || cached.Status != entity.StatusPaid {
+		t.Errorf("expected the cached copy to be refreshed after a status change, got %+v", cached)
+	}
+	if !slices.Equal(publisher.published, []string{"order-1"}) {
+		t.Errorf("expected the status change to be published, got %v", publisher.published)
+	}
+
+	// повтор того же события ничего не меняет
+	if _, err := statuses.ChangeStatus(t.Context(), entity.StatusEvent{OrderUID: "order-1", Status: entity.StatusPaid}); err != nil {
+		t.Errorf("expected a redelivered event to be a no-op, got %v", err)
+	}
+	if len(storage.history) != 1 {
+		t.Errorf("expected 1 history entry, got %d", len(storage.history))
+	}
+
+	_, err = statuses.ChangeStatus(t.Context(), entity.StatusEvent{OrderUID: "order-1", Status: entity.StatusDelivered})
+	if !errors.Is(err, entity.ErrInvalidTransition) {
+		t.Errorf("expected ErrInvalidTransition for paid -> delivered, got %v", err)
+	}
+	_, err = statuses.ChangeStatus(t.Context(), entity.StatusEvent{OrderUID: "missing", Status: entity.StatusPaid})
+	if !errors.Is(err, entity.ErrNotFound) {
+		t.Errorf("expected ErrNotFound for an unknown order, got %v", err)
+	}
+
+	history, err := statuses.StatusHistory(t.Context(), "order-1")
+	if err != nil || len(history) != 1 || history[0].To != entity.StatusPaid {
+		t.Errorf("unexpected history %+v, %v", history, err)
+	}
+}
+
+func TestSaveOrderCachesCreatedStatus(t *testing.T) {
+	returnedAt := time.Now()
+	items := []entity.Item{{Rid: "rid-1", ReturnedAt: &returnedAt}}
+	incoming := entity.Order{OrderUID: "order-1", Status: entity.StatusDelivered, Items: items}
+
+	cache := NewCache(&mockStorage{mockDB: map[string]entity.Order{}}, 3, NewLRUPolicy())
+	if _, err := cache.SaveOrder(t.Context(), incoming); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	got, err := cache.GiveOrderByUID(t.Context(), "order-1")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got.Status != entity.StatusCreated {
+		t.Errorf("expected a new order to be cached as %q, got %q", entity.StatusCreated, got.Status)
+	}
+	// хранилище не вставляет returned_at, возврат товара отмечает только отдельное событие
+	if got.Items[0].ReturnedAt != nil {
+		t.Errorf("expected a new order to be cached without returned_at, got %v", got.Items[0].ReturnedAt)
+	}
+	if items[0].ReturnedAt == nil {
+		t.Error("caching must not change the items of the saved message")
+	}
+
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	defer client.Close()
+	redisCache := NewRedisCache(client, &mockStorage{mockDB: map[string]entity.Order{}}, 3, time.Hour)
+	if _, err := redisCache.SaveOrder(t.Context(), incoming); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got, _ := redisCache.GiveOrderByUID(t.Context(), "order-1"); got.Status != entity.StatusCreated || got.Items[0].ReturnedAt != nil {
+		t.Errorf("expected a new order in redis as %q without returned_at, got %+v", entity.StatusCreated, got)
+	}
+
+	// статус уже сохранённого заказа знает только хранилище - копия из сообщения в кэш не попадает
+	duplicates := NewCache(&duplicateStorage{mockStorage{mockDB: map[string]entity.Order{}}}, 3, NewLRUPolicy())
+	duplicates.addToCache(t.Context(), entity.Order{OrderUID: "order-1", Status: entity.StatusShipped})
+	duplicates.SaveOrder(t.Context(), entity.Order{OrderUID: "order-1"})
+	if duplicates.contains("order-1") {
+		t.Error("expected a redelivered order to be dropped from the cache")
+	}
+}
+
+// fakeEventStorage запоминает изменения заказов, err возвращается на каждое из них
+type fakeEventStorage struct {
+	calls      []string
+	allowed    [][]entity.OrderStatus
+	returnedAt time.Time
+	err        error
+}
+
+func (m *fakeEventStorage) record(call string, allowed []entity.OrderStatus) error {
+	if m.err != nil {
+		return m.err
+	}
+	m.calls = append(m.calls, call)
+	m.allowed = append(m.allowed, allowed)
+	return nil
+}
+
+func (m *fakeEventStorage) UpdateOrder(ctx context.Context, UID string, patch entity.OrderPatch, allowed []entity.OrderStatus) error {
+	return m.record("update:"+UID, allowed)
+}
+
+func (m *fakeEventStorage) ChangeDelivery(ctx context.Context, UID string, d entity.Delivery, allowed []entity.OrderStatus) error {
+	return m.record("delivery:"+UID, allowed)
+}
+
+func (m *fakeEventStorage) ReturnItems(ctx context.Context, UID string, rids []string, returnedAt time.Time, allowed []entity.OrderStatus) error {
+	m.returnedAt = returnedAt
+	return m.record("return:"+UID, allowed)
+}
+
+func TestOrderEvents(t *testing.T) {
+	track := "TRACK_NEW"
+	db := map[string]entity.Order{"order-1": {OrderUID: "order-1", TrackNumber: track}}
+	cache := NewCache(&mockStorage{mockDB: db}, 3, NewLRUPolicy())
+	cache.addToCache(t.Context(), entity.Order{OrderUID: "order-1", TrackNumber: "TRACK_OLD"})
+	storage := &fakeEventStorage{}
+	statusStorage := &fakeStatusStorage{statuses: map[string]entity.OrderStatus{"order-1": entity.StatusPaid}}
+	publisher := &fakePublisher{}
+	statuses := NewStatusService(statusStorage, cache)
+	statuses.EnableInvalidationFanOut(publisher)
+	events := NewOrderEvents(storage, cache, statuses)
+	events.EnableInvalidationFanOut(publisher)
+
+	if err := events.UpdateOrder(t.Context(), "order-1", entity.OrderPatch{TrackNumber: &track}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cached, ok := cache.shard("order-1").peek("order-1"); !ok || cached.TrackNumber != track {
+		t.Errorf("expected the cached copy to be refreshed after an update, got %+v", cached)
+	}
+	if err := events.ChangeDelivery(t.Context(), "order-1", entity.Delivery{Name: "Test"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	returnedAt := time.Date(2026, 3, 2, 9, 0, 0, 0, time.UTC)
+	if err := events.ReturnItems(t.Context(), "order-1", entity.ItemsReturn{Rids: []string{"rid-1"}, ReturnedAt: returnedAt}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !storage.returnedAt.Equal(returnedAt) {
+		t.Errorf("expected items to be returned at the time from the event %v, got %v", returnedAt, storage.returnedAt)
+	}
+
+	if !slices.Equal(storage.calls, []string{"update:order-1", "delivery:order-1", "return:order-1"}) {
+		t.Errorf("unexpected storage calls %v", storage.calls)
+	}
+	// менять можно до отгрузки, возвращать - после
+	if slices.Contains(storage.allowed[0], entity.StatusShipped) || slices.Contains(storage.allowed[1], entity.StatusShipped) {
+		t.Errorf("expected shipped orders to be immutable, got %v", storage.allowed)
+	}
+	if !slices.Contains(storage.allowed[2], entity.StatusDelivered) || slices.Contains(storage.allowed[2], entity.StatusCreated) {
+		t.Errorf("expected only shipped orders to accept returns, got %v", storage.allowed[2])
+	}
+
+	if err := events.CancelOrder(t.Context(), "order-1", entity.Cancellation{Reason: "changed my mind"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if statusStorage.statuses["order-1"] != entity.StatusCancelled || statusStorage.history[0].Reason != "changed my mind" {
+		t.Errorf("expected the order to be cancelled through the status machine, got %v", statusStorage.history)
+	}
+	if len(publisher.published) != 4 {
+		t.Errorf("expected every change to be published, got %v", publisher.published)
+	}
+
+	storage.err = fmt.Errorf("order order-1 is shipped: %w", entity.ErrInvalidTransition)
+	if err := events.UpdateOrder(t.Context(), "order-1", entity.OrderPatch{TrackNumber: &track}); !errors.Is(err, entity.ErrInvalidTransition) {
+		t.Errorf("expected ErrInvalidTransition, got %v", err)
+	}
+	if len(publisher.published) != 4 {
+		t.Errorf("expected a failed change not to be published, got %v", publisher.published)
+	}
+}
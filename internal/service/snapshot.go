@@ -0,0 +1,182 @@
+package service
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"github.com/Asus/L0_DemoServise/internal/entity"
+)
+
+// снапшот кэша на диске: первая строка - заголовок в JSON, дальше JSON-массив заказов
+// от давно не запрашиваемых к недавним. контрольная сумма в заголовке считается по массиву
+const snapshotVersion = 1
+
+// ErrSnapshotCorrupt - снапшот не читается или не сходится контрольная сумма, кэш нужно грузить из БД
+var ErrSnapshotCorrupt = errors.New("cache snapshot is corrupt")
+
+type snapshotHeader struct {
+	Version   int       `json:"version"`
+	CreatedAt time.Time `json:"created_at"`
+	Count     int       `json:"count"`
+	SHA256    string    `json:"sha256"`
+}
+
+// WriteSnapshot атомарно записывает содержимое кэша в path: данные пишутся во временный файл
+// рядом и переименовываются в path, поэтому при падении посреди записи старый снапшот остаётся целым
+func (s *Cache) WriteSnapshot(path string) error {
+	// время берём до обхода кэша: заказы, сохранённые во время обхода, догрузятся при сверке с БД
+	createdAt := time.Now()
+	orders := s.ordersByRecency()
+
+	payload, err := json.Marshal(orders)
+	if err != nil {
+		return fmt.Errorf("failed to encode cache snapshot: %w", err)
+	}
+	sum := sha256.Sum256(payload)
+	header, err := json.Marshal(snapshotHeader{
+		Version:   snapshotVersion,
+		CreatedAt: createdAt,
+		Count:     len(orders),
+		SHA256:    hex.EncodeToString(sum[:]),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to encode cache snapshot header: %w", err)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return fmt.Errorf("failed to create cache snapshot directory: %w", err)
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return fmt.Errorf("failed to create cache snapshot file: %w", err)
+	}
+	defer os.Remove(tmp.Name()) // после успешного Rename файла с таким именем уже нет
+
+	w := bufio.NewWriter(tmp)
+	w.Write(header)
+	w.WriteByte('\n')
+	w.Write(payload)
+	if err := w.Flush(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write cache snapshot: %w", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to sync cache snapshot: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to close cache snapshot: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("failed to replace cache snapshot: %w", err)
+	}
+
+	slog.Info("Cache snapshot written", "path", path, "orders", len(orders))
+	return nil
+}
+
+// LoadSnapshot наполняет кэш из снапшота и возвращает время, когда снапшот был снят.
+// Заказы добавляются в записанном порядке, поэтому недавно запрошенные вытесняются последними.
+// Нет файла - ошибка с os.ErrNotExist, битый файл - ErrSnapshotCorrupt
+func (s *Cache) LoadSnapshot(ctx context.Context, path string) (time.Time, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("failed to read cache snapshot: %w", err)
+	}
+
+	line, payload, ok := bytes.Cut(data, []byte{'\n'})
+	if !ok {
+		return time.Time{}, fmt.Errorf("%w: no header", ErrSnapshotCorrupt)
+	}
+	var header snapshotHeader
+	if err := json.Unmarshal(line, &header); err != nil {
+		return time.Time{}, fmt.Errorf("%w: bad header: %v", ErrSnapshotCorrupt, err)
+	}
+	if header.Version != snapshotVersion {
+		return time.Time{}, fmt.Errorf("%w: unsupported version %d", ErrSnapshotCorrupt, header.Version)
+	}
+	sum := sha256.Sum256(payload)
+	if hex.EncodeToString(sum[:]) != header.SHA256 {
+		return time.Time{}, fmt.Errorf("%w: checksum mismatch", ErrSnapshotCorrupt)
+	}
+
+	var orders []entity.Order
+	if err := json.Unmarshal(payload, &orders); err != nil {
+		return time.Time{}, fmt.Errorf("%w: bad orders: %v", ErrSnapshotCorrupt, err)
+	}
+	if len(orders) != header.Count {
+		return time.Time{}, fmt.Errorf("%w: expected %d orders, got %d", ErrSnapshotCorrupt, header.Count, len(orders))
+	}
+
+	for _, ord := range orders {
+		s.addToCache(ctx, ord)
+	}
+	return header.CreatedAt, nil
+}
+
+// Reconcile догружает в кэш заказы, записанные в хранилище позже since,
+// и возвращает их число. Вызывается после LoadSnapshot
+func (s *Cache) Reconcile(ctx context.Context, since time.Time) (int, error) {
+	orders, err := s.OrderTaker.GetOrdersUpdatedSince(ctx, since)
+	if err != nil {
+		return 0, fmt.Errorf("error occurred while reconciling cache with storage: %w", err)
+	}
+	for _, ord := range orders {
+		s.notFound.invalidate(ord.OrderUID)
+		s.addToCache(ctx, ord)
+	}
+	return len(orders), nil
+}
+
+// RunSnapshots пишет снапшот каждые interval, пока не отменён ctx
+func (s *Cache) RunSnapshots(ctx context.Context, path string, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := s.WriteSnapshot(path); err != nil {
+				slog.Error("Failed to write cache snapshot", "path", path, "error", err)
+			}
+		}
+	}
+}
+
+// ordersByRecency - все заказы кэша, сначала те, к которым дольше всего не обращались
+func (s *Cache) ordersByRecency() []entity.Order {
+	type accessed struct {
+		order      entity.Order
+		lastAccess time.Time
+	}
+	var all []accessed
+	for _, sh := range s.shards {
+		sh.lock()
+		for UID, ord := range sh.orders {
+			all = append(all, accessed{order: ord, lastAccess: sh.lastAccess[UID]})
+		}
+		sh.mu.Unlock()
+	}
+	slices.SortFunc(all, func(a, b accessed) int {
+		return a.lastAccess.Compare(b.lastAccess)
+	})
+
+	orders := make([]entity.Order, len(all))
+	for i, a := range all {
+		orders[i] = a.order
+	}
+	return orders
+}
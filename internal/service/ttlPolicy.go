@@ -0,0 +1,64 @@
+package service
+
+import "time"
+
+// TTLPolicy хранит заказ не дольше ttl с момента добавления, обращения срок не продлевают.
+// Если кэш заполнен раньше, вытесняется заказ, который устареет первым.
+// Очередь с приоритетом упорядочена по времени устаревания (Item.Priority)
+type TTLPolicy struct {
+	ttl   time.Duration
+	queue *SafePriorityQueue
+	items map[string]*Item
+	now   func() time.Time // подменяется в тестах
+}
+
+func NewTTLPolicy(ttl time.Duration) *TTLPolicy {
+	return &TTLPolicy{
+		ttl:   ttl,
+		queue: NewSafePriorityQueue(0),
+		items: make(map[string]*Item),
+		now:   time.Now,
+	}
+}
+
+func (p *TTLPolicy) Add(UID string) {
+	expiresAt := p.now().Add(p.ttl)
+	if item, ok := p.items[UID]; ok {
+		p.queue.Update(item, expiresAt) // заказ перезаписан - срок считается заново
+		return
+	}
+	item := &Item{Value: UID, Priority: expiresAt}
+	p.queue.Push(item)
+	p.items[UID] = item
+}
+
+func (p *TTLPolicy) Touch(UID string) {}
+
+func (p *TTLPolicy) Remove(UID string) {
+	if item, ok := p.items[UID]; ok {
+		p.queue.Remove(item)
+		delete(p.items, UID)
+	}
+}
+
+func (p *TTLPolicy) Evict(incoming string) (string, bool) {
+	item := p.queue.Pop()
+	if item == nil {
+		return "", false
+	}
+	delete(p.items, item.Value)
+	return item.Value, true
+}
+
+func (p *TTLPolicy) Len() int { return len(p.items) }
+
+// Contains - UID хранится в политике, даже если уже устарел
+func (p *TTLPolicy) Contains(UID string) bool {
+	_, ok := p.items[UID]
+	return ok
+}
+
+func (p *TTLPolicy) Expired(UID string) bool {
+	item, ok := p.items[UID]
+	return ok && !p.now().Before(item.Priority)
+}
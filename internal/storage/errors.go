@@ -0,0 +1,54 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/Asus/L0_DemoServise/internal/entity"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// classifyError помечает ошибку Postgres ошибкой предметной области из entity.
+// Вызывается через defer с именованной ошибкой, исходная ошибка остаётся в цепочке
+func classifyError(err *error) {
+	if *err == nil {
+		return
+	}
+	if kind := errorKind(*err); kind != nil && !errors.Is(*err, kind) {
+		*err = fmt.Errorf("%w: %w", kind, *err)
+	}
+}
+
+func errorKind(err error) error {
+	if errors.Is(err, context.Canceled) {
+		return nil // запрос отменил клиент, с БД всё в порядке
+	}
+
+	var pgErr *pgconn.PgError
+	if !errors.As(err, &pgErr) {
+		// ответа от сервера нет: не удалось подключиться, соединение оборвалось или вышел таймаут
+		var (
+			connectErr *pgconn.ConnectError
+			netErr     net.Error
+		)
+		if errors.As(err, &connectErr) || errors.As(err, &netErr) || pgconn.Timeout(err) || pgconn.SafeToRetry(err) ||
+			errors.Is(err, context.DeadlineExceeded) {
+			return entity.ErrUnavailable
+		}
+		return nil
+	}
+
+	class := pgErr.Code[:min(len(pgErr.Code), 2)] // класс SQLSTATE; Code может оказаться короче
+	switch {
+	case pgErr.Code == "23505": // unique_violation
+		return entity.ErrDuplicate
+	case class == "22", class == "23": // данные или ограничения
+		return entity.ErrInvalidOrder
+	case class == "08", class == "53", pgErr.Code == "57P01", pgErr.Code == "57P03":
+		// нет соединения, нехватка ресурсов, сервер останавливается или ещё не готов
+		return entity.ErrUnavailable
+	}
+	return nil
+}
@@ -0,0 +1,40 @@
+package storage
+
+import (
+	"cmp"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/Asus/L0_DemoServise/internal/entity"
+)
+
+// orderHash считает отпечаток содержимого заказа, по нему SaveOrder отличает точный дубликат от изменённого заказа.
+// Перед подсчётом заказ приводится к тому виду, в котором он хранится в БД: время в UTC с точностью до микросекунд,
+// order_uid вложенных структур не учитывается (в БД он берётся из самого заказа), товары отсортированы по rid
+func orderHash(o entity.Order) (string, error) {
+	o.DateCreated = o.DateCreated.UTC().Truncate(time.Microsecond)
+	o.Payment.PaymentDt = o.Payment.PaymentDt.UTC().Truncate(time.Microsecond)
+	o.Delivery.OrderUID = ""
+	o.Payment.OrderUID = ""
+	o.Status = "" // статус меняется отдельно от содержимого заказа
+
+	items := make([]entity.Item, len(o.Items))
+	copy(items, o.Items) // копия, чтобы не менять слайс вызывающего
+	for i := range items {
+		items[i].OrderUID = ""
+		items[i].ReturnedAt = nil // возврат меняется отдельным событием
+	}
+	slices.SortFunc(items, func(a, b entity.Item) int { return cmp.Compare(a.Rid, b.Rid) })
+	o.Items = items
+
+	data, err := json.Marshal(o)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal order %s for hashing: %w", o.OrderUID, err)
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
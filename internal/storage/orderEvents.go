@@ -0,0 +1,161 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/Asus/L0_DemoServise/internal/entity"
+	"github.com/jackc/pgx/v5"
+)
+
+// методы для событий об уже сохранённом заказе. Каждый работает в своей транзакции: блокирует строку
+// заказа, проверяет, что в текущем статусе изменение допустимо, и отмечает заказ изменённым (updated_at).
+// Если изменение затрагивает содержимое заказа, в той же транзакции пересчитывается content_hash
+
+// UpdateOrder меняет переданные в patch поля заказа. Новый track_number переносится и в товары
+func (s *Storage) UpdateOrder(ctx context.Context, orderUID string, patch entity.OrderPatch, allowed []entity.OrderStatus) (err error) {
+	defer observe("update_order", time.Now(), &err)
+	defer classifyError(&err)
+
+	return s.inOrderTx(ctx, orderUID, allowed, func(tx pgx.Tx) error {
+		// NULL в COALESCE - поле не передано и остаётся прежним
+		_, err := tx.Exec(ctx, `
+			UPDATE orders SET
+				track_number = COALESCE($2, track_number), entry = COALESCE($3, entry), locale = COALESCE($4, locale),
+				internal_signature = COALESCE($5, internal_signature), customer_id = COALESCE($6, customer_id),
+				delivery_service = COALESCE($7, delivery_service), shardkey = COALESCE($8, shardkey),
+				sm_id = COALESCE($9, sm_id), oof_shard = COALESCE($10, oof_shard), updated_at = now()
+			WHERE order_uid = $1`,
+			orderUID, patch.TrackNumber, patch.Entry, patch.Locale, patch.InternalSignature, patch.CustomerID,
+			patch.DeliveryService, patch.ShardKey, patch.SmID, patch.OofShard,
+		)
+		if err != nil {
+			return fmt.Errorf("failed to update orders: %w", err)
+		}
+		if patch.TrackNumber != nil {
+			_, err = tx.Exec(ctx, `UPDATE items SET track_number = $2 WHERE order_uid = $1`, orderUID, *patch.TrackNumber)
+			if err != nil {
+				return fmt.Errorf("failed to update items track number: %w", err)
+			}
+		}
+		return rehashOrder(ctx, tx, orderUID)
+	})
+}
+
+// ChangeDelivery заменяет адрес и контакты доставки заказа
+func (s *Storage) ChangeDelivery(ctx context.Context, orderUID string, d entity.Delivery, allowed []entity.OrderStatus) (err error) {
+	defer observe("change_delivery", time.Now(), &err)
+	defer classifyError(&err)
+
+	return s.inOrderTx(ctx, orderUID, allowed, func(tx pgx.Tx) error {
+		_, err := tx.Exec(ctx,
+			`UPDATE delivery SET name = $2, phone = $3, zip = $4, city = $5, address = $6, region = $7, email = $8 WHERE order_uid = $1`,
+			orderUID, d.Name, d.Phone, d.Zip, d.City, d.Address, d.Region, d.Email,
+		)
+		if err != nil {
+			return fmt.Errorf("failed to update delivery: %w", err)
+		}
+		if err := touchOrder(ctx, tx, orderUID); err != nil {
+			return err
+		}
+		return rehashOrder(ctx, tx, orderUID)
+	})
+}
+
+// ReturnItems отмечает товары rids возвращёнными в returnedAt. Уже возвращённые товары не меняются,
+// товары чужого заказа или несуществующие - ошибка entity.ErrInvalidOrder
+func (s *Storage) ReturnItems(ctx context.Context, orderUID string, rids []string, returnedAt time.Time, allowed []entity.OrderStatus) (err error) {
+	defer observe("return_items", time.Now(), &err)
+	defer classifyError(&err)
+
+	rids = slices.Compact(slices.Sorted(slices.Values(rids)))
+	return s.inOrderTx(ctx, orderUID, allowed, func(tx pgx.Tx) error {
+		var known int
+		err := tx.QueryRow(ctx, `SELECT count(*) FROM items WHERE order_uid = $1 AND rid = ANY($2)`, orderUID, rids).Scan(&known)
+		if err != nil {
+			return fmt.Errorf("failed to count items: %w", err)
+		}
+		if known != len(rids) {
+			return fmt.Errorf("%w: %d of %d returned items do not belong to order %s", entity.ErrInvalidOrder, len(rids)-known, len(rids), orderUID)
+		}
+
+		_, err = tx.Exec(ctx,
+			`UPDATE items SET returned_at = $3 WHERE order_uid = $1 AND rid = ANY($2) AND returned_at IS NULL`,
+			orderUID, rids, returnedAt,
+		)
+		if err != nil {
+			return fmt.Errorf("failed to update items: %w", err)
+		}
+		return touchOrder(ctx, tx, orderUID)
+	})
+}
+
+// inOrderTx выполняет fn в транзакции, заблокировав строку заказа и проверив его статус
+func (s *Storage) inOrderTx(ctx context.Context, orderUID string, allowed []entity.OrderStatus, fn func(tx pgx.Tx) error) (err error) {
+	tx, err := s.pool.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("error while starting transaction %w", err)
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback(ctx)
+		}
+	}()
+
+	var status string
+	err = tx.QueryRow(ctx, `SELECT status FROM orders WHERE order_uid = $1 FOR UPDATE`, orderUID).Scan(&status)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return fmt.Errorf("order %s: %w", orderUID, entity.ErrNotFound)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read order status: %w", err)
+	}
+	if !slices.Contains(allowed, entity.OrderStatus(status)) {
+		return fmt.Errorf("%w: order %s is %s", entity.ErrInvalidTransition, orderUID, status)
+	}
+
+	if err = fn(tx); err != nil {
+		return err
+	}
+	if err = tx.Commit(ctx); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return nil
+}
+
+// touchOrder отмечает заказ изменённым, чтобы его подхватила сверка снапшота кэша
+func touchOrder(ctx context.Context, tx pgx.Tx, orderUID string) error {
+	if _, err := tx.Exec(ctx, `UPDATE orders SET updated_at = now() WHERE order_uid = $1`, orderUID); err != nil {
+		return fmt.Errorf("failed to update orders: %w", err)
+	}
+	return nil
+}
+
+// rehashOrder пересчитывает content_hash по изменённому заказу, чтобы копия текущего заказа
+// считалась дубликатом, а не изменённой версией
+func rehashOrder(ctx context.Context, tx pgx.Tx, orderUID string) error {
+	rows, err := tx.Query(ctx, orderQuery+"\nWHERE o.order_uid = $1", orderUID)
+	if err != nil {
+		return fmt.Errorf("failed to query updated order: %w", err)
+	}
+	defer rows.Close()
+	orders, err := collectOrders(rows)
+	if err != nil {
+		return err
+	}
+	if len(orders) == 0 {
+		return fmt.Errorf("order %s: %w", orderUID, entity.ErrNotFound)
+	}
+
+	hash, err := orderHash(orders[0])
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec(ctx, `UPDATE orders SET content_hash = $2 WHERE order_uid = $1`, orderUID, hash); err != nil {
+		return fmt.Errorf("failed to update order hash: %w", err)
+	}
+	return nil
+}
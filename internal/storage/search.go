@@ -0,0 +1,132 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/Asus/L0_DemoServise/internal/entity"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// SearchOrders возвращает страницу заказов, подходящих под фильтр.
+// Используется keyset-пагинация: следующая страница начинается строго после (date_created, order_uid) курсора,
+// поэтому новые заказы не сдвигают страницы, а запрос не тормозит на больших смещениях
+func (s *Storage) SearchOrders(ctx context.Context, q entity.OrderSearch) (_ entity.OrderPage, err error) {
+	defer classifyError(&err)
+
+	var (
+		conds []string
+		args  []any
+	)
+	// arg добавляет аргумент запроса и возвращает его плейсхолдер
+	arg := func(v any) string {
+		args = append(args, v)
+		return fmt.Sprintf("$%d", len(args))
+	}
+
+	f := q.Filter
+	if f.CustomerID != "" {
+		conds = append(conds, "o.customer_id = "+arg(f.CustomerID))
+	}
+	if f.TrackNumber != "" {
+		conds = append(conds, "o.track_number = "+arg(f.TrackNumber))
+	}
+	if f.DeliveryService != "" {
+		conds = append(conds, "o.delivery_service = "+arg(f.DeliveryService))
+	}
+	if f.Locale != "" {
+		conds = append(conds, "o.locale = "+arg(f.Locale))
+	}
+	if !f.CreatedFrom.IsZero() {
+		conds = append(conds, "o.date_created >= "+arg(f.CreatedFrom))
+	}
+	if !f.CreatedTo.IsZero() {
+		conds = append(conds, "o.date_created < "+arg(f.CreatedTo))
+	}
+	if f.NmID != 0 || f.Brand != "" {
+		itemConds := []string{"it.order_uid = o.order_uid"}
+		if f.NmID != 0 {
+			itemConds = append(itemConds, "it.nm_id = "+arg(f.NmID))
+		}
+		if f.Brand != "" {
+			itemConds = append(itemConds, "it.brand = "+arg(f.Brand))
+		}
+		conds = append(conds, "EXISTS (SELECT 1 FROM items it WHERE "+strings.Join(itemConds, " AND ")+")")
+	}
+
+	direction, cmp := "DESC", "<"
+	if q.Ascending {
+		direction, cmp = "ASC", ">"
+	}
+	if q.After != nil {
+		conds = append(conds, fmt.Sprintf("(o.date_created, o.order_uid) %s (%s, %s)", cmp, arg(q.After.DateCreated), arg(q.After.OrderUID)))
+	}
+
+	where := ""
+	if len(conds) > 0 {
+		where = "WHERE " + strings.Join(conds, " AND ")
+	}
+
+	// берём на один заказ больше, чтобы понять, есть ли следующая страница
+	query := fmt.Sprintf(`
+		WITH page AS (
+			SELECT o.order_uid FROM orders o
+			%s
+			ORDER BY o.date_created %s, o.order_uid %s
+			LIMIT %s
+		)`, where, direction, direction, arg(q.Limit+1)) +
+		orderQuery +
+		fmt.Sprintf("JOIN page ON page.order_uid = o.order_uid\nORDER BY o.date_created %s, o.order_uid %s, i.rid", direction, direction)
+
+	rows, err := s.pool.Query(ctx, query, args...)
+	if err != nil {
+		return entity.OrderPage{}, fmt.Errorf("failed to search orders: %w", err)
+	}
+	defer rows.Close()
+
+	orders, err := collectOrders(rows)
+	if err != nil {
+		return entity.OrderPage{}, err
+	}
+
+	page := entity.OrderPage{Orders: orders}
+	if len(orders) > q.Limit {
+		page.Orders = orders[:q.Limit]
+		last := page.Orders[q.Limit-1]
+		page.NextCursor = entity.OrderCursor{DateCreated: last.DateCreated, OrderUID: last.OrderUID}.Encode()
+	}
+	return page, nil
+}
+
+// collectOrders собирает заказы из строк orderQuery (одна строка на товар).
+// Строки одного заказа должны идти подряд, порядок заказов сохраняется
+func collectOrders(rows pgx.Rows) ([]entity.Order, error) {
+	orders := make([]entity.Order, 0)
+
+	for rows.Next() {
+		var order entity.Order
+		var item entity.Item
+
+		if err := scanDataFromRows(rows, &order, &item); err != nil {
+			return nil, fmt.Errorf("failed to scan row: %w", err)
+		}
+
+		// новая строка того же заказа - только добавляем товар
+		if n := len(orders); n == 0 || orders[n-1].OrderUID != order.OrderUID {
+			orders = append(orders, order)
+		}
+
+		// Добавляем item, если он есть (rid != "")
+		if item.Rid != "" {
+			last := &orders[len(orders)-1]
+			last.Items = append(last.Items, item)
+		}
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error during rows iteration: %w", err)
+	}
+	return orders, nil
+}
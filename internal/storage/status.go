@@ -0,0 +1,125 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/Asus/L0_DemoServise/internal/entity"
+	"github.com/jackc/pgx/v5"
+)
+
+// GetOrderStatus возвращает текущий статус заказа
+func (s *Storage) GetOrderStatus(ctx context.Context, orderUID string) (_ entity.OrderStatus, err error) {
+	defer classifyError(&err)
+
+	var status string
+	err = s.pool.QueryRow(ctx, `SELECT status FROM orders WHERE order_uid = $1`, orderUID).Scan(&status)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return "", fmt.Errorf("order %s: %w", orderUID, entity.ErrNotFound)
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to read order status: %w", err)
+	}
+	return entity.OrderStatus(status), nil
+}
+
+// ChangeOrderStatus переводит заказ из change.From в change.To и записывает переход в историю.
+// Допустимость перехода проверяет вызывающий; здесь статус меняется, только если он всё ещё change.From,
+// иначе (заказ успели перевести другим событием) возвращается entity.ErrInvalidTransition
+func (s *Storage) ChangeOrderStatus(ctx context.Context, change entity.StatusChange) (err error) {
+	defer observe("change_order_status", time.Now(), &err)
+	defer classifyError(&err)
+
+	tx, err := s.pool.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("error while starting transaction %w", err)
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback(ctx)
+		}
+	}()
+
+	tag, err := tx.Exec(ctx,
+		`UPDATE orders SET status = $3, updated_at = now() WHERE order_uid = $1 AND status = $2`,
+		change.OrderUID, string(change.From), string(change.To),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to update order status: %w", err)
+	}
+	if tag.RowsAffected() == 0 {
+		var current string
+		err = tx.QueryRow(ctx, `SELECT status FROM orders WHERE order_uid = $1`, change.OrderUID).Scan(&current)
+		if errors.Is(err, pgx.ErrNoRows) {
+			return fmt.Errorf("order %s: %w", change.OrderUID, entity.ErrNotFound)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read order status: %w", err)
+		}
+		return fmt.Errorf("%w: order %s is %s, not %s", entity.ErrInvalidTransition, change.OrderUID, current, change.From)
+	}
+
+	_, err = tx.Exec(ctx,
+		`INSERT INTO order_status_history (order_uid, from_status, to_status, changed_at, reason) VALUES ($1, $2, $3, $4, $5)`,
+		change.OrderUID, string(change.From), string(change.To), change.ChangedAt, change.Reason,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to insert into order_status_history: %w", err)
+	}
+
+	if err = tx.Commit(ctx); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return nil
+}
+
+// GetStatusHistory возвращает историю статусов заказа от старых записей к новым.
+// У заказов, сохранённых до появления истории, она пустая
+func (s *Storage) GetStatusHistory(ctx context.Context, orderUID string) (_ []entity.StatusChange, err error) {
+	defer classifyError(&err)
+
+	// LEFT JOIN отличает заказ без истории (одна строка с NULL) от несуществующего (нет строк)
+	rows, err := s.pool.Query(ctx, `
+		SELECT h.from_status, h.to_status, h.changed_at, h.reason
+		FROM orders o
+		LEFT JOIN order_status_history h ON h.order_uid = o.order_uid
+		WHERE o.order_uid = $1
+		ORDER BY h.changed_at, h.id`, orderUID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query status history: %w", err)
+	}
+	defer rows.Close()
+
+	found := false
+	history := make([]entity.StatusChange, 0)
+	for rows.Next() {
+		found = true
+		var (
+			from, to, reason *string
+			changedAt        *time.Time
+		)
+		if err := rows.Scan(&from, &to, &changedAt, &reason); err != nil {
+			return nil, fmt.Errorf("failed to scan row: %w", err)
+		}
+		if to == nil {
+			continue // заказ есть, истории нет
+		}
+		change := entity.StatusChange{OrderUID: orderUID, To: entity.OrderStatus(*to), ChangedAt: *changedAt}
+		if from != nil {
+			change.From = entity.OrderStatus(*from)
+		}
+		if reason != nil {
+			change.Reason = *reason
+		}
+		history = append(history, change)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error during rows iteration: %w", err)
+	}
+	if !found {
+		return nil, fmt.Errorf("order %s: %w", orderUID, entity.ErrNotFound)
+	}
+	return history, nil
+}
@@ -2,11 +2,14 @@ package storage
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log/slog"
+	"time"
 
 	"github.com/Asus/L0_DemoServise/config"
 	"github.com/Asus/L0_DemoServise/internal/entity"
+	"github.com/Asus/L0_DemoServise/internal/metrics"
 
 	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgconn"
@@ -17,14 +20,14 @@ const (
 	orderQuery = `
 		SELECT 
 			o.order_uid, o.track_number, o.entry, o.locale, o.internal_signature, o.customer_id, 
-			o.delivery_service, o.shardkey, o.sm_id, o.date_created, o.oof_shard,
+			o.delivery_service, o.shardkey, o.sm_id, o.date_created, o.oof_shard, o.status AS order_status,
 			d.name, d.phone, d.zip, d.city, d.address, d.region, d.email,
 			p.order_uid AS payment_uid,
 			p.request_id, p.currency, p.provider, p.amount, p.payment_dt, p.bank, 
 
 			p.delivery_cost, p.goods_total, p.custom_fee,
 			i.rid, i.chrt_id, i.track_number AS item_track_number, i.price, i.name AS item_name, 
-			i.sale, i.size, i.total_price, i.nm_id, i.brand, i.status
+			i.sale, i.size, i.total_price, i.nm_id, i.brand, i.status, i.returned_at
 		FROM orders o
 		LEFT JOIN delivery d ON o.order_uid = d.order_uid
 		LEFT JOIN payment p ON o.order_uid = p.order_uid
@@ -35,7 +38,7 @@ const (
 func scanDataFromRows(rows pgx.Rows, order *entity.Order, item *entity.Item) error {
 	return rows.Scan(
 		&order.OrderUID, &order.TrackNumber, &order.Entry, &order.Locale, &order.InternalSignature, &order.CustomerID,
-		&order.DeliveryService, &order.ShardKey, &order.SmID, &order.DateCreated, &order.OofShard,
+		&order.DeliveryService, &order.ShardKey, &order.SmID, &order.DateCreated, &order.OofShard, &order.Status,
 		&order.Delivery.Name, &order.Delivery.Phone, &order.Delivery.Zip, &order.Delivery.City, &order.Delivery.Address, &order.Delivery.Region, &order.Delivery.Email,
 
 		&order.Payment.OrderUID,
@@ -43,24 +46,41 @@ func scanDataFromRows(rows pgx.Rows, order *entity.Order, item *entity.Item) err
 
 		&order.Payment.DeliveryCost, &order.Payment.GoodsTotal, &order.Payment.CustomFee,
 		&item.Rid, &item.ChrtID, &item.TrackNumber, &item.Price, &item.Name,
-		&item.Sale, &item.Size, &item.TotalPrice, &item.NmID, &item.Brand, &item.Status,
+		&item.Sale, &item.Size, &item.TotalPrice, &item.NmID, &item.Brand, &item.Status, &item.ReturnedAt,
 	)
 }
 
 // интерфейс, для того чтобы можно было запускать тесты
 type DBPool interface {
 	Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error)
+	QueryRow(ctx context.Context, sql string, args ...any) pgx.Row
 	Begin(ctx context.Context) (pgx.Tx, error)
 	Exec(ctx context.Context, sql string, arguments ...any) (pgconn.CommandTag, error)
 	CopyFrom(ctx context.Context, tableName pgx.Identifier, columnNames []string, rowSrc pgx.CopyFromSource) (int64, error)
 	Close()
 }
 
+// политики для заказа, который уже есть в БД, но пришёл с другим содержимым
+const (
+	ConflictReject = "reject"
+	ConflictUpsert = "upsert"
+)
+
 type Storage struct {
-	pool DBPool
+	pool       DBPool
+	onConflict string
 }
 
 func NewStorage(cfg *config.Storage) (*Storage, error) {
+	onConflict := cfg.OnConflict
+	switch onConflict {
+	case "":
+		onConflict = ConflictReject
+	case ConflictReject, ConflictUpsert:
+	default:
+		return nil, fmt.Errorf("unknown on_conflict policy %q, expected %q or %q", cfg.OnConflict, ConflictReject, ConflictUpsert)
+	}
+
 	connStr := fmt.Sprintf(
 		"postgres://%s:%s@%s:%s/%s?sslmode=disable",
 		cfg.DBUser,
@@ -75,7 +95,17 @@ func NewStorage(cfg *config.Storage) (*Storage, error) {
 		return nil, fmt.Errorf("unable to create connection pool: %w", err)
 	}
 
-	return &Storage{pool: pool}, nil
+	return &Storage{pool: pool, onConflict: onConflict}, nil
+}
+
+// observe записывает длительность запроса в метрики, "заказ не найден" ошибкой не считается.
+// err передаётся указателем, чтобы в defer прочитать итоговое значение
+func observe(operation string, start time.Time, err *error) {
+	if errors.Is(*err, entity.ErrNotFound) {
+		metrics.ObserveStorage(operation, start, nil)
+		return
+	}
+	metrics.ObserveStorage(operation, start, *err)
 }
 
 func (s *Storage) Close() {
@@ -84,35 +114,120 @@ func (s *Storage) Close() {
 	}
 }
 
-// SaveOrder сохраняет заказ в БД в рамках одной транзакции
-func (s *Storage) SaveOrder(ctx context.Context, o entity.Order) error {
+// SaveOrder сохраняет заказ в БД в рамках одной транзакции.
+// Повторно пришедший заказ (например, переотправленное сообщение Kafka) не считается ошибкой:
+// точная копия игнорируется, а изменённая версия перезаписывается или отклоняется в зависимости от onConflict
+func (s *Storage) SaveOrder(ctx context.Context, o entity.Order) (result entity.SaveResult, err error) {
+	defer observe("save_order", time.Now(), &err)
+	defer classifyError(&err)
+
+	hash, err := orderHash(o)
+	if err != nil {
+		return 0, err
+	}
+
 	tx, err := s.pool.Begin(ctx)
 
 	if err != nil {
-		return fmt.Errorf("error while starting transaction %w", err)
+		return 0, fmt.Errorf("error while starting transaction %w", err)
 	}
 
 	defer func() {
-		if err != nil {
+		if err != nil || result == entity.SaveDuplicate || result == entity.SaveConflict {
 			tx.Rollback(ctx)
 		}
-	}() // если возникла ошибка, во время выполнения транзакции - откат
+	}() // если возникла ошибка или сохранять нечего - откат
 
-	_, err = tx.Exec(ctx,
+	tag, err := tx.Exec(ctx,
 		`INSERT INTO orders
 		(order_uid, track_number, entry, locale, internal_signature, customer_id,
-		 delivery_service, shardkey, sm_id, date_created, oof_shard)
-		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)`,
-		o.OrderUID, o.TrackNumber, o.Entry, o.Locale, o.InternalSignature, o.CustomerID, o.DeliveryService, o.ShardKey, o.SmID, o.DateCreated, o.OofShard,
+		 delivery_service, shardkey, sm_id, date_created, oof_shard, content_hash, source_hash)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $12)
+		ON CONFLICT (order_uid) DO NOTHING`,
+		o.OrderUID, o.TrackNumber, o.Entry, o.Locale, o.InternalSignature, o.CustomerID, o.DeliveryService, o.ShardKey, o.SmID, o.DateCreated, o.OofShard, hash,
 	)
 	if err != nil {
-		return fmt.Errorf("failed to insert into orders: %w", err)
+		return 0, fmt.Errorf("failed to insert into orders: %w", err)
 	}
 
-	_, err = tx.Exec(ctx,
+	result = entity.SaveInserted
+	if tag.RowsAffected() == 0 {
+		// заказ с таким UID уже есть - сравниваем содержимое по хэшу. Дубликат - копия текущего заказа
+		// или повтор сообщения, из которого он записан: события об изменении заказа меняют только content_hash
+		var storedHash, sourceHash string
+		err = tx.QueryRow(ctx, `SELECT content_hash, source_hash FROM orders WHERE order_uid = $1 FOR UPDATE`, o.OrderUID).
+			Scan(&storedHash, &sourceHash)
+		if err != nil {
+			return 0, fmt.Errorf("failed to read existing order: %w", err)
+		}
+
+		switch {
+		case storedHash == hash, sourceHash == hash:
+			slog.InfoContext(ctx, "Order is already saved, duplicate ignored", "order_uid", o.OrderUID)
+			return entity.SaveDuplicate, nil
+		case s.onConflict != ConflictUpsert:
+			slog.WarnContext(ctx, "Order with the same UID but different content rejected", "order_uid", o.OrderUID)
+			return entity.SaveConflict, nil
+		}
+
+		if err = s.updateOrder(ctx, tx, o, hash); err != nil {
+			return 0, err
+		}
+		result = entity.SaveUpdated
+	} else {
+		// новый заказ: статус берётся из DEFAULT колонки, историю начинает запись о создании
+		_, err = tx.Exec(ctx,
+			`INSERT INTO order_status_history (order_uid, to_status, changed_at) VALUES ($1, $2, now())`,
+			o.OrderUID, string(entity.StatusCreated),
+		)
+		if err != nil {
+			return 0, fmt.Errorf("failed to insert into order_status_history: %w", err)
+		}
+	}
+
+	if err = s.saveOrderDetails(ctx, tx, o); err != nil {
+		return 0, err
+	}
+
+	// Всё успешно — коммитим транзакцию
+	if err = tx.Commit(ctx); err != nil {
+		return 0, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	slog.InfoContext(ctx, "Order successfully saved to database", "order_uid", o.OrderUID, "result", result)
+
+	return result, nil
+}
+
+// updateOrder перезаписывает строку orders и удаляет старые items, новые вставит saveOrderDetails
+func (s *Storage) updateOrder(ctx context.Context, tx pgx.Tx, o entity.Order, hash string) error {
+	_, err := tx.Exec(ctx,
+		`UPDATE orders SET
+		track_number = $2, entry = $3, locale = $4, internal_signature = $5, customer_id = $6,
+		delivery_service = $7, shardkey = $8, sm_id = $9, date_created = $10, oof_shard = $11, content_hash = $12,
+		source_hash = $12, updated_at = now()
+		WHERE order_uid = $1`,
+		o.OrderUID, o.TrackNumber, o.Entry, o.Locale, o.InternalSignature, o.CustomerID, o.DeliveryService, o.ShardKey, o.SmID, o.DateCreated, o.OofShard, hash,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to update orders: %w", err)
+	}
+
+	if _, err := tx.Exec(ctx, `DELETE FROM items WHERE order_uid = $1`, o.OrderUID); err != nil {
+		return fmt.Errorf("failed to delete old items: %w", err)
+	}
+	return nil
+}
+
+// saveOrderDetails записывает delivery, payment и items заказа.
+// delivery и payment вставляются через upsert, поэтому функция подходит и для нового, и для обновляемого заказа
+func (s *Storage) saveOrderDetails(ctx context.Context, tx pgx.Tx, o entity.Order) error {
+	_, err := tx.Exec(ctx,
 		`INSERT INTO delivery
 		(order_uid, name, phone, zip, city, address, region, email)
-		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`,
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+		ON CONFLICT (order_uid) DO UPDATE SET
+		name = EXCLUDED.name, phone = EXCLUDED.phone, zip = EXCLUDED.zip, city = EXCLUDED.city,
+		address = EXCLUDED.address, region = EXCLUDED.region, email = EXCLUDED.email`,
 		o.OrderUID, o.Delivery.Name, o.Delivery.Phone, o.Delivery.Zip, o.Delivery.City, o.Delivery.Address, o.Delivery.Region, o.Delivery.Email,
 	)
 	if err != nil {
@@ -123,7 +238,11 @@ func (s *Storage) SaveOrder(ctx context.Context, o entity.Order) error {
 	_, err = tx.Exec(ctx,
 		`INSERT INTO payment (order_uid, request_id, currency, provider, amount,
 		 payment_dt, bank, delivery_cost, goods_total, custom_fee)
-		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)`,
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+		ON CONFLICT (order_uid) DO UPDATE SET
+		request_id = EXCLUDED.request_id, currency = EXCLUDED.currency, provider = EXCLUDED.provider,
+		amount = EXCLUDED.amount, payment_dt = EXCLUDED.payment_dt, bank = EXCLUDED.bank,
+		delivery_cost = EXCLUDED.delivery_cost, goods_total = EXCLUDED.goods_total, custom_fee = EXCLUDED.custom_fee`,
 		o.OrderUID, o.Payment.RequestID, o.Payment.Currency, o.Payment.Provider, o.Payment.Amount, o.Payment.PaymentDt, o.Payment.Bank, o.Payment.DeliveryCost, o.Payment.GoodsTotal, o.Payment.CustomFee,
 	)
 	if err != nil {
@@ -155,13 +274,6 @@ func (s *Storage) SaveOrder(ctx context.Context, o entity.Order) error {
 			return fmt.Errorf("failed to copy into items: %w", err)
 		}
 	}
-
-	// Всё успешно — коммитим транзакцию
-	if err = tx.Commit(ctx); err != nil {
-		return fmt.Errorf("failed to commit transaction: %w", err)
-	}
-	slog.Info("Order successfully saved to database", "order_uid", o.OrderUID)
-
 	return nil
 }
 
@@ -169,9 +281,19 @@ func (s *Storage) SaveOrder(ctx context.Context, o entity.Order) error {
 обычные вставки (Exec в цикле) будут медленными, потому что каждый Exec — отдельный запрос к серверу БД =>
 много сетевых вызовов -> это дорого, поэтому, я думаю, что тут лучше использовать CopyForm или хотя бы Batch */
 
-func (s *Storage) GetLastNOrders(ctx context.Context, n int) ([]entity.Order, error) {
-	secondPart := "\nLIMIT $1"
-	query := orderQuery + secondPart
+// GetLastNOrders возвращает n самых новых заказов (по date_created) целиком, со всеми товарами.
+// Сначала выбираются UID заказов, и только потом к ним присоединяются товары,
+// поэтому LIMIT ограничивает число заказов, а не строк join'а
+func (s *Storage) GetLastNOrders(ctx context.Context, n int) (_ []entity.Order, err error) {
+	defer classifyError(&err)
+
+	query := `
+		WITH last_orders AS (
+			SELECT order_uid FROM orders
+			ORDER BY date_created DESC, order_uid DESC
+			LIMIT $1
+		)` + orderQuery + `JOIN last_orders ON last_orders.order_uid = o.order_uid
+		ORDER BY o.date_created DESC, o.order_uid DESC, i.rid`
 
 	rows, err := s.pool.Query(ctx, query, n)
 	if err != nil {
@@ -179,47 +301,35 @@ func (s *Storage) GetLastNOrders(ctx context.Context, n int) ([]entity.Order, er
 	}
 	defer rows.Close()
 
-	// Map для сборки заказов: ключ - order_uid, значение - указатель на Order
-	ordersMap := make(map[string]*entity.Order)
+	return collectOrders(rows)
+}
 
-	for rows.Next() {
-		var order entity.Order
-		var item entity.Item
+// GetOrdersUpdatedSince возвращает заказы, записанные (вставленные или обновлённые) позже since,
+// от старых изменений к новым. По ним кэш, загруженный из снапшота, догоняет БД
+func (s *Storage) GetOrdersUpdatedSince(ctx context.Context, since time.Time) (_ []entity.Order, err error) {
+	defer classifyError(&err)
 
-		err = scanDataFromRows(rows, &order, &item)
-		if err != nil {
-			return nil, fmt.Errorf("failed to scan row: %w", err)
-		}
+	query := `
+		WITH updated AS (
+			SELECT order_uid, updated_at FROM orders
+			WHERE updated_at > $1
+		)` + orderQuery + `JOIN updated ON updated.order_uid = o.order_uid
+		ORDER BY updated.updated_at, o.order_uid, i.rid`
 
-		// Проверяем, существует ли заказ в map
-		existingOrder, exists := ordersMap[order.OrderUID]
-		if !exists {
-			//(используем копию, чтобы избежать перезаписи)
-			newOrder := order // Копируем структуру
-			ordersMap[order.OrderUID] = &newOrder
-			existingOrder = &newOrder
-		}
-
-		// Добавляем item, если он есть (rid != "")
-		if item.Rid != "" {
-			existingOrder.Items = append(existingOrder.Items, item)
-		}
-	}
-
-	if err = rows.Err(); err != nil {
-		return nil, fmt.Errorf("error during rows iteration: %w", err)
-	}
-
-	orders := make([]entity.Order, 0, len(ordersMap))
-	for _, ord := range ordersMap {
-		orders = append(orders, *ord)
+	rows, err := s.pool.Query(ctx, query, since)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query updated orders: %w", err)
 	}
+	defer rows.Close()
 
-	return orders, nil
+	return collectOrders(rows)
 }
 
 // GetOrderByUID находит один заказ по его ID
-func (s *Storage) GetOrderByUID(ctx context.Context, orderUID string) (entity.Order, error) {
+func (s *Storage) GetOrderByUID(ctx context.Context, orderUID string) (_ entity.Order, err error) {
+	defer observe("get_order_by_uid", time.Now(), &err)
+	defer classifyError(&err)
+
 	query := orderQuery + "\nWHERE o.order_uid = $1" // выбираем все заказы с данным UID
 
 	rows, err := s.pool.Query(ctx, query, orderUID)
@@ -256,7 +366,8 @@ func (s *Storage) GetOrderByUID(ctx context.Context, orderUID string) (entity.Or
 
 	if firstRow {
 		// Если не было ни одной строки, заказ не найден
-		return entity.Order{}, pgx.ErrNoRows
+		slog.InfoContext(ctx, "Order not found in database", "order_uid", orderUID)
+		return entity.Order{}, fmt.Errorf("order %s: %w", orderUID, entity.ErrNotFound)
 	}
 
 	order.Items = items
@@ -267,8 +378,41 @@ func (s *Storage) GetOrderByUID(ctx context.Context, orderUID string) (entity.Or
 	return order, nil
 }
 
+// GetOrderUIDs возвращает UID всех заказов, из них собирается фильтр Блума кэша
+func (s *Storage) GetOrderUIDs(ctx context.Context) (_ []string, err error) {
+	defer classifyError(&err)
+
+	rows, err := s.pool.Query(ctx, `SELECT order_uid FROM orders`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query order UIDs: %w", err)
+	}
+	uids, err := pgx.CollectRows(rows, pgx.RowTo[string])
+	if err != nil {
+		return nil, fmt.Errorf("failed to read order UIDs: %w", err)
+	}
+	return uids, nil
+}
+
+// GetOrderUIDsUpdatedSince возвращает UID заказов, записанных (вставленных или обновлённых) позже since.
+// По ним фильтр Блума догоняет БД без чтения самих заказов
+func (s *Storage) GetOrderUIDsUpdatedSince(ctx context.Context, since time.Time) (_ []string, err error) {
+	defer classifyError(&err)
+
+	rows, err := s.pool.Query(ctx, `SELECT order_uid FROM orders WHERE updated_at > $1`, since)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query updated order UIDs: %w", err)
+	}
+	uids, err := pgx.CollectRows(rows, pgx.RowTo[string])
+	if err != nil {
+		return nil, fmt.Errorf("failed to read updated order UIDs: %w", err)
+	}
+	return uids, nil
+}
+
 // GetAllOrders загружает все заказы из БД для восстановления кэша
-func (s *Storage) GetAllOrders(ctx context.Context) ([]entity.Order, error) {
+func (s *Storage) GetAllOrders(ctx context.Context) (_ []entity.Order, err error) {
+	defer classifyError(&err)
+
 	query := orderQuery + "\nORDER BY o.date_created DESC"
 
 	rows, err := s.pool.Query(ctx, query)
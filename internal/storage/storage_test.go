@@ -3,14 +3,18 @@ package storage
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"net"
 	"os"
 	"reflect"
 	"testing"
+	"time"
 
 	"github.com/Asus/L0_DemoServise/internal/entity"
 
 	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
 	"github.com/pashagolub/pgxmock/v3"
 )
 
@@ -18,12 +22,12 @@ import (
 // Это центральное место для синхронизации тестов с реальным запросом.
 var cols = []string{
 	"order_uid", "track_number", "entry", "locale", "internal_signature", "customer_id",
-	"delivery_service", "shardkey", "sm_id", "date_created", "oof_shard",
+	"delivery_service", "shardkey", "sm_id", "date_created", "oof_shard", "order_status",
 	"name", "phone", "zip", "city", "address", "region", "email",
 	"payment_uid", "request_id", "currency", "provider", "amount", "payment_dt", "bank",
 	"delivery_cost", "goods_total", "custom_fee",
 	"rid", "chrt_id", "item_track_number", "price", "item_name",
-	"sale", "size", "total_price", "nm_id", "brand", "status",
+	"sale", "size", "total_price", "nm_id", "brand", "status", "returned_at",
 }
 
 
@@ -62,7 +66,7 @@ func orderToRow(order entity.Order, itemIndex int) []any {
 	}
 	return []any{
 		order.OrderUID, order.TrackNumber, order.Entry, order.Locale, order.InternalSignature, order.CustomerID,
-		order.DeliveryService, order.ShardKey, order.SmID, order.DateCreated, order.OofShard,
+		order.DeliveryService, order.ShardKey, order.SmID, order.DateCreated, order.OofShard, order.Status,
 		order.Delivery.Name, order.Delivery.Phone, order.Delivery.Zip, order.Delivery.City, order.Delivery.Address, order.Delivery.Region, order.Delivery.Email,
 		
 		order.Payment.OrderUID, 
@@ -70,7 +74,7 @@ func orderToRow(order entity.Order, itemIndex int) []any {
 		order.Payment.RequestID, order.Payment.Currency, order.Payment.Provider, order.Payment.Amount, order.Payment.PaymentDt, order.Payment.Bank,
 		order.Payment.DeliveryCost, order.Payment.GoodsTotal, order.Payment.CustomFee,
 		item.Rid, item.ChrtID, item.TrackNumber, item.Price, item.Name,
-		item.Sale, item.Size, item.TotalPrice, item.NmID, item.Brand, item.Status,
+		item.Sale, item.Size, item.TotalPrice, item.NmID, item.Brand, item.Status, item.ReturnedAt,
 	}
 }
 
@@ -119,7 +123,7 @@ func TestGetOrderByUID(t *testing.T) {
 					WillReturnRows(rows)
 			},
 			expectedOrder: entity.Order{},
-			expectedErr:   pgx.ErrNoRows,
+			expectedErr:   fmt.Errorf("order nonexistent-uid: %w", entity.ErrNotFound),
 		},
 		{
 			name:     "Ошибка: Ошибка базы данных",
@@ -140,6 +144,9 @@ func TestGetOrderByUID(t *testing.T) {
 			order, err := s.GetOrderByUID(context.Background(), tc.orderUID)
 
 			assertError(t, err, tc.expectedErr)
+			if errors.Is(tc.expectedErr, entity.ErrNotFound) && !errors.Is(err, entity.ErrNotFound) {
+				t.Errorf("ошибка должна оборачивать entity.ErrNotFound, получили: %v", err)
+			}
 
 			if tc.expectedErr == nil {
 				if !reflect.DeepEqual(order, tc.expectedOrder) {
@@ -154,6 +161,10 @@ func TestGetOrderByUID(t *testing.T) {
 	}
 }
 
+// запрос GetLastNOrders: LIMIT внутри CTE ограничивает число заказов, а не строк с товарами
+const lastNOrdersSQL = `WITH last_orders AS \( SELECT order_uid FROM orders ORDER BY date_created DESC, order_uid DESC LIMIT \$1 \) ` +
+	`SELECT .* JOIN last_orders ON last_orders.order_uid = o.order_uid ORDER BY o.date_created DESC, o.order_uid DESC, i.rid`
+
 func TestGetLastNOrders(t *testing.T) {
 	mock, err := pgxmock.NewPool()
 	if err != nil {
@@ -170,6 +181,7 @@ func TestGetLastNOrders(t *testing.T) {
 
 	order1 := generateTestOrder(baseOrder, 1)
 	order2 := generateTestOrder(baseOrder, 2)
+	order2.DateCreated = order1.DateCreated.Add(time.Hour) // order2 новее
 
 	orderWithTwoItems := generateTestOrder(baseOrder, 3)
 	item2 := orderWithTwoItems.Items[0]
@@ -177,6 +189,14 @@ func TestGetLastNOrders(t *testing.T) {
 	item2.Name = "Второй товар"
 	orderWithTwoItems.Items = append(orderWithTwoItems.Items, item2)
 
+	orderWithThreeItems := generateTestOrder(baseOrder, 4)
+	orderWithThreeItems.DateCreated = orderWithTwoItems.DateCreated.Add(time.Hour)
+	for i := 2; i <= 3; i++ {
+		item := orderWithThreeItems.Items[0]
+		item.Rid = fmt.Sprintf("rid-4-item-%d", i)
+		orderWithThreeItems.Items = append(orderWithThreeItems.Items, item)
+	}
+
 	testCases := []struct {
 		name           string
 		n              int
@@ -185,17 +205,17 @@ func TestGetLastNOrders(t *testing.T) {
 		expectedErr    error
 	}{
 		{
-			name: "Успех: Получение 2 заказов",
+			name: "Успех: Получение 2 заказов, сначала новые",
 			n:    2,
 			mockSetup: func() {
 				rows := pgxmock.NewRows(cols).
-					AddRow(orderToRow(order1, 0)...).
-					AddRow(orderToRow(order2, 0)...)
-				mock.ExpectQuery(`SELECT .* LIMIT \$1`).
+					AddRow(orderToRow(order2, 0)...).
+					AddRow(orderToRow(order1, 0)...)
+				mock.ExpectQuery(lastNOrdersSQL).
 					WithArgs(2).
 					WillReturnRows(rows)
 			},
-			expectedOrders: []entity.Order{order1, order2},
+			expectedOrders: []entity.Order{order2, order1},
 			expectedErr:    nil,
 		},
 		{
@@ -205,19 +225,37 @@ func TestGetLastNOrders(t *testing.T) {
 				rows := pgxmock.NewRows(cols).
 					AddRow(orderToRow(orderWithTwoItems, 0)...).
 					AddRow(orderToRow(orderWithTwoItems, 1)...)
-				mock.ExpectQuery(`SELECT .* LIMIT \$1`).
+				mock.ExpectQuery(lastNOrdersSQL).
 					WithArgs(1).
 					WillReturnRows(rows)
 			},
 			expectedOrders: []entity.Order{orderWithTwoItems},
 			expectedErr:    nil,
 		},
+		{
+			// 2 заказа дают 5 строк join'а: LIMIT 2 не должен обрезать товары
+			name: "Успех: Заказы с несколькими товарами загружаются целиком",
+			n:    2,
+			mockSetup: func() {
+				rows := pgxmock.NewRows(cols).
+					AddRow(orderToRow(orderWithThreeItems, 0)...).
+					AddRow(orderToRow(orderWithThreeItems, 1)...).
+					AddRow(orderToRow(orderWithThreeItems, 2)...).
+					AddRow(orderToRow(orderWithTwoItems, 0)...).
+					AddRow(orderToRow(orderWithTwoItems, 1)...)
+				mock.ExpectQuery(lastNOrdersSQL).
+					WithArgs(2).
+					WillReturnRows(rows)
+			},
+			expectedOrders: []entity.Order{orderWithThreeItems, orderWithTwoItems},
+			expectedErr:    nil,
+		},
 		{
 			name: "Успех: В БД меньше заказов чем запрошено",
 			n:    5,
 			mockSetup: func() {
 				rows := pgxmock.NewRows(cols).AddRow(orderToRow(order1, 0)...)
-				mock.ExpectQuery(`SELECT .* LIMIT \$1`).
+				mock.ExpectQuery(lastNOrdersSQL).
 					WithArgs(5).
 					WillReturnRows(rows)
 			},
@@ -228,7 +266,7 @@ func TestGetLastNOrders(t *testing.T) {
 			name: "Ошибка: Ошибка базы данных",
 			n:    3,
 			mockSetup: func() {
-				mock.ExpectQuery(`SELECT .* LIMIT \$1`).
+				mock.ExpectQuery(lastNOrdersSQL).
 					WithArgs(3).
 					WillReturnError(fmt.Errorf("db connection failed"))
 			},
@@ -261,6 +299,131 @@ func TestGetLastNOrders(t *testing.T) {
 }
 
 
+func TestGetOrdersUpdatedSince(t *testing.T) {
+	mock, err := pgxmock.NewPool()
+	if err != nil {
+		t.Fatalf("не удалось создать мок-пул: %v", err)
+	}
+	defer mock.Close()
+
+	s := Storage{pool: mock}
+
+	baseOrder, err := loadTemplateOrder()
+	if err != nil {
+		t.Fatalf("не удалось загрузить шаблон заказа: %v", err)
+	}
+	order1 := generateTestOrder(baseOrder, 1)
+	order2 := generateTestOrder(baseOrder, 2)
+	since := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	mock.ExpectQuery(`WITH updated AS \( SELECT order_uid, updated_at FROM orders WHERE updated_at > \$1 \) ` +
+		`SELECT .* JOIN updated ON updated.order_uid = o.order_uid ORDER BY updated.updated_at, o.order_uid, i.rid`).
+		WithArgs(since).
+		WillReturnRows(pgxmock.NewRows(cols).
+			AddRow(orderToRow(order1, 0)...).
+			AddRow(orderToRow(order2, 0)...))
+
+	orders, err := s.GetOrdersUpdatedSince(context.Background(), since)
+	if err != nil {
+		t.Fatalf("неожиданная ошибка: %v", err)
+	}
+	if !reflect.DeepEqual(orders, []entity.Order{order1, order2}) {
+		assertJSONEqual(t, orders, []entity.Order{order1, order2})
+	}
+
+	mock.ExpectQuery(`WITH updated AS`).WithArgs(since).WillReturnError(fmt.Errorf("db connection failed"))
+	_, err = s.GetOrdersUpdatedSince(context.Background(), since)
+	assertError(t, err, fmt.Errorf("failed to query updated orders: db connection failed"))
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("были невыполненные ожидания мока: %s", err)
+	}
+}
+
+func TestGetOrderUIDs(t *testing.T) {
+	mock, err := pgxmock.NewPool()
+	if err != nil {
+		t.Fatalf("не удалось создать мок-пул: %v", err)
+	}
+	defer mock.Close()
+
+	s := Storage{pool: mock}
+	mock.ExpectQuery(`SELECT order_uid FROM orders`).
+		WillReturnRows(pgxmock.NewRows([]string{"order_uid"}).AddRow("uid-1").AddRow("uid-2"))
+
+	uids, err := s.GetOrderUIDs(context.Background())
+	if err != nil {
+		t.Fatalf("неожиданная ошибка: %v", err)
+	}
+	if !reflect.DeepEqual(uids, []string{"uid-1", "uid-2"}) {
+		t.Errorf("ожидались uid-1, uid-2, получили %v", uids)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("были невыполненные ожидания мока: %s", err)
+	}
+}
+
+func TestGetOrderUIDsUpdatedSince(t *testing.T) {
+	mock, err := pgxmock.NewPool()
+	if err != nil {
+		t.Fatalf("не удалось создать мок-пул: %v", err)
+	}
+	defer mock.Close()
+
+	s := Storage{pool: mock}
+	since := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	mock.ExpectQuery(`SELECT order_uid FROM orders WHERE updated_at > \$1`).
+		WithArgs(since).
+		WillReturnRows(pgxmock.NewRows([]string{"order_uid"}).AddRow("uid-2"))
+
+	uids, err := s.GetOrderUIDsUpdatedSince(context.Background(), since)
+	if err != nil {
+		t.Fatalf("неожиданная ошибка: %v", err)
+	}
+	if !reflect.DeepEqual(uids, []string{"uid-2"}) {
+		t.Errorf("ожидался uid-2, получили %v", uids)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("были невыполненные ожидания мока: %s", err)
+	}
+}
+
+func TestClassifyError(t *testing.T) {
+	testCases := []struct {
+		name     string
+		err      error
+		expected error
+	}{
+		{"нарушение уникальности", &pgconn.PgError{Code: "23505"}, entity.ErrDuplicate},
+		{"NOT NULL", &pgconn.PgError{Code: "23502"}, entity.ErrInvalidOrder},
+		{"неверные данные", &pgconn.PgError{Code: "22P02"}, entity.ErrInvalidOrder},
+		{"оборвано соединение", &pgconn.PgError{Code: "08006"}, entity.ErrUnavailable},
+		{"сервер останавливается", &pgconn.PgError{Code: "57P01"}, entity.ErrUnavailable},
+		{"сеть", fmt.Errorf("failed to query order: %w", &net.OpError{Op: "dial", Err: errors.New("connection refused")}), entity.ErrUnavailable},
+		{"дедлайн", fmt.Errorf("failed to query order: %w", context.DeadlineExceeded), entity.ErrUnavailable},
+		{"короткий код", &pgconn.PgError{Code: "2"}, nil},
+		{"отмена клиентом", context.Canceled, nil},
+		{"синтаксис SQL", &pgconn.PgError{Code: "42601"}, nil},
+	}
+
+	kinds := []error{entity.ErrDuplicate, entity.ErrInvalidOrder, entity.ErrUnavailable}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.err
+			classifyError(&err)
+
+			if !errors.Is(err, tc.err) {
+				t.Errorf("исходная ошибка должна остаться в цепочке: %v", err)
+			}
+			for _, kind := range kinds {
+				if errors.Is(err, kind) != (kind == tc.expected) {
+					t.Errorf("errors.Is(%v, %v) = %v, ожидалось %v", err, kind, !(kind == tc.expected), kind == tc.expected)
+				}
+			}
+		})
+	}
+}
+
 func assertError(t *testing.T, got, want error) {
 	t.Helper()
 	if want == nil {
@@ -288,4 +451,548 @@ func assertJSONEqual(t *testing.T, got, want any) {
 	if string(gotJSON) != string(wantJSON) {
 		t.Errorf("результат не совпадает:\n\nожидали:\n%s\n\nполучили:\n%s\n", string(wantJSON), string(gotJSON))
 	}
-}
\ No newline at end of file
+}
+
+// anyArgs нужен для запросов, где важен сам факт вызова, а не значения аргументов
+func anyArgs(n int) []any {
+	args := make([]any, n)
+	for i := range args {
+		args[i] = pgxmock.AnyArg()
+	}
+	return args
+}
+
+func TestSaveOrder(t *testing.T) {
+	testOrder, err := loadTemplateOrder()
+	if err != nil {
+		t.Fatalf("не удалось загрузить шаблон заказа: %v", err)
+	}
+	hash, err := orderHash(testOrder)
+	if err != nil {
+		t.Fatalf("не удалось посчитать хэш заказа: %v", err)
+	}
+
+	expectDetails := func(mock pgxmock.PgxPoolIface) {
+		mock.ExpectExec(`INSERT INTO delivery`).WithArgs(anyArgs(8)...).WillReturnResult(pgxmock.NewResult("INSERT", 1))
+		mock.ExpectExec(`INSERT INTO payment`).WithArgs(anyArgs(10)...).WillReturnResult(pgxmock.NewResult("INSERT", 1))
+		mock.ExpectCopyFrom(pgx.Identifier{"items"}, []string{
+			"rid", "order_uid", "chrt_id", "track_number", "price", "name", "sale",
+			"size", "total_price", "nm_id", "brand", "status",
+		}).WillReturnResult(int64(len(testOrder.Items)))
+	}
+
+	testCases := []struct {
+		name           string
+		onConflict     string
+		mockSetup      func(mock pgxmock.PgxPoolIface)
+		expectedResult entity.SaveResult
+		expectedErr    error
+	}{
+		{
+			name: "Успех: новый заказ",
+			mockSetup: func(mock pgxmock.PgxPoolIface) {
+				mock.ExpectBegin()
+				mock.ExpectExec(`INSERT INTO orders .* ON CONFLICT \(order_uid\) DO NOTHING`).
+					WithArgs(anyArgs(12)...).
+					WillReturnResult(pgxmock.NewResult("INSERT", 1))
+				mock.ExpectExec(`INSERT INTO order_status_history`).
+					WithArgs(testOrder.OrderUID, string(entity.StatusCreated)).
+					WillReturnResult(pgxmock.NewResult("INSERT", 1))
+				expectDetails(mock)
+				mock.ExpectCommit()
+			},
+			expectedResult: entity.SaveInserted,
+		},
+		{
+			name: "Успех: точный дубликат игнорируется",
+			mockSetup: func(mock pgxmock.PgxPoolIface) {
+				mock.ExpectBegin()
+				mock.ExpectExec(`INSERT INTO orders`).WithArgs(anyArgs(12)...).WillReturnResult(pgxmock.NewResult("INSERT", 0))
+				mock.ExpectQuery(`SELECT content_hash, source_hash FROM orders WHERE order_uid = \$1 FOR UPDATE`).
+					WithArgs(testOrder.OrderUID).
+					WillReturnRows(pgxmock.NewRows([]string{"content_hash", "source_hash"}).AddRow(hash, hash))
+				mock.ExpectRollback()
+			},
+			expectedResult: entity.SaveDuplicate,
+		},
+		{
+			name:       "Успех: повтор исходного сообщения не откатывает изменённый событием заказ",
+			onConflict: ConflictUpsert,
+			mockSetup: func(mock pgxmock.PgxPoolIface) {
+				mock.ExpectBegin()
+				mock.ExpectExec(`INSERT INTO orders`).WithArgs(anyArgs(12)...).WillReturnResult(pgxmock.NewResult("INSERT", 0))
+				mock.ExpectQuery(`SELECT content_hash, source_hash`).
+					WithArgs(testOrder.OrderUID).
+					WillReturnRows(pgxmock.NewRows([]string{"content_hash", "source_hash"}).AddRow("patched-hash", hash))
+				mock.ExpectRollback()
+			},
+			expectedResult: entity.SaveDuplicate,
+		},
+		{
+			name:       "Успех: изменённый дубликат отклоняется политикой reject",
+			onConflict: ConflictReject,
+			mockSetup: func(mock pgxmock.PgxPoolIface) {
+				mock.ExpectBegin()
+				mock.ExpectExec(`INSERT INTO orders`).WithArgs(anyArgs(12)...).WillReturnResult(pgxmock.NewResult("INSERT", 0))
+				mock.ExpectQuery(`SELECT content_hash, source_hash`).
+					WithArgs(testOrder.OrderUID).
+					WillReturnRows(pgxmock.NewRows([]string{"content_hash", "source_hash"}).AddRow("other-hash", "other-hash"))
+				mock.ExpectRollback()
+			},
+			expectedResult: entity.SaveConflict,
+		},
+		{
+			name:       "Успех: изменённый дубликат перезаписывается политикой upsert",
+			onConflict: ConflictUpsert,
+			mockSetup: func(mock pgxmock.PgxPoolIface) {
+				mock.ExpectBegin()
+				mock.ExpectExec(`INSERT INTO orders`).WithArgs(anyArgs(12)...).WillReturnResult(pgxmock.NewResult("INSERT", 0))
+				mock.ExpectQuery(`SELECT content_hash, source_hash`).
+					WithArgs(testOrder.OrderUID).
+					WillReturnRows(pgxmock.NewRows([]string{"content_hash", "source_hash"}).AddRow("other-hash", "other-hash"))
+				mock.ExpectExec(`UPDATE orders SET`).WithArgs(anyArgs(12)...).WillReturnResult(pgxmock.NewResult("UPDATE", 1))
+				mock.ExpectExec(`DELETE FROM items WHERE order_uid = \$1`).
+					WithArgs(testOrder.OrderUID).
+					WillReturnResult(pgxmock.NewResult("DELETE", 1))
+				expectDetails(mock)
+				mock.ExpectCommit()
+			},
+			expectedResult: entity.SaveUpdated,
+		},
+		{
+			name: "Ошибка: ошибка базы данных откатывает транзакцию",
+			mockSetup: func(mock pgxmock.PgxPoolIface) {
+				mock.ExpectBegin()
+				mock.ExpectExec(`INSERT INTO orders`).WithArgs(anyArgs(12)...).WillReturnError(fmt.Errorf("connection lost"))
+				mock.ExpectRollback()
+			},
+			expectedErr: fmt.Errorf("failed to insert into orders: connection lost"),
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			mock, err := pgxmock.NewPool()
+			if err != nil {
+				t.Fatalf("не удалось создать мок-пул: %v", err)
+			}
+			defer mock.Close()
+
+			s := Storage{pool: mock, onConflict: tc.onConflict}
+			tc.mockSetup(mock)
+
+			result, err := s.SaveOrder(context.Background(), testOrder)
+
+			assertError(t, err, tc.expectedErr)
+			if result != tc.expectedResult {
+				t.Errorf("ожидался результат %s, а получили %s", tc.expectedResult, result)
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("были невыполненные ожидания мока: %s", err)
+			}
+		})
+	}
+}
+
+func TestOrderHashIgnoresStorageDifferences(t *testing.T) {
+	testOrder, err := loadTemplateOrder()
+	if err != nil {
+		t.Fatalf("не удалось загрузить шаблон заказа: %v", err)
+	}
+	second := testOrder.Items[0]
+	second.Rid = "zz-second-item"
+	testOrder.Items = append(testOrder.Items, second)
+
+	// тот же заказ, каким его вернёт БД: другой часовой пояс, другой порядок товаров, заполненные order_uid
+	stored := testOrder
+	stored.DateCreated = testOrder.DateCreated.In(time.FixedZone("MSK", 3*60*60))
+	stored.Items = []entity.Item{testOrder.Items[1], testOrder.Items[0]}
+	for i := range stored.Items {
+		stored.Items[i].OrderUID = testOrder.OrderUID
+	}
+	stored.Delivery.OrderUID = testOrder.OrderUID
+
+	changed := testOrder
+	changed.Delivery.City = "Другой город"
+
+	original, _ := orderHash(testOrder)
+	fromDB, _ := orderHash(stored)
+	other, _ := orderHash(changed)
+
+	if original != fromDB {
+		t.Error("хэш одного и того же заказа не должен зависеть от часового пояса и порядка товаров")
+	}
+	if original == other {
+		t.Error("хэш изменённого заказа должен отличаться")
+	}
+	if testOrder.Items[0].Rid == "zz-second-item" || testOrder.Items[0].OrderUID != "" {
+		t.Error("orderHash не должен менять товары исходного заказа")
+	}
+}
+
+func TestSearchOrders(t *testing.T) {
+	baseOrder, err := loadTemplateOrder()
+	if err != nil {
+		t.Fatalf("не удалось загрузить шаблон заказа: %v", err)
+	}
+	order1 := generateTestOrder(baseOrder, 1)
+	order2 := generateTestOrder(baseOrder, 2)
+	cursor := entity.OrderCursor{DateCreated: order1.DateCreated, OrderUID: order1.OrderUID}
+
+	testCases := []struct {
+		name           string
+		search         entity.OrderSearch
+		mockSetup      func(mock pgxmock.PgxPoolIface)
+		expectedOrders []entity.Order
+		expectedCursor string
+	}{
+		{
+			name: "Успех: первая страница с курсором на следующую",
+			search: entity.OrderSearch{
+				Filter: entity.OrderFilter{CustomerID: "test"},
+				Limit:  1,
+			},
+			mockSetup: func(mock pgxmock.PgxPoolIface) {
+				rows := pgxmock.NewRows(cols).
+					AddRow(orderToRow(order1, 0)...).
+					AddRow(orderToRow(order2, 0)...)
+				mock.ExpectQuery(`WITH page AS .* WHERE o.customer_id = \$1 ORDER BY o.date_created DESC, o.order_uid DESC LIMIT \$2 .* JOIN page`).
+					WithArgs("test", 2).
+					WillReturnRows(rows)
+			},
+			expectedOrders: []entity.Order{order1},
+			expectedCursor: cursor.Encode(),
+		},
+		{
+			name: "Успех: последняя страница после курсора с фильтром по товарам",
+			search: entity.OrderSearch{
+				Filter:    entity.OrderFilter{NmID: 2389212, Brand: "Vivienne Sabo"},
+				Limit:     10,
+				Ascending: true,
+				After:     &cursor,
+			},
+			mockSetup: func(mock pgxmock.PgxPoolIface) {
+				rows := pgxmock.NewRows(cols).AddRow(orderToRow(order2, 0)...)
+				mock.ExpectQuery(`EXISTS \(SELECT 1 FROM items it WHERE it.order_uid = o.order_uid AND it.nm_id = \$1 AND it.brand = \$2\) AND \(o.date_created, o.order_uid\) > \(\$3, \$4\) ORDER BY o.date_created ASC`).
+					WithArgs(2389212, "Vivienne Sabo", cursor.DateCreated, cursor.OrderUID, 11).
+					WillReturnRows(rows)
+			},
+			expectedOrders: []entity.Order{order2},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			mock, err := pgxmock.NewPool()
+			if err != nil {
+				t.Fatalf("не удалось создать мок-пул: %v", err)
+			}
+			defer mock.Close()
+
+			s := Storage{pool: mock}
+			tc.mockSetup(mock)
+
+			page, err := s.SearchOrders(context.Background(), tc.search)
+			if err != nil {
+				t.Fatalf("неожиданная ошибка: %v", err)
+			}
+			assertJSONEqual(t, page.Orders, tc.expectedOrders)
+			if page.NextCursor != tc.expectedCursor {
+				t.Errorf("ожидался курсор %q, а получили %q", tc.expectedCursor, page.NextCursor)
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("были невыполненные ожидания мока: %s", err)
+			}
+		})
+	}
+}
+
+func TestChangeOrderStatus(t *testing.T) {
+	changedAt := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	change := entity.StatusChange{
+		OrderUID:  "uid-1",
+		From:      entity.StatusCreated,
+		To:        entity.StatusPaid,
+		ChangedAt: changedAt,
+		Reason:    "payment confirmed",
+	}
+
+	testCases := []struct {
+		name        string
+		mockSetup   func(mock pgxmock.PgxPoolIface)
+		expectedErr error
+	}{
+		{
+			name: "Успех: статус изменён и записан в историю",
+			mockSetup: func(mock pgxmock.PgxPoolIface) {
+				mock.ExpectBegin()
+				mock.ExpectExec(`UPDATE orders SET status = \$3, updated_at = now\(\) WHERE order_uid = \$1 AND status = \$2`).
+					WithArgs("uid-1", "created", "paid").
+					WillReturnResult(pgxmock.NewResult("UPDATE", 1))
+				mock.ExpectExec(`INSERT INTO order_status_history \(order_uid, from_status, to_status, changed_at, reason\)`).
+					WithArgs("uid-1", "created", "paid", changedAt, "payment confirmed").
+					WillReturnResult(pgxmock.NewResult("INSERT", 1))
+				mock.ExpectCommit()
+			},
+		},
+		{
+			name: "Ошибка: статус уже изменён другим событием",
+			mockSetup: func(mock pgxmock.PgxPoolIface) {
+				mock.ExpectBegin()
+				mock.ExpectExec(`UPDATE orders SET status`).WithArgs(anyArgs(3)...).WillReturnResult(pgxmock.NewResult("UPDATE", 0))
+				mock.ExpectQuery(`SELECT status FROM orders WHERE order_uid = \$1`).
+					WithArgs("uid-1").
+					WillReturnRows(pgxmock.NewRows([]string{"status"}).AddRow("cancelled"))
+				mock.ExpectRollback()
+			},
+			expectedErr: fmt.Errorf("%w: order uid-1 is cancelled, not created", entity.ErrInvalidTransition),
+		},
+		{
+			name: "Ошибка: заказ не найден",
+			mockSetup: func(mock pgxmock.PgxPoolIface) {
+				mock.ExpectBegin()
+				mock.ExpectExec(`UPDATE orders SET status`).WithArgs(anyArgs(3)...).WillReturnResult(pgxmock.NewResult("UPDATE", 0))
+				mock.ExpectQuery(`SELECT status FROM orders`).WithArgs("uid-1").WillReturnError(pgx.ErrNoRows)
+				mock.ExpectRollback()
+			},
+			expectedErr: fmt.Errorf("order uid-1: %w", entity.ErrNotFound),
+		},
+		{
+			name: "Ошибка: ошибка базы данных откатывает транзакцию",
+			mockSetup: func(mock pgxmock.PgxPoolIface) {
+				mock.ExpectBegin()
+				mock.ExpectExec(`UPDATE orders SET status`).WithArgs(anyArgs(3)...).WillReturnResult(pgxmock.NewResult("UPDATE", 1))
+				mock.ExpectExec(`INSERT INTO order_status_history`).WithArgs(anyArgs(5)...).WillReturnError(fmt.Errorf("connection lost"))
+				mock.ExpectRollback()
+			},
+			expectedErr: fmt.Errorf("failed to insert into order_status_history: connection lost"),
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			mock, err := pgxmock.NewPool()
+			if err != nil {
+				t.Fatalf("не удалось создать мок-пул: %v", err)
+			}
+			defer mock.Close()
+
+			s := Storage{pool: mock}
+			tc.mockSetup(mock)
+
+			err = s.ChangeOrderStatus(context.Background(), change)
+			assertError(t, err, tc.expectedErr)
+			if sentinel := errors.Unwrap(tc.expectedErr); sentinel != nil && !errors.Is(err, sentinel) {
+				t.Errorf("ошибка %v должна оборачивать %v", err, sentinel)
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("были невыполненные ожидания мока: %s", err)
+			}
+		})
+	}
+}
+
+func TestGetStatusHistory(t *testing.T) {
+	mock, err := pgxmock.NewPool()
+	if err != nil {
+		t.Fatalf("не удалось создать мок-пул: %v", err)
+	}
+	defer mock.Close()
+
+	s := Storage{pool: mock}
+	historyCols := []string{"from_status", "to_status", "changed_at", "reason"}
+	created := time.Date(2026, 3, 1, 10, 0, 0, 0, time.UTC)
+	paid := created.Add(time.Hour)
+	from, to, reason := "created", "paid", "payment confirmed"
+	first := "created"
+
+	mock.ExpectQuery(`SELECT h.from_status, h.to_status, h.changed_at, h.reason FROM orders o LEFT JOIN order_status_history h`).
+		WithArgs("uid-1").
+		WillReturnRows(pgxmock.NewRows(historyCols).
+			AddRow(nil, &first, &created, nil).
+			AddRow(&from, &to, &paid, &reason))
+
+	history, err := s.GetStatusHistory(context.Background(), "uid-1")
+	if err != nil {
+		t.Fatalf("неожиданная ошибка: %v", err)
+	}
+	want := []entity.StatusChange{
+		{OrderUID: "uid-1", To: entity.StatusCreated, ChangedAt: created},
+		{OrderUID: "uid-1", From: entity.StatusCreated, To: entity.StatusPaid, ChangedAt: paid, Reason: "payment confirmed"},
+	}
+	if !reflect.DeepEqual(history, want) {
+		assertJSONEqual(t, history, want)
+	}
+
+	// заказ без истории - пустой список, а не ошибка
+	mock.ExpectQuery(`LEFT JOIN order_status_history`).
+		WithArgs("uid-2").
+		WillReturnRows(pgxmock.NewRows(historyCols).AddRow(nil, nil, nil, nil))
+	history, err = s.GetStatusHistory(context.Background(), "uid-2")
+	if err != nil || len(history) != 0 {
+		t.Errorf("ожидалась пустая история, а получили %v, %v", history, err)
+	}
+
+	mock.ExpectQuery(`LEFT JOIN order_status_history`).
+		WithArgs("missing").
+		WillReturnRows(pgxmock.NewRows(historyCols))
+	_, err = s.GetStatusHistory(context.Background(), "missing")
+	if !errors.Is(err, entity.ErrNotFound) {
+		t.Errorf("ожидалась ошибка ErrNotFound, а получили %v", err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("были невыполненные ожидания мока: %s", err)
+	}
+}
+
+func TestOrderEventMethods(t *testing.T) {
+	editable := []entity.OrderStatus{entity.StatusCreated, entity.StatusPaid}
+	returnedAt := time.Date(2026, 3, 2, 9, 0, 0, 0, time.UTC)
+	track := "TRACK-NEW"
+	lockQuery := `SELECT status FROM orders WHERE order_uid = \$1 FOR UPDATE`
+	order, err := loadTemplateOrder()
+	if err != nil {
+		t.Fatalf("не удалось загрузить шаблон заказа: %v", err)
+	}
+	order.OrderUID = "uid-1"
+	// изменённый заказ перечитывается в транзакции, и его хэш записывается вместо прежнего
+	expectRehash := func(mock pgxmock.PgxPoolIface, o entity.Order) {
+		hash, err := orderHash(o)
+		if err != nil {
+			t.Fatalf("не удалось посчитать хэш заказа: %v", err)
+		}
+		mock.ExpectQuery(`FROM orders o .* WHERE o.order_uid = \$1`).
+			WithArgs("uid-1").
+			WillReturnRows(pgxmock.NewRows(cols).AddRow(orderToRow(o, 0)...))
+		mock.ExpectExec(`UPDATE orders SET content_hash = \$2 WHERE order_uid = \$1`).
+			WithArgs("uid-1", hash).
+			WillReturnResult(pgxmock.NewResult("UPDATE", 1))
+	}
+	patched := order
+	patched.TrackNumber = track
+
+	testCases := []struct {
+		name        string
+		mockSetup   func(mock pgxmock.PgxPoolIface)
+		call        func(s *Storage) error
+		expectedErr error
+	}{
+		{
+			name: "Успех: новый track_number попадает и в товары",
+			mockSetup: func(mock pgxmock.PgxPoolIface) {
+				mock.ExpectBegin()
+				mock.ExpectQuery(lockQuery).WithArgs("uid-1").WillReturnRows(pgxmock.NewRows([]string{"status"}).AddRow("paid"))
+				mock.ExpectExec(`UPDATE orders SET track_number = COALESCE\(\$2, track_number\)`).
+					WithArgs(anyArgs(10)...).
+					WillReturnResult(pgxmock.NewResult("UPDATE", 1))
+				mock.ExpectExec(`UPDATE items SET track_number = \$2 WHERE order_uid = \$1`).
+					WithArgs("uid-1", track).
+					WillReturnResult(pgxmock.NewResult("UPDATE", 2))
+				expectRehash(mock, patched)
+				mock.ExpectCommit()
+			},
+			call: func(s *Storage) error {
+				return s.UpdateOrder(context.Background(), "uid-1", entity.OrderPatch{TrackNumber: &track}, editable)
+			},
+		},
+		{
+			name: "Ошибка: отгруженный заказ менять нельзя",
+			mockSetup: func(mock pgxmock.PgxPoolIface) {
+				mock.ExpectBegin()
+				mock.ExpectQuery(lockQuery).WithArgs("uid-1").WillReturnRows(pgxmock.NewRows([]string{"status"}).AddRow("shipped"))
+				mock.ExpectRollback()
+			},
+			call: func(s *Storage) error {
+				return s.UpdateOrder(context.Background(), "uid-1", entity.OrderPatch{TrackNumber: &track}, editable)
+			},
+			expectedErr: fmt.Errorf("%w: order uid-1 is shipped", entity.ErrInvalidTransition),
+		},
+		{
+			name: "Успех: адрес доставки заменён",
+			mockSetup: func(mock pgxmock.PgxPoolIface) {
+				mock.ExpectBegin()
+				mock.ExpectQuery(lockQuery).WithArgs("uid-1").WillReturnRows(pgxmock.NewRows([]string{"status"}).AddRow("created"))
+				mock.ExpectExec(`UPDATE delivery SET name = \$2`).
+					WithArgs("uid-1", "Test", "+79990000000", "", "Moscow", "Lenina 1", "", "").
+					WillReturnResult(pgxmock.NewResult("UPDATE", 1))
+				mock.ExpectExec(`UPDATE orders SET updated_at = now\(\) WHERE order_uid = \$1`).
+					WithArgs("uid-1").
+					WillReturnResult(pgxmock.NewResult("UPDATE", 1))
+				expectRehash(mock, order)
+				mock.ExpectCommit()
+			},
+			call: func(s *Storage) error {
+				d := entity.Delivery{Name: "Test", Phone: "+79990000000", City: "Moscow", Address: "Lenina 1"}
+				return s.ChangeDelivery(context.Background(), "uid-1", d, editable)
+			},
+		},
+		{
+			name: "Ошибка: доставка несуществующего заказа",
+			mockSetup: func(mock pgxmock.PgxPoolIface) {
+				mock.ExpectBegin()
+				mock.ExpectQuery(lockQuery).WithArgs("missing").WillReturnError(pgx.ErrNoRows)
+				mock.ExpectRollback()
+			},
+			call: func(s *Storage) error {
+				return s.ChangeDelivery(context.Background(), "missing", entity.Delivery{}, editable)
+			},
+			expectedErr: fmt.Errorf("order missing: %w", entity.ErrNotFound),
+		},
+		{
+			name: "Успех: повторяющиеся rid возвращаются один раз",
+			mockSetup: func(mock pgxmock.PgxPoolIface) {
+				mock.ExpectBegin()
+				mock.ExpectQuery(lockQuery).WithArgs("uid-1").WillReturnRows(pgxmock.NewRows([]string{"status"}).AddRow("delivered"))
+				mock.ExpectQuery(`SELECT count\(\*\) FROM items WHERE order_uid = \$1 AND rid = ANY\(\$2\)`).
+					WithArgs("uid-1", []string{"rid-1", "rid-2"}).
+					WillReturnRows(pgxmock.NewRows([]string{"count"}).AddRow(2))
+				mock.ExpectExec(`UPDATE items SET returned_at = \$3 WHERE order_uid = \$1 AND rid = ANY\(\$2\) AND returned_at IS NULL`).
+					WithArgs("uid-1", []string{"rid-1", "rid-2"}, returnedAt).
+					WillReturnResult(pgxmock.NewResult("UPDATE", 2))
+				mock.ExpectExec(`UPDATE orders SET updated_at`).WithArgs("uid-1").WillReturnResult(pgxmock.NewResult("UPDATE", 1))
+				mock.ExpectCommit()
+			},
+			call: func(s *Storage) error {
+				return s.ReturnItems(context.Background(), "uid-1", []string{"rid-2", "rid-1", "rid-2"}, returnedAt, []entity.OrderStatus{entity.StatusDelivered})
+			},
+		},
+		{
+			name: "Ошибка: товар из другого заказа",
+			mockSetup: func(mock pgxmock.PgxPoolIface) {
+				mock.ExpectBegin()
+				mock.ExpectQuery(lockQuery).WithArgs("uid-1").WillReturnRows(pgxmock.NewRows([]string{"status"}).AddRow("delivered"))
+				mock.ExpectQuery(`SELECT count\(\*\) FROM items`).
+					WithArgs("uid-1", []string{"rid-1", "rid-9"}).
+					WillReturnRows(pgxmock.NewRows([]string{"count"}).AddRow(1))
+				mock.ExpectRollback()
+			},
+			call: func(s *Storage) error {
+				return s.ReturnItems(context.Background(), "uid-1", []string{"rid-1", "rid-9"}, returnedAt, []entity.OrderStatus{entity.StatusDelivered})
+			},
+			expectedErr: fmt.Errorf("%w: 1 of 2 returned items do not belong to order uid-1", entity.ErrInvalidOrder),
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			mock, err := pgxmock.NewPool()
+			if err != nil {
+				t.Fatalf("не удалось создать мок-пул: %v", err)
+			}
+			defer mock.Close()
+
+			s := &Storage{pool: mock}
+			tc.mockSetup(mock)
+
+			err = tc.call(s)
+			assertError(t, err, tc.expectedErr)
+			if sentinel := errors.Unwrap(tc.expectedErr); sentinel != nil && !errors.Is(err, sentinel) {
+				t.Errorf("ошибка %v должна оборачивать %v", err, sentinel)
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("были невыполненные ожидания мока: %s", err)
+			}
+		})
+	}
+}
@@ -13,9 +13,25 @@ CREATE TABLE IF NOT EXISTS orders (
     shardkey VARCHAR(10) NOT NULL DEFAULT '',
     sm_id INT NOT NULL DEFAULT 0,
     date_created TIMESTAMPTZ NOT NULL,
-    oof_shard VARCHAR(10) NOT NULL DEFAULT ''
+    oof_shard VARCHAR(10) NOT NULL DEFAULT '',
+    -- sha256 содержимого заказа, по нему отличаем повторно пришедший заказ от изменённого
+    content_hash VARCHAR(64) NOT NULL DEFAULT '',
+    -- sha256 сообщения, из которого заказ записан целиком; события об изменении заказа его не меняют,
+    -- поэтому повтор этого сообщения не откатывает изменения
+    source_hash VARCHAR(64) NOT NULL DEFAULT '',
+    -- время последней записи заказа, по нему кэш после загрузки снапшота догружает изменения
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    -- текущий статус заказа, история переходов - в order_status_history
+    status VARCHAR(20) NOT NULL DEFAULT 'created'
 );
 
+-- для баз, созданных до появления content_hash; у старых заказов хэш пустой,
+-- поэтому их повтор считается изменённым заказом
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS content_hash VARCHAR(64) NOT NULL DEFAULT '';
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS updated_at TIMESTAMPTZ NOT NULL DEFAULT now();
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS status VARCHAR(20) NOT NULL DEFAULT 'created';
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS source_hash VARCHAR(64) NOT NULL DEFAULT '';
+
 
 --- Таблица для информации о доставке (связь один-к-одному с orders)
 CREATE TABLE IF NOT EXISTS delivery (
@@ -59,7 +75,33 @@ CREATE TABLE IF NOT EXISTS items (
     total_price INT NOT NULL DEFAULT 0,
     nm_id INT NOT NULL DEFAULT 0,
     brand VARCHAR(255) NOT NULL DEFAULT '',
-    status INT NOT NULL DEFAULT 0
+    status INT NOT NULL DEFAULT 0,
+    -- время возврата товара, NULL - товар не возвращали
+    returned_at TIMESTAMPTZ
+);
+
+ALTER TABLE items ADD COLUMN IF NOT EXISTS returned_at TIMESTAMPTZ;
+
+CREATE INDEX IF NOT EXISTS idx_items_order_uid ON items(order_uid);
+
+
+--- История статусов заказа (связь один-ко-многим с orders), первая запись - создание заказа
+CREATE TABLE IF NOT EXISTS order_status_history (
+    id BIGSERIAL PRIMARY KEY,
+    order_uid VARCHAR(255) NOT NULL REFERENCES orders(order_uid) ON DELETE CASCADE,
+    -- NULL у записи о создании заказа
+    from_status VARCHAR(20),
+    to_status VARCHAR(20) NOT NULL,
+    changed_at TIMESTAMPTZ NOT NULL,
+    reason TEXT NOT NULL DEFAULT ''
 );
 
-CREATE INDEX IF NOT EXISTS idx_items_order_uid ON items(order_uid);
\ No newline at end of file
+CREATE INDEX IF NOT EXISTS idx_order_status_history_order_uid ON order_status_history(order_uid, changed_at);
+
+-- индексы для поиска заказов (GET /orders), сортировка и курсор идут по (date_created, order_uid)
+CREATE INDEX IF NOT EXISTS idx_orders_date_created ON orders(date_created, order_uid);
+CREATE INDEX IF NOT EXISTS idx_orders_updated_at ON orders(updated_at);
+CREATE INDEX IF NOT EXISTS idx_orders_customer_id ON orders(customer_id);
+CREATE INDEX IF NOT EXISTS idx_orders_track_number ON orders(track_number);
+CREATE INDEX IF NOT EXISTS idx_items_nm_id ON items(nm_id);
+CREATE INDEX IF NOT EXISTS idx_items_brand ON items(brand);